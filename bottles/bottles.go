@@ -0,0 +1,147 @@
+// Package bottles fills the placeholders of a rule command: the feeding
+// bottles b%('name')%b and the positional arguments b%(1)%b, b%(2)%b...
+package bottles
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "abbtr/internal/shell"
+)
+
+// Regex matches the feeding bottle syntax b%('name')%b, optionally with a
+// default value as in b%('name'|'default')%b. A name starting with '!' as in
+// b%('!password')%b declares a secret.
+var Regex = regexp.MustCompile(`b%\('([^']+)'(?:\|'([^']*)')?\)%b`)
+
+// ArgumentRegex matches the positional placeholders b%(1)%b, b%(2)%b...
+var ArgumentRegex = regexp.MustCompile(`b%\(([0-9]+)\)%b`)
+
+// Redacted replaces the value of secret bottles wherever a command is shown
+// or logged
+const Redacted = "***"
+
+// Bottle is a feeding bottle declared in a command
+type Bottle struct {
+    Name string
+    // Default is used when the user enters nothing. HasDefault tells an
+    // empty default from none at all.
+    Default    string
+    HasDefault bool
+    // Secret values are typed without echo and never shown or logged
+    Secret bool
+    // Spec is what the rule declared about the values it accepts
+    Spec Spec
+    // Invalid tells why the previous answer was refused when the prompt is
+    // repeated
+    Invalid error
+}
+
+// Prompter asks the user for the value of a bottle. An empty answer selects
+// the default of the bottle, if it has one. Answers the Spec refuses are
+// asked for again.
+type Prompter func(bottle Bottle) (string, error)
+
+// Has reports whether a command needs anything filled in at run time
+func Has(command string) bool {
+    return Regex.MatchString(command) || ArgumentRegex.MatchString(command)
+}
+
+// Parse returns the bottles of a command in order of appearance, once each.
+// The first default given for a bottle wins.
+func Parse(command string) []Bottle {
+    var found []Bottle
+    index := make(map[string]int)
+    for _, match := range Regex.FindAllStringSubmatchIndex(command, -1) {
+        bottle := parseMatch(command, match)
+        i, seen := index[bottle.Name]
+        if !seen {
+            index[bottle.Name] = len(found)
+            found = append(found, bottle)
+        } else {
+            if !found[i].HasDefault && bottle.HasDefault {
+                found[i].Default, found[i].HasDefault = bottle.Default, true
+            }
+            // Declaring a bottle secret once is enough
+            found[i].Secret = found[i].Secret || bottle.Secret
+        }
+    }
+    return found
+}
+
+// parseMatch builds a Bottle from the submatch indexes of Regex
+func parseMatch(command string, match []int) Bottle {
+    bottle := Bottle{Name: command[match[2]:match[3]]}
+    if len(bottle.Name) > 1 && strings.HasPrefix(bottle.Name, "!") {
+        bottle.Name, bottle.Secret = bottle.Name[1:], true
+    }
+    if match[4] >= 0 {
+        bottle.Default, bottle.HasDefault = command[match[4]:match[5]], true
+    }
+    return bottle
+}
+
+// InsertArguments inserts the arguments given after the rule name. Each
+// b%(N)%b placeholder takes the Nth argument and the arguments no placeholder
+// used are appended to the command, like an alias would do, see
+// shell.Append. Every argument is quoted so it reaches the command as a
+// single word.
+func InsertArguments(command string, args []string) (string, error) {
+    command, rest, err := PlaceArguments(command, args)
+    if err != nil || len(rest) == 0 {
+        return command, err
+    }
+    words := make([]string, len(rest))
+    for i, arg := range rest {
+        words[i] = shell.Quote(arg)
+    }
+    return shell.Append(command, strings.Join(words, " ")), nil
+}
+
+// PlaceArguments is InsertArguments for shell commands receiving their
+// other arguments as positional parameters, such as scripts of several
+// lines. The arguments no placeholder used are returned instead of being
+// appended.
+func PlaceArguments(command string, args []string) (string, []string, error) {
+    used := make([]bool, len(args))
+    var missing []string
+
+    command = ArgumentRegex.ReplaceAllStringFunc(command, func(match string) string {
+        position, _ := strconv.Atoi(ArgumentRegex.FindStringSubmatch(match)[1])
+        if position < 1 || position > len(args) {
+            missing = append(missing, match)
+            return match
+        }
+        used[position-1] = true
+        return shell.Quote(args[position-1])
+    })
+
+    if len(missing) > 0 {
+        return "", nil, fmt.Errorf("missing arguments for %s", strings.Join(missing, ", "))
+    }
+
+    var rest []string
+    for i, arg := range args {
+        if !used[i] {
+            rest = append(rest, arg)
+        }
+    }
+
+    return command, rest, nil
+}
+
+// EnvName returns the environment variable that predefines a bottle
+func EnvName(name string) string {
+    var b strings.Builder
+    b.WriteString("ABBTR_BOTTLE_")
+    for _, r := range name {
+        if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+            b.WriteRune(r)
+        } else {
+            b.WriteRune('_')
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,128 @@
+package bottles
+
+import (
+    "errors"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestInsertArguments(t *testing.T) {
+    tests := []struct {
+        command string
+        args    []string
+        want    string
+    }{
+        {"git status", nil, "git status"},
+        {"git status", []string{"-s"}, "git status -s"},
+        {"echo", []string{"a b", "it's"}, `echo 'a b' 'it'\''s'`},
+        {"scp b%(1)%b host:/tmp", []string{"notes.txt", "-v"}, "scp notes.txt host:/tmp -v"},
+        {"echo b%(2)%b b%(1)%b b%(2)%b", []string{"x", "$y"}, `echo '$y' x '$y'`},
+    }
+
+    for _, tc := range tests {
+        got, err := InsertArguments(tc.command, tc.args)
+        if err != nil {
+            t.Errorf("%q %q: %v", tc.command, tc.args, err)
+            continue
+        }
+        if got != tc.want {
+            t.Errorf("%q %q: got %q, want %q", tc.command, tc.args, got, tc.want)
+        }
+    }
+
+    _, err := InsertArguments("echo b%(2)%b", []string{"only one"})
+    if err == nil {
+        t.Error("expected an error for a missing argument")
+    }
+}
+
+func TestFill(t *testing.T) {
+    t.Setenv("ABBTR_BOTTLE_host", "from-env")
+    t.Setenv("ABBTR_BOTTLE_user_name", "env-user")
+
+    var asked []string
+    prompt := func(bottle Bottle) (string, error) {
+        asked = append(asked, bottle.Name)
+        if bottle.HasDefault {
+            return "", nil
+        }
+        return "typed-" + bottle.Name, nil
+    }
+
+    r := &Resolver{Flags: map[string]string{"host": "given"}, Prompt: prompt}
+    got, err := r.Fill("", "ssh -p b%('port')%b b%('user-name')%b@b%('host')%b b%('port')%b", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != "ssh -p typed-port env-user@given typed-port" {
+        t.Errorf("got %q", got)
+    }
+
+    // Answers are reused by the next commands and Enter takes the default
+    got, err = r.Fill("", "echo b%('port')%b b%('user'|'root')%b b%('user')%b", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != "echo typed-port root root" {
+        t.Errorf("got %q", got)
+    }
+    if strings.Join(asked, ",") != "port,user" {
+        t.Errorf("prompted for %v", asked)
+    }
+    if value, _ := r.Resolved("", "user"); value.Source != FromDefault {
+        t.Errorf("user came from %s", value.Source)
+    }
+
+    // Without a prompt only the defaults can be used
+    got, err = new(Resolver).Fill("", "echo b%('empty'|'')%b b%('user'|'root')%b", nil)
+    if err != nil || got != "echo  root" {
+        t.Errorf("got %q, %v", got, err)
+    }
+    _, err = new(Resolver).Fill("", "echo b%('missing')%b", nil)
+    if err == nil {
+        t.Error("expected an error without a prompt")
+    }
+
+    failure := errors.New("no terminal")
+    r = &Resolver{Prompt: func(Bottle) (string, error) { return "", failure }}
+    _, err = r.Fill("", "echo b%('missing')%b", nil)
+    if err != failure {
+        t.Errorf("got %v, want the prompt error", err)
+    }
+}
+
+func TestParse(t *testing.T) {
+    got := Parse("b%('a')%b b%('b'|'x y')%b b%('a'|'later')%b b%('b'|'ignored')%b b%(1)%b")
+    want := []Bottle{{Name: "a", Default: "later", HasDefault: true}, {Name: "b", Default: "x y", HasDefault: true}}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %+v, want %+v", got, want)
+    }
+    if !Has("echo b%(1)%b") || !Has("echo b%('x'|'y')%b") || Has("echo b%(x)%b") {
+        t.Error("Has does not match the placeholders")
+    }
+}
+
+func TestRedact(t *testing.T) {
+    t.Setenv("ABBTR_BOTTLE_token", "env-token")
+
+    command := "login b%('user')%b b%('!password')%b b%('password')%b b%('!token')%b"
+    r := &Resolver{Flags: map[string]string{"user": "alice", "password": "s3cret with spaces"}}
+    filled, err := r.Fill("", command, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if filled != "login alice s3cret with spaces s3cret with spaces env-token" {
+        t.Errorf("got %q", filled)
+    }
+
+    shown := r.Redact("", command)
+    if shown != "login alice *** *** ***" {
+        t.Errorf("got %q", shown)
+    }
+
+    bottles := Parse(command)
+    if len(bottles) != 3 || bottles[1].Name != "password" || !bottles[1].Secret || bottles[0].Secret {
+        t.Errorf("got %+v", bottles)
+    }
+}
@@ -0,0 +1,100 @@
+package bottles
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// ReadFile reads bottle values from a dotenv style file
+func ReadFile(path string) (map[string]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    values, err := ParseFile(file)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return values, nil
+}
+
+// ParseFile reads "name=value" lines. Blank lines, lines starting with '#'
+// and a leading "export " are ignored. Values may be wrapped in single
+// quotes, taken literally, or in double quotes, where \n, \t, \" and \\ are
+// escapes. Unquoted values end at " #", which starts a comment.
+func ParseFile(r io.Reader) (map[string]string, error) {
+    values := make(map[string]string)
+
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    number := 0
+    for scanner.Scan() {
+        number++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        line = strings.TrimPrefix(line, "export ")
+
+        parts := strings.SplitN(line, "=", 2)
+        name := strings.TrimSpace(parts[0])
+        if len(parts) != 2 || name == "" {
+            return nil, fmt.Errorf("line %d: expected name=value", number)
+        }
+
+        value, err := parseFileValue(strings.TrimSpace(parts[1]))
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", number, err)
+        }
+        values[name] = value
+    }
+
+    return values, scanner.Err()
+}
+
+func parseFileValue(value string) (string, error) {
+    if value == "" {
+        return "", nil
+    }
+
+    switch value[0] {
+    case '\'':
+        end := strings.IndexByte(value[1:], '\'')
+        if end < 0 {
+            return "", fmt.Errorf("unterminated quote")
+        }
+        return value[1 : end+1], nil
+    case '"':
+        var b strings.Builder
+        for i := 1; i < len(value); i++ {
+            c := value[i]
+            if c == '"' {
+                return b.String(), nil
+            }
+            if c == '\\' && i+1 < len(value) {
+                i++
+                switch value[i] {
+                case 'n':
+                    b.WriteByte('\n')
+                case 't':
+                    b.WriteByte('\t')
+                default:
+                    b.WriteByte(value[i])
+                }
+                continue
+            }
+            b.WriteByte(c)
+        }
+        return "", fmt.Errorf("unterminated quote")
+    }
+
+    if i := strings.Index(value, " #"); i >= 0 {
+        value = strings.TrimSpace(value[:i])
+    }
+    return value, nil
+}
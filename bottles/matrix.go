@@ -0,0 +1,63 @@
+package bottles
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Axis is a bottle given a list of values with --matrix=<bottle>:<a,b,c>
+type Axis struct {
+    Bottle string
+    Values []string
+}
+
+// Matrix runs the rules once for every combination of the values of its
+// axes
+type Matrix []Axis
+
+// Combinations returns the values of every iteration of the matrix, the
+// last axis changing fastest. Without axes there is a single iteration
+// with no values.
+func (m Matrix) Combinations() []map[string]string {
+    combinations := []map[string]string{{}}
+    for _, axis := range m {
+        var next []map[string]string
+        for _, combination := range combinations {
+            for _, value := range axis.Values {
+                values := make(map[string]string, len(combination)+1)
+                for name, v := range combination {
+                    values[name] = v
+                }
+                values[axis.Bottle] = value
+                next = append(next, values)
+            }
+        }
+        combinations = next
+    }
+    return combinations
+}
+
+// Check makes sure every axis gives its bottle a value, a matrix with an
+// empty axis has no iteration to run
+func (m Matrix) Check() error {
+    for _, axis := range m {
+        if len(axis.Values) == 0 {
+            return fmt.Errorf("the matrix gives no value to bottle '%s'", axis.Bottle)
+        }
+    }
+    return nil
+}
+
+// Label names an iteration of the matrix, as in "host=web1 env=prod". The
+// values of secret bottles are hidden.
+func (m Matrix) Label(values map[string]string, secrets map[string]bool) string {
+    var parts []string
+    for _, axis := range m {
+        value := values[axis.Bottle]
+        if secrets[axis.Bottle] {
+            value = Redacted
+        }
+        parts = append(parts, axis.Bottle+"="+value)
+    }
+    return strings.Join(parts, " ")
+}
@@ -0,0 +1,45 @@
+package bottles
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+    if got := Matrix(nil).Combinations(); !reflect.DeepEqual(got, []map[string]string{{}}) {
+        t.Errorf("no axes: got %v, want a single iteration", got)
+    }
+
+    matrix := Matrix{{Bottle: "host", Values: []string{"web1", "web2"}}, {Bottle: "env", Values: []string{"dev", "prod"}}}
+    want := []map[string]string{
+        {"host": "web1", "env": "dev"},
+        {"host": "web1", "env": "prod"},
+        {"host": "web2", "env": "dev"},
+        {"host": "web2", "env": "prod"},
+    }
+    if got := matrix.Combinations(); !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v, want %v", got, want)
+    }
+}
+
+func TestMatrixCheck(t *testing.T) {
+    if err := (Matrix{{Bottle: "host", Values: []string{"web1"}}}).Check(); err != nil {
+        t.Error(err)
+    }
+    matrix := Matrix{{Bottle: "host", Values: []string{"web1"}}, {Bottle: "env"}}
+    if err := matrix.Check(); err == nil || err.Error() != "the matrix gives no value to bottle 'env'" {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestMatrixLabel(t *testing.T) {
+    matrix := Matrix{{Bottle: "host", Values: []string{"web1"}}, {Bottle: "token", Values: []string{"s3cret"}}}
+    values := matrix.Combinations()[0]
+
+    if got := matrix.Label(values, nil); got != "host=web1 token=s3cret" {
+        t.Errorf("got %q", got)
+    }
+    if got := matrix.Label(values, map[string]bool{"token": true}); got != "host=web1 token="+Redacted {
+        t.Errorf("secret shown: %q", got)
+    }
+}
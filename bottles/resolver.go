@@ -0,0 +1,349 @@
+package bottles
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+// Source tells where the value of a bottle came from
+type Source string
+
+const (
+    FromMatrix  Source = "matrix"
+    FromFlag    Source = "-b="
+    FromProfile Source = "profile"
+    FromFile    Source = "bottles file"
+    FromEnv     Source = "environment"
+    FromCommand Source = "command"
+    FromPrompt  Source = "prompt"
+    FromDefault Source = "default"
+)
+
+// Value is a resolved bottle
+type Value struct {
+    Value  string
+    Source Source
+    // Rule is set when the value was given for that rule only, as in
+    // -b=ssh.username:alice
+    Rule string
+    // Pending is set by Explain for bottles that only the prompt can fill
+    Pending bool
+}
+
+// Resolution is the value Explain found for a bottle of a rule
+type Resolution struct {
+    Bottle Bottle
+    Value
+}
+
+// key identifies a resolved value. Values shared by every rule have no rule.
+type key struct {
+    rule string
+    name string
+}
+
+// Resolver fills the bottles of commands. Each bottle takes its value from
+// the first of these sources that has one:
+//
+//  1. Matrix, the values of the current iteration of a matrix run
+//  2. Flags, the values given with -b=
+//  3. Profile, the values of the profile given with -p
+//  4. File, the values read from a bottles file
+//  5. the ABBTR_BOTTLE_<name> environment variable, then the variable named
+//     by the Env of its spec
+//  6. the output of the Command of its spec
+//  7. Prompt, where an empty answer selects the default
+//
+// Matrix, Flags, Profile and File may scope a value to one rule by naming
+// the bottle <rule>.<name>. Scoped values win over the others and are only
+// used by that rule.
+//
+// Without a Prompt the default is used and bottles without one are an
+// error. A bottle is resolved once and its value reused by every command
+// filled afterwards, except for the rules it has a scoped value for.
+type Resolver struct {
+    Matrix  map[string]string
+    Flags   map[string]string
+    Profile map[string]string
+    File    map[string]string
+    Prompt  Prompter
+
+    resolved map[key]Value
+}
+
+// Fill replaces every bottle in the command of a rule. Every value must
+// satisfy the spec given for its bottle, answers that do not are asked for
+// again. Use Redact for the version of the command that can be shown.
+func (r *Resolver) Fill(rule, command string, specs map[string]Spec) (string, error) {
+    for _, bottle := range Parse(command) {
+        bottle.Spec = specs[bottle.Name]
+        _, err := r.value(rule, bottle, true)
+        if err != nil {
+            return "", err
+        }
+    }
+
+    return r.substitute(rule, command, nil), nil
+}
+
+// Fork returns a resolver for one iteration of a matrix run, with matrix as
+// its Matrix. It starts from the values r resolved, except those of the
+// bottles named in r.Matrix or matrix. Forks of the same resolver can be used
+// at the same time.
+func (r *Resolver) Fork(matrix map[string]string) *Resolver {
+    fork := &Resolver{
+        Matrix:   matrix,
+        Flags:    r.Flags,
+        Profile:  r.Profile,
+        File:     r.File,
+        Prompt:   r.Prompt,
+        resolved: make(map[key]Value, len(r.resolved)),
+    }
+    for k, value := range r.resolved {
+        if value.Source == FromMatrix {
+            continue
+        }
+        _, plain := matrix[k.name]
+        _, scoped := matrix[k.rule+"."+k.name]
+        if plain || (k.rule != "" && scoped) {
+            continue
+        }
+        fork.resolved[k] = value
+    }
+    return fork
+}
+
+// Explain resolves the bottles of a rule like Fill would, without prompting.
+// The bottles left to the prompt are Pending.
+func (r *Resolver) Explain(rule, command string, specs map[string]Spec) ([]Resolution, error) {
+    var resolutions []Resolution
+    for _, bottle := range Parse(command) {
+        bottle.Spec = specs[bottle.Name]
+        value, err := r.value(rule, bottle, false)
+        if err != nil {
+            return nil, err
+        }
+        resolutions = append(resolutions, Resolution{Bottle: bottle, Value: value})
+    }
+    return resolutions, nil
+}
+
+// value returns the value a rule gets for a bottle, resolving it if no rule
+// did before. Unless ask is set the prompt is not used and bottles needing it
+// are returned Pending.
+func (r *Resolver) value(rule string, bottle Bottle, ask bool) (Value, error) {
+    if r.resolved == nil {
+        r.resolved = make(map[key]Value)
+    }
+
+    scoped := key{rule: rule, name: bottle.Name}
+    if known, ok := r.resolved[scoped]; ok {
+        return known, nil
+    }
+    if given, source, ok := r.scoped(rule, bottle.Name); ok {
+        value, err := accept(bottle, given)
+        if err != nil {
+            return Value{}, fmt.Errorf("bottle '%s' (from %s%s.%s): %v", bottle.Name, source, rule, bottle.Name, err)
+        }
+        known := Value{Value: value, Source: source, Rule: rule}
+        r.resolved[scoped] = known
+        return known, nil
+    }
+
+    shared := key{name: bottle.Name}
+    if known, ok := r.resolved[shared]; ok {
+        // Another rule asked first, its answer must suit this one too
+        if _, err := accept(bottle, known.Value); err != nil && !known.Pending {
+            return Value{}, fmt.Errorf("bottle '%s': %v", bottle.Name, err)
+        }
+        return known, nil
+    }
+
+    known, err := r.resolve(bottle, ask)
+    if err != nil {
+        return Value{}, err
+    }
+    r.resolved[shared] = known
+    return known, nil
+}
+
+// resolve finds the value of a bottle no command used before
+func (r *Resolver) resolve(bottle Bottle, ask bool) (Value, error) {
+    given, source, ok := r.given(bottle)
+    if !ok && bottle.Spec.Command != "" {
+        output, err := runSource(bottle.Spec.Command)
+        if err != nil {
+            return Value{}, fmt.Errorf("bottle '%s': %v", bottle.Name, err)
+        }
+        given, source, ok = output, FromCommand, true
+    }
+    if !ok && !ask {
+        return Value{Source: FromPrompt, Pending: true}, nil
+    }
+    if !ok && r.Prompt == nil {
+        if !bottle.HasDefault {
+            return Value{}, fmt.Errorf("no value given for the bottle '%s'", bottle.Name)
+        }
+        given, source, ok = bottle.Default, FromDefault, true
+    }
+    if ok {
+        value, err := accept(bottle, given)
+        if err != nil {
+            return Value{}, fmt.Errorf("bottle '%s' (from %s): %v", bottle.Name, source, err)
+        }
+        return Value{Value: value, Source: source}, nil
+    }
+
+    for {
+        answer, err := r.Prompt(bottle)
+        if err != nil {
+            return Value{}, err
+        }
+        source = FromPrompt
+        if answer == "" && bottle.HasDefault {
+            answer, source = bottle.Default, FromDefault
+        }
+        value, err := accept(bottle, answer)
+        if err == nil {
+            return Value{Value: value, Source: source}, nil
+        }
+        bottle.Invalid = err
+    }
+}
+
+// accept checks a value against the spec of a bottle. The values of secret
+// bottles are left out of the error, which may be printed or logged.
+func accept(bottle Bottle, value string) (string, error) {
+    accepted, err := bottle.Spec.Accept(value)
+    if refused, ok := err.(*ValueError); ok && bottle.Secret {
+        refused.Value = Redacted
+    }
+    return accepted, err
+}
+
+// scoped returns the value given for a bottle of one rule only
+func (r *Resolver) scoped(rule, name string) (string, Source, bool) {
+    if rule == "" {
+        return "", "", false
+    }
+    name = rule + "." + name
+    if value, ok := r.Matrix[name]; ok {
+        return value, FromMatrix, true
+    }
+    if value, ok := r.Flags[name]; ok {
+        return value, FromFlag, true
+    }
+    if value, ok := r.Profile[name]; ok {
+        return value, FromProfile, true
+    }
+    if value, ok := r.File[name]; ok {
+        return value, FromFile, true
+    }
+    return "", "", false
+}
+
+// given returns the value of a bottle available to every rule without
+// asking anyone or running anything
+func (r *Resolver) given(bottle Bottle) (string, Source, bool) {
+    if value, ok := r.Matrix[bottle.Name]; ok {
+        return value, FromMatrix, true
+    }
+    if value, ok := r.Flags[bottle.Name]; ok {
+        return value, FromFlag, true
+    }
+    if value, ok := r.Profile[bottle.Name]; ok {
+        return value, FromProfile, true
+    }
+    if value, ok := r.File[bottle.Name]; ok {
+        return value, FromFile, true
+    }
+    if value, ok := os.LookupEnv(EnvName(bottle.Name)); ok {
+        return value, FromEnv, true
+    }
+    if bottle.Spec.Env != "" {
+        if value, ok := os.LookupEnv(bottle.Spec.Env); ok {
+            return value, FromEnv, true
+        }
+    }
+    return "", "", false
+}
+
+// Check validates the values given for the bottles of a rule by the matrix,
+// -b=, the profile, the bottles file or the environment, so nothing runs when one is
+// refused
+func (r *Resolver) Check(rule, command string, specs map[string]Spec) error {
+    for _, bottle := range Parse(command) {
+        bottle.Spec = specs[bottle.Name]
+        if value, source, ok := r.scoped(rule, bottle.Name); ok {
+            if _, err := accept(bottle, value); err != nil {
+                return fmt.Errorf("bottle '%s' (from %s%s.%s): %v", bottle.Name, source, rule, bottle.Name, err)
+            }
+            continue
+        }
+        value, source, ok := r.given(bottle)
+        if !ok {
+            continue
+        }
+        if _, err := accept(bottle, value); err != nil {
+            return fmt.Errorf("bottle '%s' (from %s): %v", bottle.Name, source, err)
+        }
+    }
+    return nil
+}
+
+// Resolved returns the value a rule received for a bottle
+func (r *Resolver) Resolved(rule, name string) (Value, bool) {
+    if value, ok := r.resolved[key{rule: rule, name: name}]; ok {
+        return value, true
+    }
+    value, ok := r.resolved[key{name: name}]
+    return value, ok
+}
+
+// Redact returns the command of a rule as Fill did, except that secret
+// bottles read Redacted
+func (r *Resolver) Redact(rule, command string) string {
+    secrets := make(map[string]bool)
+    for _, bottle := range Parse(command) {
+        if bottle.Secret {
+            secrets[bottle.Name] = true
+        }
+    }
+    return r.substitute(rule, command, secrets)
+}
+
+// substitute replaces every resolved bottle by the value the rule received,
+// or by Redacted for the names in hidden. Pending bottles are left in place.
+func (r *Resolver) substitute(rule, command string, hidden map[string]bool) string {
+    return Regex.ReplaceAllStringFunc(command, func(match string) string {
+        name := parseMatch(match, Regex.FindStringSubmatchIndex(match)).Name
+        value, ok := r.Resolved(rule, name)
+        if !ok || value.Pending {
+            return match
+        }
+        if hidden[name] {
+            return Redacted
+        }
+        return value.Value
+    })
+}
+
+// runSource runs the command of a spec and returns its output without the
+// final line break
+func runSource(command string) (string, error) {
+    var stderr bytes.Buffer
+    cmd := exec.Command("bash", "-c", command)
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        message := strings.TrimSpace(stderr.String())
+        if message == "" {
+            return "", fmt.Errorf("command %q failed: %v", command, err)
+        }
+        return "", fmt.Errorf("command %q failed: %v: %s", command, err, message)
+    }
+    return strings.TrimRight(string(out), "\r\n"), nil
+}
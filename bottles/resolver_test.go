@@ -0,0 +1,216 @@
+package bottles
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestResolverPrecedence(t *testing.T) {
+    t.Setenv("ABBTR_BOTTLE_a", "env-a")
+    t.Setenv("ABBTR_BOTTLE_b", "env-b")
+    t.Setenv("ABBTR_BOTTLE_c", "env-c")
+    t.Setenv("DEPLOY_TARGET", "spec-env")
+
+    specs := map[string]Spec{
+        "d": {Env: "DEPLOY_TARGET", Command: "echo unused"},
+        "e": {Command: "printf 'from command\\n\\n'"},
+        "f": {Env: "UNSET_VARIABLE_FOR_TEST"},
+    }
+    r := &Resolver{
+        Flags:   map[string]string{"a": "flag-a"},
+        Profile: map[string]string{"a": "profile-a", "g": "profile-g"},
+        File:    map[string]string{"a": "file-a", "b": "file-b", "g": "file-g"},
+    }
+
+    got, err := r.Fill("", "b%('a')%b|b%('b')%b|b%('c')%b|b%('d')%b|b%('e')%b|b%('f'|'default')%b|b%('g')%b", specs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != "flag-a|file-b|env-c|spec-env|from command|default|profile-g" {
+        t.Errorf("got %q", got)
+    }
+
+    sources := map[string]Source{"a": FromFlag, "b": FromFile, "c": FromEnv, "d": FromEnv, "e": FromCommand, "f": FromDefault, "g": FromProfile}
+    for name, want := range sources {
+        if value, _ := r.Resolved("", name); value.Source != want {
+            t.Errorf("%s came from %s, want %s", name, value.Source, want)
+        }
+    }
+}
+
+func TestResolverCommandSource(t *testing.T) {
+    r := &Resolver{}
+    _, err := r.Fill("", "echo b%('x')%b", map[string]Spec{"x": {Command: "echo broken >&2; exit 3"}})
+    if err == nil || !strings.Contains(err.Error(), "broken") {
+        t.Errorf("got %v", err)
+    }
+
+    // Command output is validated like any other value
+    _, err = r.Fill("", "echo b%('y')%b", map[string]Spec{"y": {Type: "port", Command: "echo ssh"}})
+    if err == nil || !strings.Contains(err.Error(), "from command") {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestParseFile(t *testing.T) {
+    text := `# deploy values
+host = db.example.com
+export user=alice
+empty=
+comment=value # ignored
+single='$HOME # kept'
+double="a \"b\"\n\tc"
+
+hash=a#b
+`
+    got, err := ParseFile(strings.NewReader(text))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{
+        "host":    "db.example.com",
+        "user":    "alice",
+        "empty":   "",
+        "comment": "value",
+        "single":  "$HOME # kept",
+        "double":  "a \"b\"\n\tc",
+        "hash":    "a#b",
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+
+    for _, bad := range []string{"no value", "=x", "x='open", `x="open`} {
+        if _, err := ParseFile(strings.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "line 1") {
+            t.Errorf("%q: got %v", bad, err)
+        }
+    }
+}
+
+func TestResolverScopedValues(t *testing.T) {
+    var asked []string
+    r := &Resolver{
+        Flags:   map[string]string{"ssh.user": "alice", "user": "bob"},
+        Profile: map[string]string{"deploy.host": "prod1", "host": "shared"},
+        Prompt: func(bottle Bottle) (string, error) {
+            asked = append(asked, bottle.Name)
+            return "typed", nil
+        },
+    }
+
+    tests := []struct {
+        rule string
+        want string
+    }{
+        {"ssh", "alice shared typed"},
+        {"deploy", "bob prod1 typed"},
+        {"other", "bob shared typed"},
+    }
+    for _, tc := range tests {
+        got, err := r.Fill(tc.rule, "b%('user')%b b%('host')%b b%('port')%b", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got != tc.want {
+            t.Errorf("%s: got %q, want %q", tc.rule, got, tc.want)
+        }
+    }
+    if strings.Join(asked, ",") != "port" {
+        t.Errorf("prompted for %v", asked)
+    }
+    if value, _ := r.Resolved("ssh", "user"); value.Rule != "ssh" || value.Source != FromFlag {
+        t.Errorf("got %+v", value)
+    }
+
+    r = &Resolver{Flags: map[string]string{"ssh.port": "http", "port": "22"}}
+    err := r.Check("ssh", "b%('port')%b", map[string]Spec{"port": {Type: "port"}})
+    if err == nil || !strings.Contains(err.Error(), "-b=ssh.port") {
+        t.Errorf("got %v", err)
+    }
+    if r.Check("deploy", "b%('port')%b", map[string]Spec{"port": {Type: "port"}}) != nil {
+        t.Error("a value scoped to another rule was checked")
+    }
+}
+
+func TestResolverExplain(t *testing.T) {
+    r := &Resolver{
+        Flags:  map[string]string{"ssh.user": "alice"},
+        Prompt: func(Bottle) (string, error) { t.Fatal("a dry run prompted"); return "", nil },
+    }
+
+    command := "echo b%('user')%b b%('port'|'22')%b"
+    for _, rule := range []string{"ssh", "deploy"} {
+        resolutions, err := r.Explain(rule, command, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(resolutions) != 2 || !resolutions[1].Pending || resolutions[1].Bottle.Default != "22" {
+            t.Fatalf("%s: got %+v", rule, resolutions)
+        }
+        if got := r.Redact(rule, command); rule == "ssh" && got != "echo alice b%('port'|'22')%b" {
+            t.Errorf("got %q", got)
+        }
+    }
+    if value, _ := r.Resolved("deploy", "user"); !value.Pending {
+        t.Errorf("deploy got %+v", value)
+    }
+}
+
+func TestResolverFork(t *testing.T) {
+    var asked []string
+    r := &Resolver{
+        Flags: map[string]string{"host": "flag"},
+        Prompt: func(bottle Bottle) (string, error) {
+            asked = append(asked, bottle.Name)
+            return "typed", nil
+        },
+    }
+
+    command := "b%('host')%b b%('user')%b"
+    prepared := r.Fork(map[string]string{"host": "web1"})
+    if got, _ := prepared.Fill("ping", command, nil); got != "web1 typed" {
+        t.Errorf("got %q", got)
+    }
+
+    for _, host := range []string{"web2", "web3"} {
+        iteration := prepared.Fork(map[string]string{"host": host})
+        got, err := iteration.Fill("ping", command, nil)
+        if err != nil || got != host+" typed" {
+            t.Errorf("got %q, %v", got, err)
+        }
+        if value, _ := iteration.Resolved("ping", "host"); value.Source != FromMatrix {
+            t.Errorf("host came from %s", value.Source)
+        }
+    }
+    if len(asked) != 1 {
+        t.Errorf("prompted for %v", asked)
+    }
+
+    if got, _ := r.Fill("ping", command, nil); got != "flag typed" {
+        t.Errorf("the fork changed its parent: %q", got)
+    }
+}
+
+func TestResolverHidesRefusedSecrets(t *testing.T) {
+    r := &Resolver{Flags: map[string]string{"token": "SuperSecretValue123"}}
+    _, err := r.Fill("", "curl -H b%('!token')%b", map[string]Spec{"token": {Pattern: "[a-f0-9]{8}"}})
+    if err == nil || strings.Contains(err.Error(), "SuperSecret") || !strings.Contains(err.Error(), "'***' does not match") {
+        t.Errorf("got %v", err)
+    }
+
+    var refused []string
+    r = &Resolver{Prompt: func(bottle Bottle) (string, error) {
+        if bottle.Invalid != nil {
+            refused = append(refused, bottle.Invalid.Error())
+        }
+        if len(refused) == 0 {
+            return "typed-secret", nil
+        }
+        return "cafe1234", nil
+    }}
+    _, err = r.Fill("", "b%('!token')%b", map[string]Spec{"token": {Pattern: "[a-f0-9]{8}"}})
+    if err != nil || len(refused) != 1 || strings.Contains(refused[0], "typed-secret") {
+        t.Errorf("got %v, %q", err, refused)
+    }
+}
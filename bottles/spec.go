@@ -0,0 +1,194 @@
+package bottles
+
+import (
+    "fmt"
+    "net"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Types lists the values accepted for Spec.Type
+var Types = []string{"int", "port", "path", "hostname"}
+
+// hostnameRegex matches a host name made of RFC 1123 labels
+var hostnameRegex = regexp.MustCompile(`^(?i:[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)(\.(?i:[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?))*\.?$`)
+
+// Spec restricts the values a bottle accepts. It is stored with the rule
+// declaring the bottle.
+type Spec struct {
+    // Type is one of Types, or empty for free text
+    Type string `json:"type,omitempty"`
+    // Choices are offered as a numbered menu and are the only values
+    // accepted when present
+    Choices []string `json:"choices,omitempty"`
+    // Pattern is a regular expression the whole value must match
+    Pattern string `json:"pattern,omitempty"`
+    // Prompt replaces "The <name> is?" when asking for the value
+    Prompt string `json:"prompt,omitempty"`
+    // Env names an environment variable holding the value
+    Env string `json:"env,omitempty"`
+    // Command is a shell command whose output is the value, asked for when
+    // no other source has one
+    Command string `json:"command,omitempty"`
+}
+
+// IsZero reports whether the spec accepts anything
+func (s Spec) IsZero() bool {
+    return s.Type == "" && len(s.Choices) == 0 && s.Pattern == "" && s.Prompt == "" && s.Env == "" && s.Command == ""
+}
+
+// Set changes one attribute from its command line form, as in
+// choices=dev,prod or type=port. An empty value clears the attribute.
+func (s *Spec) Set(attr, value string) error {
+    switch attr {
+    case "type":
+        if value != "" && !isType(value) {
+            return fmt.Errorf("unknown bottle type '%s', use one of %s", value, strings.Join(Types, ", "))
+        }
+        s.Type = value
+    case "choices":
+        s.Choices = nil
+        for _, choice := range strings.Split(value, ",") {
+            choice = strings.TrimSpace(choice)
+            if choice != "" {
+                s.Choices = append(s.Choices, choice)
+            }
+        }
+    case "pattern":
+        if _, err := regexp.Compile(value); err != nil {
+            return fmt.Errorf("invalid bottle pattern: %v", err)
+        }
+        s.Pattern = value
+    case "prompt":
+        s.Prompt = value
+    case "env":
+        s.Env = value
+    case "command":
+        s.Command = value
+    default:
+        return fmt.Errorf("unknown bottle attribute '%s', use type, choices, pattern, prompt, env or command", attr)
+    }
+    return nil
+}
+
+// ValueError is returned by Accept for a value the spec refuses
+type ValueError struct {
+    Value string
+    // Reason follows the value in the message, as in "is not a whole number"
+    Reason string
+}
+
+func (e *ValueError) Error() string {
+    return fmt.Sprintf("'%s' %s", e.Value, e.Reason)
+}
+
+// Accept checks a value against the spec and returns it as it should be
+// used. The number of an entry of Choices selects that entry. Refused values
+// are reported with a *ValueError.
+func (s Spec) Accept(value string) (string, error) {
+    if len(s.Choices) > 0 {
+        if n, err := strconv.Atoi(value); err == nil && n >= 1 && n <= len(s.Choices) {
+            value = s.Choices[n-1]
+        }
+        found := false
+        for _, choice := range s.Choices {
+            if value == choice {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return "", &ValueError{Value: value, Reason: "is not one of " + strings.Join(s.Choices, ", ")}
+        }
+    }
+
+    switch s.Type {
+    case "int":
+        if _, err := strconv.Atoi(value); err != nil {
+            return "", &ValueError{Value: value, Reason: "is not a whole number"}
+        }
+    case "port":
+        port, err := strconv.Atoi(value)
+        if err != nil || port < 1 || port > 65535 {
+            return "", &ValueError{Value: value, Reason: "is not a port number between 1 and 65535"}
+        }
+    case "path":
+        if value == "" || strings.ContainsAny(value, "\x00\n") {
+            return "", &ValueError{Value: value, Reason: "is not a valid path"}
+        }
+    case "hostname":
+        if net.ParseIP(value) == nil && (len(value) > 253 || !hostnameRegex.MatchString(value)) {
+            return "", &ValueError{Value: value, Reason: "is not a valid host name or IP address"}
+        }
+    }
+
+    if s.Pattern != "" {
+        re, err := regexp.Compile(`^(?:` + s.Pattern + `)$`)
+        if err != nil {
+            return "", fmt.Errorf("invalid bottle pattern: %v", err)
+        }
+        if !re.MatchString(value) {
+            return "", &ValueError{Value: value, Reason: "does not match " + s.Pattern}
+        }
+    }
+
+    return value, nil
+}
+
+func (s Spec) String() string {
+    var parts []string
+    if s.Type != "" {
+        parts = append(parts, "type "+s.Type)
+    }
+    if len(s.Choices) > 0 {
+        parts = append(parts, "choices "+strings.Join(s.Choices, ", "))
+    }
+    if s.Pattern != "" {
+        parts = append(parts, "pattern "+s.Pattern)
+    }
+    if s.Prompt != "" {
+        parts = append(parts, fmt.Sprintf("prompt %q", s.Prompt))
+    }
+    if s.Env != "" {
+        parts = append(parts, "env $"+s.Env)
+    }
+    if s.Command != "" {
+        parts = append(parts, fmt.Sprintf("command %q", s.Command))
+    }
+    return strings.Join(parts, "; ")
+}
+
+// Attributes returns the attributes of the spec in the form Set reads, as in
+// type=port, in the order String lists them
+func (s Spec) Attributes() []string {
+    var attrs []string
+    if s.Type != "" {
+        attrs = append(attrs, "type="+s.Type)
+    }
+    if len(s.Choices) > 0 {
+        attrs = append(attrs, "choices="+strings.Join(s.Choices, ","))
+    }
+    if s.Pattern != "" {
+        attrs = append(attrs, "pattern="+s.Pattern)
+    }
+    if s.Prompt != "" {
+        attrs = append(attrs, "prompt="+s.Prompt)
+    }
+    if s.Env != "" {
+        attrs = append(attrs, "env="+s.Env)
+    }
+    if s.Command != "" {
+        attrs = append(attrs, "command="+s.Command)
+    }
+    return attrs
+}
+
+func isType(value string) bool {
+    for _, t := range Types {
+        if value == t {
+            return true
+        }
+    }
+    return false
+}
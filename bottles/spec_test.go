@@ -0,0 +1,118 @@
+package bottles
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestSpecAccept(t *testing.T) {
+    tests := []struct {
+        attrs map[string]string
+        good  []string
+        bad   []string
+    }{
+        {map[string]string{"type": "int"}, []string{"0", "-12", "42"}, []string{"", "4.2", "ten"}},
+        {map[string]string{"type": "port"}, []string{"1", "22", "65535"}, []string{"0", "65536", "ssh"}},
+        {map[string]string{"type": "path"}, []string{"/tmp", "notes.txt", "a dir/b"}, []string{"", "a\nb"}},
+        {map[string]string{"type": "hostname"}, []string{"example.com", "db-1", "10.0.0.1", "::1"}, []string{"", "-bad.com", "a b", "x_y.com"}},
+        {map[string]string{"pattern": "v[0-9]+"}, []string{"v1", "v20"}, []string{"v", "xv1", "v1x"}},
+        {map[string]string{"choices": "dev, staging,prod"}, []string{"dev", "prod", "2"}, []string{"qa", "0", "4", ""}},
+    }
+
+    for _, tc := range tests {
+        var spec Spec
+        for attr, value := range tc.attrs {
+            if err := spec.Set(attr, value); err != nil {
+                t.Fatal(err)
+            }
+        }
+        for _, value := range tc.good {
+            if _, err := spec.Accept(value); err != nil {
+                t.Errorf("%v: %q refused: %v", tc.attrs, value, err)
+            }
+        }
+        for _, value := range tc.bad {
+            if _, err := spec.Accept(value); err == nil {
+                t.Errorf("%v: %q accepted", tc.attrs, value)
+            }
+        }
+    }
+
+    spec := Spec{Choices: []string{"dev", "staging", "prod"}}
+    if value, _ := spec.Accept("2"); value != "staging" {
+        t.Errorf("menu number selected %q", value)
+    }
+}
+
+func TestSpecSet(t *testing.T) {
+    var spec Spec
+    for _, attr := range [][2]string{{"type", "colour"}, {"pattern", "("}, {"size", "3"}} {
+        if err := spec.Set(attr[0], attr[1]); err == nil {
+            t.Errorf("%s=%s accepted", attr[0], attr[1])
+        }
+    }
+
+    spec.Set("type", "port")
+    spec.Set("prompt", "SSH port")
+    if spec.String() != `type port; prompt "SSH port"` {
+        t.Errorf("got %q", spec.String())
+    }
+    spec.Set("choices", "dev, prod")
+    var copied Spec
+    for _, attr := range spec.Attributes() {
+        parts := strings.SplitN(attr, "=", 2)
+        copied.Set(parts[0], parts[1])
+    }
+    if !reflect.DeepEqual(copied, spec) {
+        t.Errorf("got %+v from %v", copied, spec.Attributes())
+    }
+
+    spec.Set("type", "")
+    spec.Set("prompt", "")
+    spec.Set("choices", "")
+    if !spec.IsZero() {
+        t.Errorf("attributes were not cleared: %+v", spec)
+    }
+}
+
+func TestFillRepromptsInvalidValues(t *testing.T) {
+    specs := map[string]Spec{"port": {Type: "port"}, "env": {Choices: []string{"dev", "prod"}}}
+
+    answers := []string{"ssh", "99999", "2222", "3", "2"}
+    var refused []string
+    prompt := func(bottle Bottle) (string, error) {
+        if bottle.Invalid != nil {
+            refused = append(refused, bottle.Name)
+        }
+        answer := answers[0]
+        answers = answers[1:]
+        return answer, nil
+    }
+
+    got, err := (&Resolver{Prompt: prompt}).Fill("", "ssh -p b%('port')%b b%('env')%b", specs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != "ssh -p 2222 prod" {
+        t.Errorf("got %q", got)
+    }
+    if strings.Join(refused, ",") != "port,port,env" {
+        t.Errorf("re-prompted for %v", refused)
+    }
+
+    // Given values are never re-prompted, they are refused
+    r := &Resolver{Flags: map[string]string{"port": "ssh", "unused": "x"}, Prompt: prompt}
+    _, err = r.Fill("", "ssh -p b%('port')%b", specs)
+    if err == nil {
+        t.Error("an invalid given value was accepted")
+    }
+    err = r.Check("", "ssh -p b%('port')%b", specs)
+    if err == nil || !strings.Contains(err.Error(), "port") {
+        t.Errorf("got %v", err)
+    }
+    r = &Resolver{Flags: map[string]string{"env": "1", "port": "bad"}}
+    if r.Check("", "ssh b%('env')%b", specs) != nil {
+        t.Error("values of bottles the command does not use must be ignored")
+    }
+}
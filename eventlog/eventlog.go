@@ -0,0 +1,100 @@
+// Package eventlog writes the abbtr.log history shared by abbtr and the
+// scripts it generates.
+package eventlog
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Logger appends events to a log file
+type Logger struct {
+    Path string
+}
+
+// New returns a Logger writing to path
+func New(path string) *Logger {
+    return &Logger{Path: path}
+}
+
+// Log appends an entry of the given type. Entries look like
+// "[2006-01-02 15:04:05] TYPE user at ip | details".
+func (l *Logger) Log(eventType, details string) error {
+    // Create the log directory if it does not exist
+    err := os.MkdirAll(filepath.Dir(l.Path), 0755)
+    if err != nil {
+        return fmt.Errorf("failed to create log directory: %v", err)
+    }
+
+    // Open the log file in append mode, create it if it doesn't exist
+    file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open log file: %v", err)
+    }
+    defer file.Close()
+
+    // Gather necessary information for the log
+    user := os.Getenv("USER")
+    timestamp := time.Now().Format("2006-01-02 15:04:05")
+    ip := IP()
+
+    // Create the log message. Multi-line commands must not split the entry.
+    details = strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(details)
+    logMessage := fmt.Sprintf("[%s] %s %s at %s | %s\n",
+        timestamp, eventType, user, ip, details)
+
+    // Hold the lock shared with the generated scripts, so entries written at
+    // the same time never interleave
+    err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+    if err != nil {
+        return fmt.Errorf("failed to lock log file: %v", err)
+    }
+    defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+    // Write the log message to the file
+    _, err = file.WriteString(logMessage)
+    if err != nil {
+        return fmt.Errorf("failed to write to log file: %v", err)
+    }
+
+    return file.Sync()
+}
+
+// IP returns the first non-loopback IPv4 address of the machine
+func IP() string {
+    addrs, err := net.InterfaceAddrs()
+    if err == nil {
+        for _, addr := range addrs {
+            if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+                if ipnet.IP.To4() != nil {
+                    return ipnet.IP.String()
+                }
+            }
+        }
+    }
+    return "Unknown IP"
+}
+
+// RuleDetails is the part of an EXECUTE_RULE entry known before running
+func RuleDetails(name, command string) string {
+    return fmt.Sprintf("Rule: %s, Command: %q", name, command)
+}
+
+// ExecutionDetails formats an EXECUTE_RULE entry. The generated scripts
+// build exactly the same text from RuleDetails.
+func ExecutionDetails(name, command, result string, duration time.Duration) string {
+    return fmt.Sprintf("%s, Result: %s, Duration: %dms", RuleDetails(name, command), result, duration.Milliseconds())
+}
+
+// Result formats the outcome of a command for an EXECUTE_RULE entry
+func Result(err error) string {
+    if err == nil {
+        return "Success"
+    }
+    return fmt.Sprintf("Error: %v", err)
+}
@@ -0,0 +1,79 @@
+package eventlog
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+
+    "abbtr/bottles"
+)
+
+func TestLog(t *testing.T) {
+    t.Setenv("USER", "ada")
+    logger := New(filepath.Join(t.TempDir(), "share", "abbtr.log"))
+
+    if err := logger.Log("CREATE_RULE", "Name: gs, Command: git status"); err != nil {
+        t.Fatal(err)
+    }
+    // Entries stay on one line, whatever the details hold
+    if err := logger.Log("UPDATE_RULE", "Name: setup, Command: cd /\r\nls"); err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := os.ReadFile(logger.Path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("got %q", data)
+    }
+    entry := regexp.MustCompile(`^\[\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\] (\S+) ada at (.+) \| (.*)$`)
+    for i, want := range []string{
+        "CREATE_RULE|Name: gs, Command: git status",
+        `UPDATE_RULE|Name: setup, Command: cd /\r\nls`,
+    } {
+        m := entry.FindStringSubmatch(lines[i])
+        if m == nil || m[2] != IP() || m[1]+"|"+m[3] != want {
+            t.Errorf("entry %d: got %q, want %q", i+1, lines[i], want)
+        }
+    }
+}
+
+func TestLogRedacted(t *testing.T) {
+    logger := New(filepath.Join(t.TempDir(), "abbtr.log"))
+    command := "login b%('user')%b b%('!password')%b"
+    resolver := &bottles.Resolver{Flags: map[string]string{"user": "ada", "password": "sesame"}}
+    if _, err := resolver.Fill("login", command, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    details := ExecutionDetails("login", resolver.Redact("login", command), Result(nil), time.Second)
+    if err := logger.Log("EXECUTE_RULE", details); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(logger.Path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(string(data), "sesame") || !strings.HasSuffix(string(data), ` | Rule: login, Command: "login ada `+bottles.Redacted+`", Result: Success, Duration: 1000ms`+"\n") {
+        t.Errorf("got %q", data)
+    }
+}
+
+func TestResult(t *testing.T) {
+    if got := Result(nil); got != "Success" {
+        t.Errorf("got %q", got)
+    }
+    if got := Result(errors.New("exit status 2")); got != "Error: exit status 2" {
+        t.Errorf("got %q", got)
+    }
+    got := ExecutionDetails("gs", `git "status"`, "Success", 1500*time.Microsecond)
+    if got != `Rule: gs, Command: "git \"status\"", Result: Success, Duration: 1ms` {
+        t.Errorf("got %q", got)
+    }
+}
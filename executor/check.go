@@ -0,0 +1,83 @@
+package executor
+
+import (
+    "fmt"
+
+    "abbtr/internal/shell"
+    "abbtr/store"
+)
+
+// Prepare checks that a rule just changed in rules can run: its interpreter
+// is installed, it does not end up needing or referring to itself and it
+// does not break the rules referring to it. It returns the rule expanded as
+// its script runs it.
+func Prepare(rules *store.Store, name string) (*store.Rule, error) {
+    rule := rules.Find(name)
+    if rule == nil {
+        return nil, store.ErrNotFound
+    }
+    if rule.Shell != "" {
+        err := shell.CheckShell(rule.Shell)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    _, err := rules.Plan([]string{name})
+    if err != nil {
+        return nil, err
+    }
+    expanded, err := rules.Expand(name)
+    if err != nil {
+        return nil, err
+    }
+    err = CheckArguments(expanded)
+    if err != nil {
+        return nil, err
+    }
+    for _, user := range rules.Dependents(name) {
+        if _, err := rules.Expand(user); err != nil {
+            return nil, err
+        }
+    }
+    return expanded, nil
+}
+
+// Preview tries giving a rule a new command and settings on a copy of
+// rules, so mistakes are reported before anything is written. The rule is
+// created if it does not exist.
+func Preview(rules *store.Store, name, command string, settings store.Settings) error {
+    err := settings.Check(command)
+    if err != nil {
+        return err
+    }
+    preview := rules.Clone()
+    preview.Set(name, command, settings)
+    _, err = Prepare(preview, name)
+    return err
+}
+
+// SetDefaultShell makes interpreter run the rules that name none. It must be
+// installed, and the rules referring to one another must keep sharing an
+// interpreter.
+func SetDefaultShell(rules *store.Store, interpreter string) error {
+    err := shell.CheckShell(interpreter)
+    if err != nil {
+        return err
+    }
+
+    rules.Shell = interpreter
+    if interpreter == DefaultShell {
+        rules.Shell = ""
+    }
+    for _, rule := range rules.Rules {
+        expanded, err := rules.Expand(rule.Name)
+        if err != nil {
+            return err
+        }
+        if err := CheckArguments(expanded); err != nil {
+            return fmt.Errorf("rule '%s': %v", rule.Name, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,82 @@
+package executor
+
+import (
+    "strings"
+    "testing"
+
+    "abbtr/store"
+)
+
+func TestPrepare(t *testing.T) {
+    s := newStore(
+        store.Rule{Name: "build", Command: "make"},
+        store.Rule{Name: "ship", Command: "@build && rsync", Needs: []string{"test"}},
+        store.Rule{Name: "test", Command: "go test"},
+    )
+
+    rule, err := Prepare(s, "ship")
+    if err != nil || rule.Command != "( make ) && rsync" {
+        t.Errorf("got %+v, %v", rule, err)
+    }
+
+    for _, tc := range []struct {
+        change  func()
+        name    string
+        message string
+    }{
+        {func() { s.Find("test").Needs = []string{"ship"} }, "test", "dependency cycle: test -> ship -> test"},
+        {func() { s.Find("test").Shell = "no-such-interpreter" }, "test", "was not found"},
+        {func() { s.Find("build").Shell = "sh" }, "build", "rule 'build' runs with sh, it cannot be used by 'ship'"},
+        {func() { s.Find("test").Shell, s.Find("test").Command = "perl", "print b%(1)%b" }, "test", "only work with shells"},
+    } {
+        saved := s.Clone()
+        tc.change()
+        if _, err := Prepare(s, tc.name); err == nil || !strings.Contains(err.Error(), tc.message) {
+            t.Errorf("got %v, want an error about %q", err, tc.message)
+        }
+        s = saved
+    }
+
+    if _, err := Prepare(s, "nope"); err != store.ErrNotFound {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestPreview(t *testing.T) {
+    s := newStore(store.Rule{Name: "build", Command: "make"})
+
+    needs := []string{"ship"}
+    err := Preview(s, "ship", "@build", store.Settings{Needs: &needs})
+    if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+        t.Errorf("got %v", err)
+    }
+    err = Preview(s, "ship", "@build && rsync", store.Settings{})
+    if err != nil {
+        t.Error(err)
+    }
+    if s.Find("ship") != nil {
+        t.Error("the preview changed the rules")
+    }
+}
+
+func TestSetDefaultShell(t *testing.T) {
+    s := newStore(
+        store.Rule{Name: "build", Command: "make", Shell: "sh"},
+        store.Rule{Name: "ship", Command: "@build && rsync"},
+    )
+
+    // ship runs with the default, which build has to share
+    if err := SetDefaultShell(s, "sh"); err != nil || s.Shell != "sh" {
+        t.Errorf("got %q, %v", s.Shell, err)
+    }
+    if err := SetDefaultShell(s, "bash"); err == nil || !strings.Contains(err.Error(), "cannot be used by 'ship'") {
+        t.Errorf("got %v", err)
+    }
+    s.Find("build").Shell = ""
+    if err := SetDefaultShell(s, "bash"); err != nil || s.Shell != "" {
+        t.Errorf("got %q, %v", s.Shell, err)
+    }
+    if err := SetDefaultShell(s, "no-such-interpreter"); err == nil || !strings.Contains(err.Error(), "was not found") {
+        t.Errorf("got %v", err)
+    }
+}
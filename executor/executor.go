@@ -0,0 +1,103 @@
+// Package executor runs rule commands with bash, or the interpreter of the
+// rule, and reports how they ended.
+package executor
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "time"
+
+    "abbtr/eventlog"
+)
+
+// Runner runs commands connected to the given streams
+type Runner struct {
+    Stdin  io.Reader
+    Stdout io.Writer
+    Stderr io.Writer
+}
+
+// New returns a Runner attached to the standard streams of the process
+func New() *Runner {
+    return &Runner{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// Result describes a finished command
+type Result struct {
+    Name     string
+    Command  string
+    Duration time.Duration
+    // Err is nil on success and an *ExitError when the command ran but
+    // failed
+    Err error
+}
+
+// Details formats the result as an EXECUTE_RULE log entry
+func (r Result) Details() string {
+    return eventlog.ExecutionDetails(r.Name, r.Command, eventlog.Result(r.cause()), r.Duration)
+}
+
+// cause returns the error as bash would describe it, "exit status N"
+func (r Result) cause() error {
+    if exitErr, ok := r.Err.(*ExitError); ok {
+        return exitErr.Err
+    }
+    return r.Err
+}
+
+// Run runs a command with bash. name is given to bash as $0, so messages
+// from the command mention the rule rather than bash.
+func (r *Runner) Run(name, command string) Result {
+    return r.RunWith(DefaultShell, name, command, nil)
+}
+
+// RunWith runs a command with an interpreter, passing it args as described
+// by CommandLine
+func (r *Runner) RunWith(interpreter, name, command string, args []string) Result {
+    // Record the start time of the command execution
+    start := time.Now()
+
+    // Prepare the command for execution
+    line := CommandLine(interpreter, name, command, args)
+    cmd := exec.Command(line[0], line[1:]...)
+    cmd.Stdout = r.Stdout
+    cmd.Stderr = r.Stderr
+    cmd.Stdin = r.Stdin
+
+    // Run the command
+    err := cmd.Run()
+
+    result := Result{Name: name, Command: command, Duration: time.Since(start)}
+    if err != nil {
+        if exitError, ok := err.(*exec.ExitError); ok {
+            result.Err = &ExitError{Code: exitError.ExitCode(), Err: err}
+        } else {
+            result.Err = fmt.Errorf("failed to execute command: %v", err)
+        }
+    }
+
+    return result
+}
+
+// ExitError carries the exit status of a command that ran but failed
+type ExitError struct {
+    Code int
+    Err  error
+}
+
+func (e *ExitError) Error() string {
+    return fmt.Sprintf("command failed with exit code %d: %v", e.Code, e.Err)
+}
+
+// ExitCode returns the status abbtr should exit with for an execution error
+func ExitCode(err error) int {
+    if err == nil {
+        return 0
+    }
+    if exitErr, ok := err.(*ExitError); ok && exitErr.Code > 0 {
+        return exitErr.Code
+    }
+    return 1
+}
@@ -0,0 +1,53 @@
+package executor
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestRun(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    runner := &Runner{Stdin: strings.NewReader("input\n"), Stdout: &stdout, Stderr: &stderr}
+
+    result := runner.Run("rule", `read line; echo "$0 got $line"; echo oops >&2`)
+    if result.Err != nil {
+        t.Fatal(result.Err)
+    }
+    if stdout.String() != "rule got input\n" || stderr.String() != "oops\n" {
+        t.Errorf("got stdout %q, stderr %q", stdout.String(), stderr.String())
+    }
+    details := result.Details()
+    if !strings.HasPrefix(details, `Rule: rule, Command: "read line;`) || !strings.Contains(details, ", Result: Success, Duration: ") || !strings.HasSuffix(details, "ms") {
+        t.Errorf("unexpected details %q", details)
+    }
+
+    result = runner.Run("rule", "exit 3")
+    if ExitCode(result.Err) != 3 {
+        t.Errorf("got exit code %d, want 3", ExitCode(result.Err))
+    }
+    if !strings.Contains(result.Details(), "Result: Error: exit status 3, Duration: ") {
+        t.Errorf("unexpected details %q", result.Details())
+    }
+
+    if ExitCode(nil) != 0 {
+        t.Error("success must exit with 0")
+    }
+}
+
+func TestRunWith(t *testing.T) {
+    var stdout bytes.Buffer
+    runner := &Runner{Stdout: &stdout, Stderr: &stdout}
+
+    result := runner.RunWith("sh", "rule", `echo "$0:$1"`, []string{"a b"})
+    if result.Err != nil || stdout.String() != "rule:a b\n" {
+        t.Errorf("got %v, %q", result.Err, stdout.String())
+    }
+
+    if line := CommandLine("/usr/bin/perl", "rule", "print 1", []string{"x"}); strings.Join(line, " ") != "/usr/bin/perl -e print 1 x" {
+        t.Errorf("got %q", line)
+    }
+    if line := CommandLine("python3", "rule", "pass", nil); strings.Join(line, " ") != "python3 -c pass" {
+        t.Errorf("got %q", line)
+    }
+}
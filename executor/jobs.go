@@ -0,0 +1,136 @@
+package executor
+
+import (
+    "time"
+)
+
+// Job is a unit of work run by RunJobs, such as a rule or one iteration of
+// a matrix
+type Job struct {
+    Name string
+    Run  func() error
+    // Needs names the jobs that must pass before this one starts. A job
+    // whose needs failed or were skipped is skipped.
+    Needs []string
+}
+
+// Status tells how a job ended
+type Status int
+
+const (
+    Passed Status = iota
+    Failed
+    Skipped
+)
+
+func (s Status) String() string {
+    switch s {
+    case Passed:
+        return "passed"
+    case Failed:
+        return "failed"
+    default:
+        return "skipped"
+    }
+}
+
+// Outcome is the result of a job, in the order the jobs were given
+type Outcome struct {
+    Name     string
+    Status   Status
+    Err      error
+    Duration time.Duration
+}
+
+// RunJobs starts the jobs in order as soon as the jobs they need have
+// passed, running at most parallel of them at the same time. With failFast no
+// job starts once one has failed, the remaining ones are Skipped. Needs that
+// are not among the jobs are ignored.
+func RunJobs(jobs []Job, parallel int, failFast bool) []Outcome {
+    if parallel < 1 {
+        parallel = 1
+    }
+
+    index := make(map[string]int, len(jobs))
+    for i, job := range jobs {
+        index[job.Name] = i
+    }
+
+    outcomes := make([]Outcome, len(jobs))
+    finished := make([]bool, len(jobs))
+    started := make([]bool, len(jobs))
+    done := make(chan int)
+    running := 0
+    failed := false
+
+    for {
+        // Start what can start, skipping the jobs whose needs did not pass
+        for progress := true; progress; {
+            progress = false
+            for i, job := range jobs {
+                if started[i] || running == parallel || (failFast && failed) {
+                    continue
+                }
+                ready, skip := true, false
+                for _, need := range job.Needs {
+                    n, ok := index[need]
+                    if !ok {
+                        continue
+                    }
+                    if !finished[n] {
+                        ready = false
+                    } else if outcomes[n].Status != Passed {
+                        skip = true
+                    }
+                }
+                if skip {
+                    started[i], finished[i] = true, true
+                    outcomes[i] = Outcome{Name: job.Name, Status: Skipped}
+                    progress = true
+                    continue
+                }
+                if !ready {
+                    continue
+                }
+
+                started[i] = true
+                running++
+                go func(i int, job Job) {
+                    start := time.Now()
+                    err := job.Run()
+                    outcomes[i] = Outcome{Name: job.Name, Status: Passed, Err: err, Duration: time.Since(start)}
+                    if err != nil {
+                        outcomes[i].Status = Failed
+                    }
+                    done <- i
+                }(i, job)
+            }
+        }
+
+        if running == 0 {
+            break
+        }
+        i := <-done
+        running--
+        finished[i] = true
+        failed = failed || outcomes[i].Status == Failed
+    }
+
+    // Jobs that never started, after a failure or in a cycle
+    for i, job := range jobs {
+        if !started[i] {
+            outcomes[i] = Outcome{Name: job.Name, Status: Skipped}
+        }
+    }
+    return outcomes
+}
+
+// FirstFailure returns the error of the first failed outcome, or nil
+func FirstFailure(outcomes []Outcome) error {
+    for _, outcome := range outcomes {
+        if outcome.Status == Failed {
+            return outcome.Err
+        }
+    }
+    return nil
+}
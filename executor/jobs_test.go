@@ -0,0 +1,126 @@
+package executor
+
+import (
+    "bytes"
+    "errors"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestRunJobs(t *testing.T) {
+    var running, most int32
+    job := func(err error) func() error {
+        return func() error {
+            now := atomic.AddInt32(&running, 1)
+            for {
+                seen := atomic.LoadInt32(&most)
+                if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) {
+                    break
+                }
+            }
+            time.Sleep(10 * time.Millisecond)
+            atomic.AddInt32(&running, -1)
+            return err
+        }
+    }
+
+    failure := errors.New("failed")
+    jobs := []Job{{Name: "a", Run: job(nil)}, {Name: "b", Run: job(failure)}, {Name: "c", Run: job(nil)}, {Name: "d", Run: job(nil)}, {Name: "e", Run: job(nil)}}
+    outcomes := RunJobs(jobs, 2, false)
+    if most != 2 {
+        t.Errorf("%d jobs ran at the same time, want 2", most)
+    }
+    for i, outcome := range outcomes {
+        want := Passed
+        if i == 1 {
+            want = Failed
+        }
+        if outcome.Name != jobs[i].Name || outcome.Status != want {
+            t.Errorf("job %d: got %+v", i, outcome)
+        }
+    }
+    if FirstFailure(outcomes) != failure {
+        t.Errorf("got %v", FirstFailure(outcomes))
+    }
+
+    // Nothing starts after a failure with failFast
+    outcomes = RunJobs(jobs, 1, true)
+    statuses := []Status{Passed, Failed, Skipped, Skipped, Skipped}
+    for i, outcome := range outcomes {
+        if outcome.Status != statuses[i] {
+            t.Errorf("job %d: got %s, want %s", i, outcome.Status, statuses[i])
+        }
+    }
+}
+
+func TestRunJobsNeeds(t *testing.T) {
+    var mu sync.Mutex
+    var order []string
+    job := func(name string, err error) Job {
+        return Job{Name: name, Run: func() error {
+            time.Sleep(10 * time.Millisecond)
+            mu.Lock()
+            order = append(order, name)
+            mu.Unlock()
+            return err
+        }}
+    }
+
+    failure := errors.New("failed")
+    deploy := job("deploy", nil)
+    deploy.Needs = []string{"build", "test"}
+    test := job("test", nil)
+    test.Needs = []string{"build"}
+    docs := job("docs", nil)
+    docs.Needs = []string{"build"}
+    jobs := []Job{deploy, test, job("build", nil), docs}
+
+    outcomes := RunJobs(jobs, 4, true)
+    for _, outcome := range outcomes {
+        if outcome.Status != Passed {
+            t.Errorf("%s: got %s", outcome.Name, outcome.Status)
+        }
+    }
+    if order[0] != "build" || order[3] != "deploy" {
+        t.Errorf("ran in the order %v", order)
+    }
+
+    // Only the jobs needing the failed one are skipped
+    jobs[1] = job("test", failure)
+    jobs[1].Needs = []string{"build"}
+    outcomes = RunJobs(jobs, 4, false)
+    statuses := []Status{Skipped, Failed, Passed, Passed}
+    for i, outcome := range outcomes {
+        if outcome.Status != statuses[i] {
+            t.Errorf("%s: got %s, want %s", outcome.Name, outcome.Status, statuses[i])
+        }
+    }
+
+    // Jobs in a cycle never start
+    a, b := job("a", nil), job("b", nil)
+    a.Needs, b.Needs = []string{"b"}, []string{"a"}
+    outcomes = RunJobs([]Job{a, b}, 1, false)
+    if outcomes[0].Status != Skipped || outcomes[1].Status != Skipped {
+        t.Errorf("got %+v", outcomes)
+    }
+}
+
+func TestPrefixWriter(t *testing.T) {
+    var out bytes.Buffer
+    var mu sync.Mutex
+    a := NewPrefixWriter(&out, &mu, "[a] ")
+    b := NewPrefixWriter(&out, &mu, "[b] ")
+
+    a.Write([]byte("one\ntw"))
+    b.Write([]byte("three\n"))
+    a.Write([]byte("o\nfour"))
+    a.Flush()
+    b.Flush()
+
+    want := "[a] one\n[b] three\n[a] two\n[a] four\n"
+    if out.String() != want {
+        t.Errorf("got %q, want %q", out.String(), want)
+    }
+}
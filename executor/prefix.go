@@ -0,0 +1,59 @@
+package executor
+
+import (
+    "bytes"
+    "io"
+    "sync"
+)
+
+// PrefixWriter writes whole lines to Out, each one starting with Prefix, so
+// the output of commands running at the same time can be told apart. Writers
+// sharing Mu never mix their lines.
+type PrefixWriter struct {
+    Out    io.Writer
+    Mu     *sync.Mutex
+    Prefix string
+
+    pending []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter writing to out under mu
+func NewPrefixWriter(out io.Writer, mu *sync.Mutex, prefix string) *PrefixWriter {
+    return &PrefixWriter{Out: out, Mu: mu, Prefix: prefix}
+}
+
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+    w.pending = append(w.pending, p...)
+
+    end := bytes.LastIndexByte(w.pending, '\n')
+    if end < 0 {
+        return len(p), nil
+    }
+    lines := w.pending[:end+1]
+
+    var buf bytes.Buffer
+    for len(lines) > 0 {
+        i := bytes.IndexByte(lines, '\n')
+        buf.WriteString(w.Prefix)
+        buf.Write(lines[:i+1])
+        lines = lines[i+1:]
+    }
+    w.pending = append([]byte(nil), w.pending[end+1:]...)
+
+    w.Mu.Lock()
+    defer w.Mu.Unlock()
+    _, err := w.Out.Write(buf.Bytes())
+    if err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// Flush writes what is left of an unfinished last line
+func (w *PrefixWriter) Flush() error {
+    if len(w.pending) == 0 {
+        return nil
+    }
+    _, err := w.Write([]byte("\n"))
+    return err
+}
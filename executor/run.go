@@ -0,0 +1,379 @@
+package executor
+
+import (
+    "fmt"
+    "sync"
+
+    "abbtr/bottles"
+    "abbtr/internal/shell"
+    "abbtr/store"
+)
+
+// Plan returns the rules to run for the given names, each once and after the
+// rules it needs, their references to other rules expanded. The names that
+// are not rules are returned apart.
+func Plan(rules *store.Store, names []string) (plan []*store.Rule, missing []string, err error) {
+    var found []string
+    for _, name := range names {
+        if rules.Find(name) == nil {
+            missing = append(missing, name)
+            continue
+        }
+        found = append(found, name)
+    }
+
+    order, err := rules.Plan(found)
+    if err != nil {
+        return nil, missing, err
+    }
+    for _, name := range order {
+        rule, err := rules.Expand(name)
+        if err != nil {
+            return nil, missing, fmt.Errorf("rule '%s': %v", name, err)
+        }
+        plan = append(plan, rule)
+    }
+    return plan, missing, nil
+}
+
+// AppendsArguments reports whether the arguments of a run are appended to
+// the command of a rule, as they would be to an alias. Only single-line
+// commands run by a shell get them this way, the others receive them as
+// their own arguments.
+func AppendsArguments(rule *store.Rule) bool {
+    return shell.IsShell(rule.Shell) && !rule.Multiline()
+}
+
+// Arguments places the arguments of a run in the command of a rule. It
+// returns the command and the arguments left for the interpreter.
+func Arguments(rule *store.Rule, args []string) (string, []string, error) {
+    err := CheckArguments(rule)
+    if err != nil {
+        return "", nil, err
+    }
+    if !shell.IsShell(rule.Shell) {
+        return rule.Command, args, nil
+    }
+    if AppendsArguments(rule) {
+        command, err := bottles.InsertArguments(rule.Command, args)
+        return command, nil, err
+    }
+    return bottles.PlaceArguments(rule.Command, args)
+}
+
+// CheckArguments refuses positional placeholders in rules that are not run
+// by a shell. Their arguments are quoted for a shell, which means nothing to
+// python3 or perl; those interpreters get the arguments as their own.
+func CheckArguments(rule *store.Rule) error {
+    if shell.IsShell(rule.Shell) || !bottles.ArgumentRegex.MatchString(rule.Command) {
+        return nil
+    }
+    return fmt.Errorf("b%%(1)%%b placeholders only work with shells, a rule running with %s receives its arguments as its own (sys.argv, @ARGV...)", rule.Shell)
+}
+
+// Run runs planned rules, or runs them once for every iteration of a
+// matrix. What it does is written to the streams of its Runner.
+type Run struct {
+    // Rules are the rules to run, as returned by Plan
+    Rules []*store.Rule
+    // Missing names the rules that do not exist. They fail in the outcomes
+    // of a run going on without them.
+    Missing []string
+    // Args are forwarded to the rules named in Targets. The rules that are
+    // only needed by them run without arguments.
+    Args []string
+    // Targets names the rules asked for, as given to Plan
+    Targets []string
+    // Resolver fills the bottles, each once for the whole run
+    Resolver *bottles.Resolver
+    // Matrix runs the rules once for every combination of its values
+    Matrix bottles.Matrix
+    // Jobs is the number of rules, or of iterations, running at the same
+    // time
+    Jobs int
+    // FailFast skips what is left of the run after a failure
+    FailFast bool
+    // Prompt returns what asks for the bottles of a rule, nil when nobody
+    // can be asked
+    Prompt func(rule string) bottles.Prompter
+    // Log records every execution, given its EXECUTE_RULE details
+    Log func(details string) error
+    // Runner runs the commands. Rules or iterations running at the same
+    // time write to its streams with their name as prefix.
+    Runner *Runner
+}
+
+// Check makes sure every rule accepts the values given before the run, with
+// the Resolver or the Matrix, so nothing runs when one of them is refused
+func (r *Run) Check() error {
+    err := r.Matrix.Check()
+    if err != nil {
+        return err
+    }
+    for _, values := range r.Matrix.Combinations() {
+        resolver := r.Resolver
+        if len(r.Matrix) > 0 {
+            resolver = r.Resolver.Fork(values)
+        }
+        for _, rule := range r.Rules {
+            err := resolver.Check(rule.Name, rule.Command, rule.Bottles)
+            if err != nil {
+                return fmt.Errorf("rule '%s': %s", rule.Name, err)
+            }
+        }
+    }
+    return nil
+}
+
+// Execute runs the rules and returns how each of them, or each iteration of
+// the matrix, ended. A rule starts once the rules it needs passed and is
+// skipped if one of them did not. The error tells why nothing ran, such as
+// a bottle asked for before the run that got no value.
+func (r *Run) Execute() ([]Outcome, error) {
+    if len(r.Matrix) > 0 {
+        return r.executeMatrix()
+    }
+
+    parallel := r.Jobs > 1 && len(r.Rules)+len(r.Missing) > 1
+    if parallel {
+        // Rules running together cannot share the terminal, so every bottle
+        // is asked for before the first one starts
+        for _, rule := range r.Rules {
+            if err := r.prepare(r.Resolver, rule); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    var output sync.Mutex
+    var jobs []Job
+    for i, rule := range r.Rules {
+        number, rule := i+1, rule
+        filler := r.Resolver
+        if parallel {
+            // Every answer is known, each rule fills its command from a copy
+            filler = r.Resolver.Fork(nil)
+            filler.Prompt = nil
+        }
+
+        jobs = append(jobs, Job{Name: rule.Name, Needs: rule.Needs, Run: func() error {
+            runner := r.Runner
+            if parallel {
+                var flush func()
+                runner, flush = r.prefixed(rule.Name, &output)
+                defer flush()
+            } else {
+                filler.Prompt = r.prompter(rule.Name)
+            }
+            return r.runRule(runner, filler, rule, number, "")
+        }})
+    }
+    for _, name := range r.Missing {
+        err := fmt.Errorf("rule '%s' not found", name)
+        jobs = append(jobs, Job{Name: name, Run: func() error { return err }})
+    }
+
+    return RunJobs(jobs, r.Jobs, r.FailFast), nil
+}
+
+// executeMatrix runs the rules once for every iteration of the matrix. The
+// bottles the matrix leaves open are asked for before the first iteration
+// starts, and the answers shared by all of them. Each iteration stops at its
+// first failing rule.
+func (r *Run) executeMatrix() ([]Outcome, error) {
+    err := r.Matrix.Check()
+    if err != nil {
+        return nil, err
+    }
+    combinations := r.Matrix.Combinations()
+    prepared := r.Resolver.Fork(combinations[0])
+    for _, rule := range r.Rules {
+        if err := r.prepare(prepared, rule); err != nil {
+            return nil, err
+        }
+    }
+
+    secrets := store.SecretBottles(r.Rules)
+    var output sync.Mutex
+    jobs := make([]Job, len(combinations))
+    for i, values := range combinations {
+        number := i + 1
+        label := r.Matrix.Label(values, secrets)
+        iteration := prepared.Fork(values)
+        iteration.Prompt = nil
+
+        jobs[i] = Job{Name: label, Run: func() error {
+            runner := r.Runner
+            if r.Jobs > 1 {
+                // Iterations running together cannot share the terminal
+                var flush func()
+                runner, flush = r.prefixed(label, &output)
+                defer flush()
+            }
+
+            fmt.Fprintf(runner.Stdout, "Iteration %d of %d: %s\n", number, len(combinations), label)
+            for n, rule := range r.Rules {
+                if err := r.runRule(runner, iteration, rule, n+1, label); err != nil {
+                    return err
+                }
+            }
+            return nil
+        }}
+    }
+
+    return RunJobs(jobs, r.Jobs, r.FailFast), nil
+}
+
+// prepare has resolver ask for the bottles of a rule before the run starts
+func (r *Run) prepare(resolver *bottles.Resolver, rule *store.Rule) error {
+    command, _, err := Arguments(rule, r.args(rule))
+    if err == nil {
+        resolver.Prompt = r.prompter(rule.Name)
+        _, err = resolver.Fill(rule.Name, command, rule.Bottles)
+    }
+    if err != nil {
+        return fmt.Errorf("rule '%s': %s", rule.Name, err)
+    }
+    return nil
+}
+
+// runRule fills the bottles of a rule with filler and runs it with runner
+// as the number-th command of the run. label names the iteration of the
+// matrix in the log, if any.
+func (r *Run) runRule(runner *Runner, filler *bottles.Resolver, rule *store.Rule, number int, label string) error {
+    withArgs, extra, err := Arguments(rule, r.args(rule))
+    var command string
+    if err == nil {
+        command, err = filler.Fill(rule.Name, withArgs, rule.Bottles)
+    }
+    if err != nil {
+        fmt.Fprintf(runner.Stdout, "Error: rule '%s': %s\n", rule.Name, err)
+        return err
+    }
+
+    // Secrets are neither shown nor logged
+    shown := filler.Redact(rule.Name, withArgs)
+    fmt.Fprintf(runner.Stdout, "Executing command %d: %s\n", number, shown)
+    result := runner.RunWith(rule.Shell, rule.Name, command, extra)
+    result.Command = shown
+
+    if r.Log != nil {
+        details := result.Details()
+        if label != "" {
+            details += ", Matrix: " + label
+        }
+        if err := r.Log(details); err != nil {
+            fmt.Fprintf(runner.Stdout, "Warning: Failed to log event: %v\n", err)
+        }
+    }
+    if result.Err != nil {
+        fmt.Fprintf(runner.Stdout, "Error executing command %d: %s\n", number, result.Err)
+    }
+    return result.Err
+}
+
+// args returns the arguments of the run given to a rule, none for the
+// rules that are only needed
+func (r *Run) args(rule *store.Rule) []string {
+    for _, name := range r.Targets {
+        if name == rule.Name {
+            return r.Args
+        }
+    }
+    return nil
+}
+
+// prefixed returns a runner writing to the streams of the run with name as
+// prefix, and the function flushing its last incomplete lines
+func (r *Run) prefixed(name string, output *sync.Mutex) (*Runner, func()) {
+    stdout := NewPrefixWriter(r.Runner.Stdout, output, "["+name+"] ")
+    stderr := NewPrefixWriter(r.Runner.Stderr, output, "["+name+"] ")
+    return &Runner{Stdout: stdout, Stderr: stderr}, func() {
+        stdout.Flush()
+        stderr.Flush()
+    }
+}
+
+func (r *Run) prompter(rule string) bottles.Prompter {
+    if r.Prompt == nil {
+        return nil
+    }
+    return r.Prompt(rule)
+}
+
+// Explanation tells what a rule would run and where each of its bottles
+// would take its value from
+type Explanation struct {
+    Rule string
+    // Command is the command of the rule with the arguments of the run, its
+    // secrets redacted
+    Command     string
+    Resolutions []bottles.Resolution
+    // AskedBefore holds, for the bottles left to the prompt, the earlier
+    // rule the same question is asked for. The bottles missing from it are
+    // asked for this rule.
+    AskedBefore map[string]string
+    // Err tells why the rule cannot run
+    Err error
+}
+
+// Iteration explains the rules of one iteration of a run. Runs without a
+// matrix have a single iteration with no label.
+type Iteration struct {
+    Label string
+    Rules []Explanation
+}
+
+// Explain returns what Execute would run, without running anything nor
+// asking anybody. The command attributes of bottles are the only thing
+// executed.
+func (r *Run) Explain() []Iteration {
+    var secrets map[string]bool
+    if len(r.Matrix) > 0 {
+        secrets = store.SecretBottles(r.Rules)
+    }
+
+    askedBy := make(map[string]string)
+    resolver := r.Resolver
+    var iterations []Iteration
+    for _, values := range r.Matrix.Combinations() {
+        var iteration Iteration
+        if len(r.Matrix) > 0 {
+            iteration.Label = r.Matrix.Label(values, secrets)
+            resolver = resolver.Fork(values)
+        }
+        for _, rule := range r.Rules {
+            iteration.Rules = append(iteration.Rules, explain(resolver, rule, r.args(rule), askedBy))
+        }
+        iterations = append(iterations, iteration)
+    }
+    return iterations
+}
+
+// explain explains a rule of an iteration. askedBy holds the rule each
+// bottle left to the prompt is first asked for.
+func explain(resolver *bottles.Resolver, rule *store.Rule, args []string, askedBy map[string]string) Explanation {
+    explanation := Explanation{Rule: rule.Name, AskedBefore: make(map[string]string)}
+    withArgs, _, err := Arguments(rule, args)
+    if err == nil {
+        explanation.Resolutions, err = resolver.Explain(rule.Name, withArgs, rule.Bottles)
+    }
+    if err != nil {
+        explanation.Err = fmt.Errorf("rule '%s': %s", rule.Name, err)
+        return explanation
+    }
+
+    explanation.Command = resolver.Redact(rule.Name, withArgs)
+    for _, resolution := range explanation.Resolutions {
+        if !resolution.Pending {
+            continue
+        }
+        name := resolution.Bottle.Name
+        if first, asked := askedBy[name]; asked {
+            explanation.AskedBefore[name] = first
+        } else {
+            askedBy[name] = rule.Name
+        }
+    }
+    return explanation
+}
@@ -0,0 +1,188 @@
+package executor
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+
+    "abbtr/bottles"
+    "abbtr/store"
+)
+
+func newStore(rules ...store.Rule) *store.Store {
+    s := &store.Store{Rules: rules}
+    for i := range s.Rules {
+        s.UpdateRefs(&s.Rules[i])
+    }
+    return s
+}
+
+func TestPlan(t *testing.T) {
+    s := newStore(
+        store.Rule{Name: "build", Command: "make"},
+        store.Rule{Name: "test", Command: "@build && go test", Needs: []string{"build"}},
+    )
+
+    plan, missing, err := Plan(s, []string{"test", "nope"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, rule := range plan {
+        names = append(names, rule.Name)
+    }
+    if !reflect.DeepEqual(names, []string{"build", "test"}) || !reflect.DeepEqual(missing, []string{"nope"}) {
+        t.Errorf("got plan %v, missing %v", names, missing)
+    }
+    if plan[1].Command != "( make ) && go test" {
+        t.Errorf("the references were not expanded: %q", plan[1].Command)
+    }
+}
+
+func TestArguments(t *testing.T) {
+    for _, tc := range []struct {
+        rule    store.Rule
+        command string
+        extra   []string
+    }{
+        {store.Rule{Command: "ls # all"}, "ls 'a b' # all", nil},
+        {store.Rule{Command: "echo b%(1)%b"}, "echo 'a b'", nil},
+        {store.Rule{Command: "cd /\nls"}, "cd /\nls", []string{"a b"}},
+        {store.Rule{Command: "print(1)", Shell: "python3"}, "print(1)", []string{"a b"}},
+    } {
+        command, extra, err := Arguments(&tc.rule, []string{"a b"})
+        if err != nil || command != tc.command || !reflect.DeepEqual(extra, tc.extra) {
+            t.Errorf("%q: got %q, %q, %v", tc.rule.Command, command, extra, err)
+        }
+    }
+
+    rule := &store.Rule{Command: "print(b%(1)%b)", Shell: "python3"}
+    if _, _, err := Arguments(rule, nil); err == nil || !strings.Contains(err.Error(), "only work with shells") {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestRunExecute(t *testing.T) {
+    s := newStore(store.Rule{Name: "login", Command: "echo b%('!token')%b"})
+    plan, _, err := Plan(s, []string{"login"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var stdout bytes.Buffer
+    var logged []string
+    run := &Run{
+        Rules:    plan,
+        Missing:  []string{"nope"},
+        Args:     []string{"again"},
+        Targets:  []string{"login", "nope"},
+        Resolver: &bottles.Resolver{Flags: map[string]string{"token": "s3cret"}},
+        Log: func(details string) error {
+            logged = append(logged, details)
+            return nil
+        },
+        Runner: &Runner{Stdout: &stdout, Stderr: &stdout},
+    }
+    if err := run.Check(); err != nil {
+        t.Fatal(err)
+    }
+    outcomes, err := run.Execute()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(outcomes) != 2 || outcomes[0].Status != Passed || outcomes[1].Status != Failed {
+        t.Errorf("got outcomes %+v", outcomes)
+    }
+    want := "Executing command 1: echo " + bottles.Redacted + " again\ns3cret again\n"
+    if stdout.String() != want {
+        t.Errorf("got %q, want %q", stdout.String(), want)
+    }
+    // The secret runs but is neither shown nor logged
+    if len(logged) != 1 || !strings.Contains(logged[0], `Command: "echo `+bottles.Redacted+` again"`) || strings.Contains(logged[0], "s3cret") {
+        t.Errorf("got log %q", logged)
+    }
+}
+
+func TestRunArgumentsSkipNeededRules(t *testing.T) {
+    s := newStore(
+        store.Rule{Name: "build", Command: "echo make"},
+        store.Rule{Name: "deploy", Command: "echo deploy", Needs: []string{"build"}},
+    )
+    plan, _, err := Plan(s, []string{"deploy"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var stdout bytes.Buffer
+    run := &Run{
+        Rules:    plan,
+        Args:     []string{"v1.2"},
+        Targets:  []string{"deploy"},
+        Resolver: &bottles.Resolver{},
+        Runner:   &Runner{Stdout: &stdout, Stderr: &stdout},
+    }
+    outcomes, err := run.Execute()
+    if err != nil || FirstFailure(outcomes) != nil {
+        t.Fatalf("got %+v, %v", outcomes, err)
+    }
+    want := "Executing command 1: echo make\nmake\nExecuting command 2: echo deploy v1.2\ndeploy v1.2\n"
+    if stdout.String() != want {
+        t.Errorf("got %q, want %q", stdout.String(), want)
+    }
+    iterations := run.Explain()
+    if got := iterations[0].Rules[0].Command; got != "echo make" {
+        t.Errorf("the needed rule was explained with the arguments: %q", got)
+    }
+}
+
+func TestRunMatrix(t *testing.T) {
+    s := newStore(store.Rule{Name: "greet", Command: "echo b%('env')%b"})
+    plan, _, err := Plan(s, []string{"greet"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var stdout bytes.Buffer
+    var logged []string
+    run := &Run{
+        Rules:    plan,
+        Resolver: &bottles.Resolver{},
+        Matrix:   bottles.Matrix{{Bottle: "env", Values: []string{"dev", "prod"}}},
+        Log: func(details string) error {
+            logged = append(logged, details)
+            return nil
+        },
+        Runner: &Runner{Stdout: &stdout, Stderr: &stdout},
+    }
+    outcomes, err := run.Execute()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(outcomes) != 2 || outcomes[0].Name != "env=dev" || outcomes[1].Name != "env=prod" {
+        t.Errorf("got outcomes %+v", outcomes)
+    }
+    if !strings.Contains(stdout.String(), "Iteration 2 of 2: env=prod\nExecuting command 1: echo prod\nprod\n") {
+        t.Errorf("got %q", stdout.String())
+    }
+    if len(logged) != 2 || !strings.HasSuffix(logged[1], ", Matrix: env=prod") {
+        t.Errorf("got log %q", logged)
+    }
+
+    // Explaining asks nobody
+    iterations := run.Explain()
+    if len(iterations) != 2 || iterations[0].Label != "env=dev" || iterations[0].Rules[0].Command != "echo dev" {
+        t.Errorf("got %+v", iterations)
+    }
+
+    // An axis without values runs nothing
+    run.Matrix = bottles.Matrix{{Bottle: "env"}}
+    if err := run.Check(); err == nil {
+        t.Error("an empty axis was accepted")
+    }
+    if outcomes, err := run.Execute(); err == nil {
+        t.Errorf("an empty axis ran: %+v", outcomes)
+    }
+}
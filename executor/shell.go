@@ -0,0 +1,37 @@
+package executor
+
+import (
+    "path/filepath"
+    "strings"
+
+    "abbtr/internal/shell"
+)
+
+// DefaultShell runs the commands of rules that name no interpreter
+const DefaultShell = "bash"
+
+// CommandLine returns the program and arguments running command with an
+// interpreter, such as bash, zsh, fish, python3 or perl. Shells get name as
+// $0, every interpreter gets args as its own arguments.
+func CommandLine(interpreter, name, command string, args []string) []string {
+    if interpreter == "" {
+        interpreter = DefaultShell
+    }
+    line := []string{interpreter, InlineFlag(interpreter), command}
+    if shell.IsShell(interpreter) {
+        line = append(line, name)
+    }
+    return append(line, args...)
+}
+
+// InlineFlag returns the option making an interpreter run the code given on
+// its command line: -e for perl, ruby and node, -c for the others
+func InlineFlag(interpreter string) string {
+    base := filepath.Base(interpreter)
+    for _, prefix := range []string{"perl", "ruby", "node"} {
+        if strings.HasPrefix(base, prefix) {
+            return "-e"
+        }
+    }
+    return "-c"
+}
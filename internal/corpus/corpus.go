@@ -0,0 +1,35 @@
+// Package corpus holds the awkward commands the tests of every package run
+// through the places where a command is stored or rendered.
+package corpus
+
+// Command is a named entry of the corpus
+type Command struct {
+    Name    string
+    Command string
+}
+
+// Commands must survive every place a command is stored or rendered
+var Commands = []Command{
+    {"awk program", `awk -F: '{ printf "%s -> %d\n", $1, NR }' /etc/passwd`},
+    {"sed expression", `sed -e 's/"\(.*\)"/\1/g' -e "s/\\\\/\//g" file.txt`},
+    {"nested quotes", `bash -c "echo 'it'\''s \"quoted\"'"`},
+    {"printf formats", `printf '%s %5.2f %% %q\n' "a" 3.14159 "b c"`},
+    {"dollar and backticks", "echo $HOME ${USER:-nobody} $(date +%s) `uname -r` $'\\t'"},
+    {"backslashes", `echo \\ \\\\ \n \t \" \' \$`},
+    {"escaped newline text", `echo -e 'line1\nline2\ttab'`},
+    {"single quotes only", `echo 'a' 'b''c' ''`},
+    {"percent signs", `date +%Y-%m-%d_%H%M%S && echo 100%% %d %v`},
+    {"html entities", `echo '&amp; &lt; &#10; &copy &gt' && echo a&&echo b`},
+    {"export markers", `echo b:name = cmd:b && echo :b:b b:`},
+    {"equals signs", `export A = B; test "$A" = "B"`},
+    {"surrounding whitespace", "  echo padded\t "},
+    {"unicode", `echo "héllo wörld ✓" | tr 'ö' 'o'`},
+    {"unbalanced quote", `echo "unterminated`},
+    {"trailing backslash", `echo trailing \`},
+    {"escaped trailing backslash", `echo escaped \\`},
+    {"comment", `echo visible # hidden "$@"`},
+    {"trailing comment", `echo kept # the arguments go before this`},
+    {"hashes that are not comments", `echo '#' "#" \# x#y ${#HOME} # but this is`},
+    {"comment after an operator", `false;# the status is kept`},
+    {"real newline", "echo one\necho two"},
+}
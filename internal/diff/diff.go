@@ -0,0 +1,48 @@
+// Package diff compares texts line by line.
+package diff
+
+import "strings"
+
+// Lines returns the lines of a followed by the changes turning them into b.
+// Kept lines start with two spaces, removed lines with "- " and added lines
+// with "+ ".
+func Lines(a, b string) []string {
+    from := strings.Split(a, "\n")
+    to := strings.Split(b, "\n")
+
+    // common[i][j] is the length of the longest common subsequence of
+    // from[i:] and to[j:]
+    common := make([][]int, len(from)+1)
+    for i := range common {
+        common[i] = make([]int, len(to)+1)
+    }
+    for i := len(from) - 1; i >= 0; i-- {
+        for j := len(to) - 1; j >= 0; j-- {
+            if from[i] == to[j] {
+                common[i][j] = common[i+1][j+1] + 1
+            } else if common[i+1][j] >= common[i][j+1] {
+                common[i][j] = common[i+1][j]
+            } else {
+                common[i][j] = common[i][j+1]
+            }
+        }
+    }
+
+    var lines []string
+    i, j := 0, 0
+    for i < len(from) || j < len(to) {
+        switch {
+        case i < len(from) && j < len(to) && from[i] == to[j]:
+            lines = append(lines, "  "+from[i])
+            i++
+            j++
+        case j == len(to) || i < len(from) && common[i+1][j] >= common[i][j+1]:
+            lines = append(lines, "- "+from[i])
+            i++
+        default:
+            lines = append(lines, "+ "+to[j])
+            j++
+        }
+    }
+    return lines
+}
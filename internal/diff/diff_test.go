@@ -0,0 +1,14 @@
+package diff
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestLines(t *testing.T) {
+    got := Lines("desc: old\ntags: a\n---\nmake\nmake install", "tags: a\n---\nmake\nmake test\nmake install")
+    want := []string{"- desc: old", "  tags: a", "  ---", "  make", "+ make test", "  make install"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+}
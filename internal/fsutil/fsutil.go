@@ -0,0 +1,118 @@
+// Package fsutil holds the file primitives shared by the abbtr packages:
+// advisory locks and atomic replacement of files.
+package fsutil
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "syscall"
+    "time"
+)
+
+// LockTimeout is how long Lock waits for another process to release a file
+var LockTimeout = 10 * time.Second
+
+// Lock takes an advisory lock on path through a companion .lock file and
+// returns the function that releases it. Concurrent abbtr processes wait for
+// each other for up to LockTimeout.
+func Lock(path string) (func(), error) {
+    err := os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return nil, err
+    }
+
+    lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open lock file: %v", err)
+    }
+
+    deadline := time.Now().Add(LockTimeout)
+    for {
+        err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+        if err == nil {
+            break
+        }
+        if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+            lock.Close()
+            if err == syscall.EWOULDBLOCK {
+                return nil, fmt.Errorf("%s is being modified by another abbtr process, try again later", filepath.Base(path))
+            }
+            return nil, fmt.Errorf("failed to lock %s: %v", filepath.Base(path), err)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    return func() {
+        syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+        lock.Close()
+    }, nil
+}
+
+// WriteFileAtomic replaces path with data through a synced temporary file
+// and a rename, so a crash or a full disk never leaves a truncated file. A
+// symbolic link is followed and its target replaced, as with dotfiles kept in
+// a repository. An existing file keeps its mode, perm is for new files.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+    resolved, err := filepath.EvalSymlinks(path)
+    if err == nil {
+        path = resolved
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    if info, err := os.Stat(path); err == nil {
+        perm = info.Mode().Perm()
+    }
+
+    dir := filepath.Dir(path)
+    tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpPath := tmp.Name()
+    defer os.Remove(tmpPath)
+
+    _, err = tmp.Write(data)
+    if err == nil {
+        err = tmp.Chmod(perm)
+    }
+    if err == nil {
+        err = tmp.Sync()
+    }
+    closeErr := tmp.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+
+    err = os.Rename(tmpPath, path)
+    if err != nil {
+        return err
+    }
+
+    // Make the rename itself durable
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    return nil
+}
+
+// Hash returns the hex encoded SHA-256 of content
+func Hash(content []byte) string {
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the Hash of the file at path
+func HashFile(path string) (string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    return Hash(data), nil
+}
@@ -0,0 +1,134 @@
+package fsutil
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLock(t *testing.T) {
+    defer func(timeout time.Duration) { LockTimeout = timeout }(LockTimeout)
+    LockTimeout = 100 * time.Millisecond
+    path := filepath.Join(t.TempDir(), "dir", "abbtr.conf")
+
+    unlock, err := Lock(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(path + ".lock"); err != nil {
+        t.Errorf("the lock file is missing: %v", err)
+    }
+
+    // A second holder waits for LockTimeout, then gives up
+    start := time.Now()
+    if _, err := Lock(path); err == nil || !strings.Contains(err.Error(), "abbtr.conf is being modified by another abbtr process") {
+        t.Errorf("got %v", err)
+    }
+    if waited := time.Since(start); waited < LockTimeout {
+        t.Errorf("gave up after %v, before the timeout", waited)
+    }
+
+    unlock()
+    unlock, err = Lock(path)
+    if err != nil {
+        t.Fatalf("the lock was not released: %v", err)
+    }
+    unlock()
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "abbtr.conf")
+    if err := os.WriteFile(path, []byte("old content, longer than the new one"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil || string(data) != "new" {
+        t.Errorf("got %q, %v", data, err)
+    }
+    // The mode is only chosen for new files
+    if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+        t.Errorf("got %v, %v", info.Mode(), err)
+    }
+    created := filepath.Join(dir, "profiles.json")
+    if err := WriteFileAtomic(created, []byte("new"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("got %v, %v", info.Mode(), err)
+    }
+    if err := os.Remove(created); err != nil {
+        t.Fatal(err)
+    }
+
+    // The temporary file is gone, even when the rename fails
+    if err := WriteFileAtomic(filepath.Join(dir, "missing", "abbtr.conf"), []byte("x"), 0644); err == nil {
+        t.Error("writing into a missing directory succeeded")
+    }
+    if err := os.Mkdir(filepath.Join(dir, "taken"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "taken", "file"), nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := WriteFileAtomic(filepath.Join(dir, "taken"), []byte("x"), 0644); err == nil {
+        t.Error("replacing a directory succeeded")
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, entry := range entries {
+        names = append(names, entry.Name())
+    }
+    if strings.Join(names, " ") != "abbtr.conf taken" {
+        t.Errorf("got %v", names)
+    }
+}
+
+func TestWriteFileAtomicSymlink(t *testing.T) {
+    dir := t.TempDir()
+    target := filepath.Join(dir, "dotfiles", "abbtr.conf")
+    if err := os.Mkdir(filepath.Dir(target), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(target, []byte("old"), 0640); err != nil {
+        t.Fatal(err)
+    }
+    link := filepath.Join(dir, "abbtr.conf")
+    if err := os.Symlink(filepath.Join("dotfiles", "abbtr.conf"), link); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := WriteFileAtomic(link, []byte("new"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+        t.Errorf("the link was replaced: %v, %v", info.Mode(), err)
+    }
+    data, err := os.ReadFile(target)
+    if err != nil || string(data) != "new" {
+        t.Errorf("got %q, %v", data, err)
+    }
+    if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0640 {
+        t.Errorf("got %v, %v", info.Mode(), err)
+    }
+}
+
+func TestHash(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "script")
+    if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    got, err := HashFile(path)
+    if err != nil || got != Hash([]byte("abc")) || got != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+        t.Errorf("got %q, %v", got, err)
+    }
+}
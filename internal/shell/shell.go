@@ -0,0 +1,100 @@
+// Package shell quotes values for bash, adds words to bash commands and
+// tells shells apart from the other interpreters.
+package shell
+
+import (
+    "fmt"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// shells take their command with -c followed by $0 and the arguments, like
+// bash does
+var shells = map[string]bool{"bash": true, "sh": true, "zsh": true, "dash": true, "ksh": true, "mksh": true}
+
+// IsShell reports whether an interpreter is a POSIX style shell. An empty
+// interpreter is bash.
+func IsShell(interpreter string) bool {
+    return interpreter == "" || shells[filepath.Base(interpreter)]
+}
+
+// CheckShell makes sure an interpreter can run on this machine
+func CheckShell(interpreter string) error {
+    if interpreter == "" || strings.ContainsAny(interpreter, " \t") {
+        return fmt.Errorf("'%s' is not an interpreter, give a single program name or path", interpreter)
+    }
+    _, err := exec.LookPath(interpreter)
+    if err != nil {
+        return fmt.Errorf("the interpreter '%s' was not found on this machine", interpreter)
+    }
+    return nil
+}
+
+// safeWord matches the values bash reads literally without quotes
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote wraps a value in single quotes so bash reads it literally
+func Quote(value string) string {
+    if safeWord.MatchString(value) {
+        return value
+    }
+    return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// Append adds words to the end of a command, as bash does with the words
+// typed after an alias. A comment ending the command stays after the words
+// rather than swallowing them, and a backslash ending it stays a backslash
+// rather than escaping the space before them.
+func Append(command, words string) string {
+    end, backslash := tail(command)
+    if backslash {
+        return command[:end] + `\\ ` + words
+    }
+    if end < len(command) {
+        return command[:end] + words + " " + command[end:]
+    }
+    return command + " " + words
+}
+
+// tail returns where the comment ending a command starts, len(command) when
+// it has none, and whether the command ends with a lone backslash, which
+// bash reads literally. Quotes left open are not looked into.
+func tail(command string) (int, bool) {
+    comment := -1
+    // closing ends the quote being read, escapes tells whether backslashes
+    // escape in it: in double quotes, backquotes and $'...' but not in
+    // single quotes
+    closing, escapes := byte(0), false
+    dollar := false
+    for i := 0; i < len(command); i++ {
+        c := command[i]
+        switch {
+        case comment >= 0:
+            if c == '\n' {
+                comment = -1
+            }
+        case closing != 0:
+            if c == '\\' && escapes {
+                i++
+            } else if c == closing {
+                closing = 0
+            }
+        case c == '\\':
+            if i == len(command)-1 {
+                return i, true
+            }
+            i++
+        case c == '\'' || c == '"' || c == '`':
+            closing, escapes = c, c != '\'' || dollar
+        case c == '#' && (i == 0 || strings.IndexByte(" \t\n;&|()<>", command[i-1]) >= 0):
+            comment = i
+        }
+        dollar = closing == 0 && comment < 0 && c == '$'
+    }
+    if comment >= 0 {
+        return comment, false
+    }
+    return len(command), false
+}
@@ -0,0 +1,58 @@
+package shell
+
+import (
+    "os/exec"
+    "strings"
+    "testing"
+
+    "abbtr/internal/corpus"
+)
+
+func TestQuote(t *testing.T) {
+    for _, tc := range corpus.Commands {
+        t.Run(tc.Name, func(t *testing.T) {
+            out, err := exec.Command("bash", "-c", "printf %s "+Quote(tc.Command)).Output()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if string(out) != tc.Command {
+                t.Errorf("got %q, want %q", out, tc.Command)
+            }
+        })
+    }
+}
+
+func TestAppend(t *testing.T) {
+    tests := []struct {
+        command string
+        want    string
+    }{
+        {`echo plain`, "plain a b\n"},
+        {`echo trailing \`, "trailing \\ a b\n"},
+        {`echo escaped \\`, "escaped \\ a b\n"},
+        {`echo visible # hidden "$@"`, "visible a b\n"},
+        {`echo '#' "x # y" $'it\'s #' #real`, "# x # y it's # a b\n"},
+        {`echo x#y ${#1}`, "x#y 0 a b\n"},
+        {`echo "\"" '\' \# # \`, "\" \\ # a b\n"},
+    }
+
+    for _, tc := range tests {
+        command := Append(tc.command, Quote("a")+" "+Quote("b"))
+        out, err := exec.Command("bash", "-c", command).Output()
+        if err != nil || string(out) != tc.want {
+            t.Errorf("%s: %q printed %q, want %q: %v", tc.command, command, out, tc.want, err)
+        }
+    }
+}
+
+func TestCheckShell(t *testing.T) {
+    if err := CheckShell("sh"); err != nil {
+        t.Error(err)
+    }
+    if err := CheckShell("no-such-interpreter"); err == nil || !strings.Contains(err.Error(), "was not found") {
+        t.Errorf("got %v", err)
+    }
+    if err := CheckShell("code --wait"); err == nil || !strings.Contains(err.Error(), "is not an interpreter") {
+        t.Errorf("got %v", err)
+    }
+}
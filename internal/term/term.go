@@ -0,0 +1,69 @@
+// Package term turns the echo of a terminal off while secrets are typed.
+package term
+
+import (
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+    "unsafe"
+)
+
+// DisableEcho stops f from echoing what is typed and returns the function
+// that restores it. Nothing is changed when f is not a terminal. The echo is
+// also restored when the process is interrupted or terminated meanwhile,
+// before the signal takes its usual effect.
+func DisableEcho(f *os.File) func() {
+    var state syscall.Termios
+    if ioctl(f.Fd(), syscall.TCGETS, &state) != nil {
+        return func() {}
+    }
+
+    hidden := state
+    hidden.Lflag &^= syscall.ECHO
+    hidden.Lflag |= syscall.ICANON | syscall.ECHONL
+    if ioctl(f.Fd(), syscall.TCSETS, &hidden) != nil {
+        return func() {}
+    }
+
+    var once sync.Once
+    restore := func() {
+        once.Do(func() {
+            ioctl(f.Fd(), syscall.TCSETS, &state)
+        })
+    }
+
+    signals := make(chan os.Signal, 1)
+    done := make(chan struct{})
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+    go func() {
+        select {
+        case sig := <-signals:
+            restore()
+            // Die of the signal as if it had never been caught
+            signal.Reset(sig)
+            syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+        case <-done:
+        }
+    }()
+
+    return func() {
+        signal.Stop(signals)
+        close(done)
+        restore()
+    }
+}
+
+// IsTerminal reports whether f is attached to a terminal
+func IsTerminal(f *os.File) bool {
+    var state syscall.Termios
+    return ioctl(f.Fd(), syscall.TCGETS, &state) == nil
+}
+
+func ioctl(fd uintptr, request uintptr, state *syscall.Termios) error {
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(state)))
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
@@ -4,16 +4,23 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"html"
-	"net"
-	"path/filepath"
 	"os/exec"
-	"regexp"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 	"log"
+	"io"
+	"sort"
+	"strconv"
 
+	"abbtr/bottles"
+	"abbtr/eventlog"
+	"abbtr/executor"
+	"abbtr/internal/diff"
+	"abbtr/internal/fsutil"
+	"abbtr/internal/term"
+	"abbtr/scripts"
+	"abbtr/store"
 )
 
 const (
@@ -21,15 +28,26 @@ const (
     configFileName = "abbtr.conf"
     logDir = "/.local/share/abbtr/"
     logFileName = "abbtr.log"
+    manifestFileName = "scripts.json"
+    profilesFileName = "profiles.json"
     VERSION = "1.0.4"
 )
 
 var configFile = filepath.Join(os.Getenv("HOME"), configDir, configFileName)
+var manifestFile = filepath.Join(os.Getenv("HOME"), configDir, manifestFileName)
+var profilesFile = filepath.Join(os.Getenv("HOME"), configDir, profilesFileName)
+
+// logger writes abbtr.log, scriptManager keeps ~/.local/bin in line with the
+// rules and runner executes them. All of them are set up by setHome.
+var logger *eventlog.Logger
+var scriptManager *scripts.Manager
+var runner = executor.New()
 
 var reservedNames = []string{
     "-h", "-l", "-n", "-r", "-c", "-ln", "-v", "-i", "-e", "-b",
     "-H", "-L", "-N", "-R", "-C", "-LN", "-V", "-I", "-E", "-B",
-    "-lN", "-Ln",
+    "-lN", "-Ln", "--exec", "--sync", "-p", "-P", "--profile", "-j", "-J",
+    "--edit", "--rename", "--copy",
 
     // Reserved for future implementations
     "-g", "-G", "-w", "-W", "-t", "-T", "-x", "-X", "-y", "-Y",
@@ -48,61 +66,175 @@ func main() {
     if err != nil {
         log.Fatalf("Failed to get home directory: %v", err)
     }
-    configFile = filepath.Join(homeDir, ".config", "abbtr", "abbtr.conf")
+    setHome(homeDir)
 
     err = initConfigFile()
     if err != nil {
         log.Fatalf("Failed to initialize config file: %v", err)
     }
 
-    // Verify if ~/.local/bin is in the PATH
-    checkPath()
-
-    // Call for syncRulesWithScripts
-    err = syncRulesWithScripts()
-    if err != nil {
-        fmt.Printf("Warning: Unable to synchronize rules with scripts: %v\n", err)
-        fmt.Println("This may be normal if this is the first run or if ~/.local/bin doesn't exist.")
-        fmt.Println("The program will continue, but some functionality may be limited.")
-    }
-
     args := os.Args[1:]
 
     bottleValues := make(map[string]string)
+    bottlesFile := os.Getenv("ABBTR_BOTTLES_FILE")
+    profile := os.Getenv("ABBTR_PROFILE")
+    dryRun := false
+    force := false
+    expand := false
+    fromFile := ""
+    opts := runOptions{jobs: 1, failFast: true}
+    var meta store.Settings
     var commands []string
+    var ruleArgs []string
 
     for i := 0; i < len(args); i++ {
-        if strings.HasPrefix(args[i], "-b=") {
+        runningRules := len(commands) > 0 && !strings.HasPrefix(commands[0], "-")
+        // An unquoted command may have its own -p or -j, as in ssh -p 2222
+        definingRule := len(commands) > 0 && (commands[0] == "-n" || commands[0] == "-c")
+        // Settings may follow a quoted command, but once an unquoted command
+        // has several words the rest of the line belongs to it, as in
+        // git log --tags=v1*
+        inCommand := definingRule && len(commands) > 3
+        execArgs := len(commands) == 2 && commands[0] == "--exec"
+        if execArgs && args[i] != "--" && !isRunOption(args[i]) {
+            // The arguments typed after the name of a rule script, once its
+            // leading options of abbtr are read
+            ruleArgs = append(ruleArgs, args[i:]...)
+            break
+        }
+        if args[i] == "--" && (runningRules || execArgs) {
+            // Everything after the separator is forwarded to the rules
+            ruleArgs = append(ruleArgs, args[i+1:]...)
+            break
+        }
+
+        if strings.HasPrefix(args[i], "-b=") && !definingRule {
             parts := strings.SplitN(args[i], "=", 2)
             if len(parts) == 2 {
                 bottleParts := strings.SplitN(parts[1], ":", 2)
                 if len(bottleParts) == 2 {
-                    bottleValues[bottleParts[0]] = bottleParts[1]
+                    // Secret bottles may be named with or without their
+                    // '!', also when scoped to a rule as in ssh.!password
+                    name := strings.TrimPrefix(bottleParts[0], "!")
+                    name = strings.Replace(name, ".!", ".", 1)
+                    bottleValues[name] = bottleParts[1]
                 }
             }
+        } else if strings.HasPrefix(args[i], "--bottles-file=") && !definingRule {
+            bottlesFile = strings.TrimPrefix(args[i], "--bottles-file=")
+        } else if args[i] == "--bottles-file" && !definingRule {
+            if i+1 == len(args) {
+                fmt.Println("Error: Incorrect usage of --bottles-file. It should be: --bottles-file <file path>")
+                return
+            }
+            i++
+            bottlesFile = args[i]
+        } else if strings.HasPrefix(args[i], "-p=") && !definingRule {
+            profile = strings.TrimPrefix(args[i], "-p=")
+        } else if args[i] == "-p" && !definingRule {
+            if i+1 == len(args) {
+                fmt.Println("Error: Incorrect usage of -p. It should be: -p <profile>")
+                return
+            }
+            i++
+            profile = args[i]
+        } else if args[i] == "--dry-run" && !definingRule {
+            dryRun = true
+        } else if strings.HasPrefix(args[i], "--matrix=") && !definingRule {
+            axis, err := parseMatrixAxis(strings.TrimPrefix(args[i], "--matrix="))
+            if err != nil {
+                fmt.Printf("Error: %v\n", err)
+                return
+            }
+            opts.matrix = append(opts.matrix, axis)
+        } else if (args[i] == "-j" || strings.HasPrefix(args[i], "-j=")) && !definingRule {
+            value := strings.TrimPrefix(args[i], "-j=")
+            if args[i] == "-j" && i+1 < len(args) {
+                i++
+                value = args[i]
+            }
+            jobs, err := strconv.Atoi(value)
+            if err != nil || jobs < 1 {
+                fmt.Println("Error: Incorrect usage of -j. It should be: -j <number of rules run at the same time>")
+                return
+            }
+            opts.jobs = jobs
+        } else if args[i] == "--fail-fast" && !definingRule {
+            opts.failFast = true
+        } else if args[i] == "--keep-going" && !definingRule {
+            opts.failFast = false
+        } else if args[i] == "--force" && !definingRule {
+            force = true
+        } else if args[i] == "--expand" && !definingRule {
+            expand = true
+        } else if strings.HasPrefix(args[i], "--desc=") && !inCommand {
+            description := strings.TrimPrefix(args[i], "--desc=")
+            meta.Description = &description
+        } else if strings.HasPrefix(args[i], "--tags=") && !inCommand {
+            tags := store.SplitList(strings.TrimPrefix(args[i], "--tags="))
+            meta.Tags = &tags
+        } else if strings.HasPrefix(args[i], "--from-file=") && !inCommand {
+            fromFile = strings.TrimPrefix(args[i], "--from-file=")
+        } else if args[i] == "--from-file" && !inCommand {
+            if i+1 == len(args) {
+                fmt.Println("Error: Incorrect usage of --from-file. It should be: --from-file <file path>")
+                return
+            }
+            i++
+            fromFile = args[i]
+        } else if strings.HasPrefix(args[i], "--shell=") && !inCommand {
+            shell := strings.TrimPrefix(args[i], "--shell=")
+            meta.Shell = &shell
+        } else if strings.HasPrefix(args[i], "--needs=") && !inCommand {
+            needs := store.SplitList(strings.TrimPrefix(args[i], "--needs="))
+            meta.Needs = &needs
+        } else if strings.HasPrefix(args[i], "--bottle=") && !inCommand {
+            attr, err := parseBottleAttr(strings.TrimPrefix(args[i], "--bottle="))
+            if err != nil {
+                fmt.Printf("Error: %v\n", err)
+                return
+            }
+            meta.Bottles = append(meta.Bottles, attr)
         } else {
             commands = append(commands, args[i])
         }
     }
 
+    // Verify if ~/.local/bin is in the PATH. Rules being run, as by their
+    // scripts under cron, keep their output to themselves.
+    if len(commands) == 0 || commands[0] != "--exec" && strings.HasPrefix(commands[0], "-") {
+        checkPath()
+    }
+
     if len(commands) == 0 {
         showHelp()
         return
     }
 
+    // Bring the scripts up to date if abbtr.conf changed since the last run
+    if commands[0] != "-h" && commands[0] != "-v" && commands[0] != "--sync" {
+        report, err := syncRulesWithScripts(false)
+        if err != nil {
+            fmt.Printf("Warning: Unable to synchronize rules with scripts: %v\n", err)
+            fmt.Println("This may be normal if this is the first run or if ~/.local/bin doesn't exist.")
+            fmt.Println("The program will continue, but some functionality may be limited.")
+        } else if !report.Empty() {
+            fmt.Printf("Scripts synchronized (%s).\n", report)
+        }
+    }
+
     switch commands[0] {
     case "-h":
         showHelp()
     case "-l":
         listRules()
     case "-n":
-        if len(commands) < 3 {
-            fmt.Println("Error: Incorrect usage of -n. It should be: abbtr -n <name> '<command>'")
+        command, ok := ruleCommand(commands, fromFile)
+        if !ok {
             return
         }
         name := commands[1]
-        command := strings.Join(commands[2:], " ")
-        createRule(name, command)
+        createRule(name, command, meta)
     case "-r":
         if len(commands) == 1 {
             fmt.Println("Error: Incorrect usage of -r. It should be: abbtr -r <name> [<name>...] or abbtr -r a")
@@ -110,27 +242,46 @@ func main() {
         }
         names := commands[1:]
         if len(names) == 1 && names[0] == "a" {
-            deleteAllRules()
-        } else {
-            for _, name := range names {
-                deleteRule(name)
+            err := deleteAllRules()
+            if err != nil {
+                fmt.Printf("Error deleting all rules: %v\n", err)
+                os.Exit(1)
             }
+        } else {
+            deleteRules(names, force)
         }
     case "-c":
-        if len(commands) < 3 {
-            fmt.Println("Error: Incorrect usage of -c. It should be: abbtr -c <name> '<command>'")
+        command, ok := ruleCommand(commands, fromFile)
+        if !ok {
             return
         }
         name := commands[1]
-        command := strings.Join(commands[2:], " ")
-        updateRule(name, command)
+        updateRule(name, command, meta)
     case "-ln":
         if len(commands) != 2 {
-            fmt.Println("Error: Incorrect usage of -ln. It should be: abbtr -ln <name>")
+            fmt.Println("Error: Incorrect usage of -ln. It should be: abbtr -ln <name> [--expand]")
             return
         }
         name := commands[1]
-        showRule(name)
+        showRule(name, expand)
+    case "--edit":
+        if len(commands) != 2 {
+            fmt.Println("Error: Incorrect usage of --edit. It should be: abbtr --edit <name>")
+            return
+        }
+        editRule(commands[1])
+    case "--rename":
+        if len(commands) != 3 {
+            fmt.Println("Error: Incorrect usage of --rename. It should be: abbtr --rename <name> <new name>")
+            return
+        }
+        renameRule(commands[1], commands[2])
+    case "--copy":
+        if len(commands) != 3 {
+            fmt.Println("Error: Incorrect usage of --copy. It should be: abbtr --copy <name> <new name>")
+            return
+        }
+        copyRule(commands[1], commands[2])
     case "-v":
         fmt.Println("abbtr version", VERSION)
     case "-i":
@@ -142,13 +293,135 @@ func main() {
         importRulesFromFile(importSource)
     case "-e":
         exportRules()
+    case "--sync":
+        report, err := syncRulesWithScripts(true)
+        if err != nil {
+            fmt.Printf("Error synchronizing rules with scripts: %v\n", err)
+            return
+        }
+        fmt.Printf("Scripts synchronized (%s).\n", report)
+    case "--profile":
+        manageProfiles(commands[1:], bottleValues)
+    case "--default-shell":
+        if len(commands) > 2 {
+            fmt.Println("Error: Incorrect usage of --default-shell. It should be: abbtr --default-shell [<interpreter>]")
+            return
+        }
+        if len(commands) == 1 {
+            showDefaultShell()
+            return
+        }
+        setDefaultShell(commands[1])
+    case "--exec":
+        // Used by the generated scripts of rules with bottles
+        if len(commands) != 2 {
+            fmt.Println("Error: Incorrect usage of --exec. It should be: abbtr --exec <name>")
+            return
+        }
+        resolver, err := newResolver(bottleValues, profile, bottlesFile)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+        if dryRun {
+            os.Exit(explainCommands(commands[1:], resolver, ruleArgs, opts))
+        }
+        os.Exit(runCommands(commands[1:], resolver, ruleArgs, opts))
     default:
         if strings.HasPrefix(commands[0], "-") {
             fmt.Println("Unrecognized option. Use abbtr -h to see the available options.")
-        } else {
-            runCommands(commands, bottleValues)
+            return
+        }
+        resolver, err := newResolver(bottleValues, profile, bottlesFile)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+        if dryRun {
+            os.Exit(explainCommands(commands, resolver, ruleArgs, opts))
+        }
+        os.Exit(runCommands(commands, resolver, ruleArgs, opts))
+    }
+}
+
+// isRunOption reports whether arg gives bottle values to a rule run by its
+// script, before the arguments of the rule. Any other option goes to the
+// command, as it does in the scripts of plain rules.
+func isRunOption(arg string) bool {
+    for _, prefix := range []string{"-b=", "-p=", "--bottles-file="} {
+        if strings.HasPrefix(arg, prefix) {
+            return true
         }
     }
+    return false
+}
+
+// runOptions control how runCommands runs the rules
+type runOptions struct {
+    // matrix runs the rules once for every combination of its values
+    matrix bottles.Matrix
+    // jobs is the number of rules, or of matrix iterations, run at the same
+    // time
+    jobs int
+    // failFast skips what is left of the run once a rule failed, it is
+    // turned off by --keep-going
+    failFast bool
+}
+
+func parseMatrixAxis(arg string) (bottles.Axis, error) {
+    parts := strings.SplitN(arg, ":", 2)
+    if len(parts) == 2 && parts[0] != "" {
+        axis := bottles.Axis{Bottle: strings.Replace(strings.TrimPrefix(parts[0], "!"), ".!", ".", 1)}
+        for _, value := range strings.Split(parts[1], ",") {
+            value = strings.TrimSpace(value)
+            if value != "" {
+                axis.Values = append(axis.Values, value)
+            }
+        }
+        if len(axis.Values) > 0 {
+            return axis, nil
+        }
+    }
+    return bottles.Axis{}, fmt.Errorf("incorrect usage of --matrix. It should be: --matrix=<bottle>:<value,value...>")
+}
+
+// newResolver gathers the bottle values given on the command line, in the
+// profile and in the bottles file, if any
+func newResolver(bottleValues map[string]string, profile, bottlesFile string) (*bottles.Resolver, error) {
+    resolver := &bottles.Resolver{Flags: bottleValues}
+    if profile != "" {
+        profiles, err := store.ReadProfiles(profilesFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read the profiles: %v", err)
+        }
+        values, ok := profiles.Profiles[profile]
+        if !ok {
+            return nil, fmt.Errorf("profile '%s' not found", profile)
+        }
+        resolver.Profile = values
+    }
+    if bottlesFile != "" {
+        values, err := bottles.ReadFile(bottlesFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read the bottles file: %v", err)
+        }
+        resolver.File = values
+    }
+    return resolver, nil
+}
+
+// setHome points every file abbtr uses inside homeDir
+func setHome(homeDir string) {
+    configFile = filepath.Join(homeDir, ".config", "abbtr", configFileName)
+    manifestFile = filepath.Join(homeDir, ".config", "abbtr", manifestFileName)
+    profilesFile = filepath.Join(homeDir, ".config", "abbtr", profilesFileName)
+    logger = eventlog.New(filepath.Join(homeDir, logDir, logFileName))
+    scriptManager = &scripts.Manager{
+        Dir:          filepath.Join(homeDir, ".local", "bin"),
+        ManifestPath: manifestFile,
+        LogPath:      logger.Path,
+    }
+    loadedStore = nil
 }
 
 func showHelp() {
@@ -156,134 +429,168 @@ func showHelp() {
     fmt.Println(" ")
     fmt.Println("Available options:")
     fmt.Println(" -n <name> '<command>'\tCreate a new rule")
+    fmt.Println(" -n <name> -\t\tCreate a rule whose command, of one or more lines, is read")
+    fmt.Println("\t\t\tfrom the standard input (also with -c)")
+    fmt.Println(" -n <name> --from-file <file path>")
+    fmt.Println("\t\t\tCreate a rule whose command is read from a file (also with -c)")
     fmt.Println(" -l\t\t\tList stored rules")
     fmt.Println(" -r <name> [<name>...]\tDelete existing rules")
     fmt.Println(" -r a \t\t\tDelete all rules")
+    fmt.Println(" -r <name> --force\tDelete a rule even if other rules use it")
     fmt.Println(" -c <name> '<command>'\tUpdate the command of a rule")
     fmt.Println(" -ln <name>\t\tShow the contents of a specific rule")
+    fmt.Println(" -ln <name> --expand\tAlso show its command with the rules it uses expanded")
+    fmt.Println(" --edit <name>\t\tEdit or create a rule in $VISUAL or $EDITOR")
+    fmt.Println(" --rename <name> <new name>")
+    fmt.Println("\t\t\tRename a rule, updating the rules that use it")
+    fmt.Println(" --copy <name> <new name>")
+    fmt.Println("\t\t\tCopy a rule and its settings under a new name")
     fmt.Println(" -h\t\t\tShow this help")
     fmt.Println(" -v\t\t\tShow the program version")
     fmt.Println(" -i <file path>\t\tImport rules from a local file")
     fmt.Println(" -e\t\t\tExport rules to a text file (backup)")
+    fmt.Println(" --sync\t\t\tRegenerate missing or modified rule scripts")
+    fmt.Println(" <name> -- <args>\tRun a rule forwarding arguments to its command")
+    fmt.Println("\t\t\tUse @<rule> in a command to run the command of another rule")
+    fmt.Printf("\t\t\tSyntax for placing an argument: b%%(1)%%b, b%%(2)%%b...\n")
     fmt.Println(" -b=<variable:value>\tPre-define the content of a bottle")
-    fmt.Println("\t\t\tSyntax for create bottles: b%('variable')%b")
+    fmt.Printf("\t\t\tSyntax for create bottles: b%%('variable')%%b\n")
+    fmt.Printf("\t\t\twith a default value: b%%('variable'|'default')%%b\n")
+    fmt.Printf("\t\t\tor a secret, typed hidden and never logged: b%%('!variable')%%b\n")
+    fmt.Println("\t\t\tor export ABBTR_BOTTLE_<variable>=<value>")
+    fmt.Println(" -b=<rule>.<variable:value>")
+    fmt.Println("\t\t\tPre-define a bottle for one of the rules run in bulk")
+    fmt.Println(" --matrix=<variable>:<a,b,c>")
+    fmt.Println("\t\t\tRun the rules once per value, repeat it to combine bottles")
+    fmt.Println(" -j <number>\t\tRun up to this number of rules or matrix iterations at the same time")
+    fmt.Println(" --fail-fast\t\tStop a bulk or matrix run at the first failure (default)")
+    fmt.Println(" --keep-going\t\tRun every rule or iteration even after a failure")
+    fmt.Println(" --dry-run\t\tShow the commands and where each bottle value comes from")
+    fmt.Println("\t\t\twithout running anything")
+    fmt.Println(" -p <profile>\t\tUse the bottle values saved in a profile (or set ABBTR_PROFILE)")
+    fmt.Println(" --profile save <profile> -b=<variable:value>...")
+    fmt.Println("\t\t\tSave bottle values as a profile, replacing it if it exists")
+    fmt.Println(" --profile list\t\tList the saved profiles")
+    fmt.Println(" --profile delete <profile>")
+    fmt.Println("\t\t\tDelete a profile")
+    fmt.Println(" --bottles-file=<path>\tRead bottle values from a file of variable=value lines")
+    fmt.Println("\t\t\t(or set ABBTR_BOTTLES_FILE). Sources in order: -b=, the")
+    fmt.Println("\t\t\tprofile, the file, the environment, the command attribute,")
+    fmt.Println("\t\t\tthe prompt")
+    fmt.Println(" --desc=<text>\t\tSet the description of a rule (with -n or -c)")
+    fmt.Println(" --tags=<tag,tag>\tSet the tags of a rule (with -n or -c)")
+    fmt.Println(" --needs=<rule,rule>\tSet the rules that run first when a rule runs (with -n or -c)")
+    fmt.Println(" --shell=<interpreter>\tRun the command of a rule with zsh, sh, fish, python3, perl...")
+    fmt.Println("\t\t\t(with -n or -c), empty for the default")
+    fmt.Println(" --default-shell [<interpreter>]")
+    fmt.Println("\t\t\tShow or change the interpreter of the rules without one (bash)")
+    fmt.Println(" --bottle=<variable>:<attribute>=<value>")
+    fmt.Println("\t\t\tRestrict the values of a bottle (with -n or -c). Attributes:")
+    fmt.Println("\t\t\ttype=int|port|path|hostname, choices=<a,b,c>,")
+    fmt.Println("\t\t\tpattern=<regular expression>, prompt=<text>,")
+    fmt.Println("\t\t\tenv=<variable to read>, command=<command printing the value>")
     fmt.Println(" ")
     fmt.Println("Usage examples:")
     fmt.Println(" Create a new rule: abbtr -n update 'sudo apt update -y'")
     fmt.Println(" The next time just run: update")
     fmt.Println(" ")
-    fmt.Println(" Create a new rule with bottle: abbtr -n ssh 'ssh -p 2222 b%('username')%b@example.com'")
+    fmt.Printf(" Create a new rule with bottle: abbtr -n ssh 'ssh -p 2222 b%%('username')%%b@example.com'\n")
     fmt.Println(" The next time you run 'ssh' the system will ask you for the username value")
     fmt.Println(" ")
+    fmt.Println(" Forward arguments: abbtr -n gs 'git status' and then run: gs -s")
+    fmt.Println(" ")
     fmt.Println("For further help go to https://github.com/manuwarfare/abbtr")
     fmt.Println("Author: Manuel Guerra")
     fmt.Printf("V %s | Software licensed under the BSD 3-Clause License\n", VERSION)
 }
 
 func listRules() {
-    file, err := os.Open(configFile)
+    rules, err := loadRules()
     if err != nil {
-        fmt.Println("Failed to open the configuration file:", err)
+        fmt.Println("Failed to read the configuration file:", err)
         fmt.Println("No rules have been created in abbtr yet.")
         return
     }
-    defer file.Close()
-
-    scanner := bufio.NewScanner(file)
-    var rules [][]string
-
-    for scanner.Scan() {
-        line := scanner.Text()
-        parts := strings.SplitN(line, "=", 2)
-        if len(parts) != 2 {
-            continue
-        }
-        name := strings.TrimSpace(parts[0])
-        command := strings.TrimSpace(parts[1])
-        rules = append(rules, []string{name, command})
-    }
 
-    if len(rules) == 0 {
+    if len(rules.Rules) == 0 {
         fmt.Println("No rules have been created in abbtr yet.")
         return
     }
 
     // Print rules
     fmt.Println("Rules:")
-    for _, rule := range rules {
-        fmt.Printf("Rule Name: %s\n", rule[0])
-        fmt.Printf("Command: %s\n\n", rule[1])
+    for _, rule := range rules.Rules {
+        fmt.Printf("Rule Name: %s\n", rule.Name)
+        if rule.Description != "" {
+            fmt.Printf("Description: %s\n", rule.Description)
+        }
+        if len(rule.Needs) > 0 {
+            fmt.Printf("Needs: %s\n", strings.Join(rule.Needs, ", "))
+        }
+        printCommand("Command:", rule.Command)
+        fmt.Println()
     }
+}
 
-    if err := scanner.Err(); err != nil {
+func createRule(name, command string, meta store.Settings) {
+    // Read the existing rules from the configuration file
+    rules, err := loadRules()
+    if err != nil {
         fmt.Println("Error reading the configuration file:", err)
+        return
     }
-}
 
-func createRule(name, command string) {
-    // Read existing lines from the configuration file
-    lines, err := readLines(configFile)
+    err = checkNewName(name)
     if err != nil {
-        fmt.Println("Error reading the configuration file:", err)
+        fmt.Printf("Unable to create a rule with this name. %v.\n", err)
         return
     }
 
-    // Check if the rule name is reserved
-    if isReservedName(name) {
-        fmt.Printf("Unable to create a rule with this name. '%s' is a reserved command name.\n", name)
+    err = meta.Check(command)
+    if err != nil {
+        fmt.Printf("Unable to create rule. %v.\n", err)
         return
     }
 
     // Check if the rule already exists and ask if it should be overwritten
-    found := false
-    for i, line := range lines {
-        if strings.HasPrefix(line, name+" = ") {
-            fmt.Printf("The rule '%s' already exists. Do you want to overwrite it? (y/n): ", name)
-            var response string
-            fmt.Scanln(&response)
-            if response != "y" {
-                fmt.Println("Operation cancelled.")
-                return
-            }
-            lines[i] = fmt.Sprintf("%s = %s", name, command)
-            found = true
-            break
+    if rules.Find(name) != nil {
+        fmt.Printf("The rule '%s' already exists. Do you want to overwrite it? (y/n): ", name)
+        var response string
+        fmt.Scanln(&response)
+        if response != "y" {
+            fmt.Println("Operation cancelled.")
+            return
         }
     }
 
-    // If the rule was not found, add it to the configuration
-    if !found {
-        lines = append(lines, fmt.Sprintf("%s = %s", name, command))
-    }
-
-    // Write the updated lines to the configuration file
-    err = writeLines(configFile, lines)
-    if err != nil {
-        fmt.Println("Error writing to the configuration file:", err)
+    // Write the rule to the configuration file
+    var saved *store.Rule
+    var invalid error
+    err = updateRules(func(rules *store.Store) error {
+        rules.Set(name, command, meta)
+        saved, invalid = executor.Prepare(rules, name)
+        return invalid
+    })
+    if invalid != nil {
+        fmt.Printf("Unable to create rule. %v.\n", invalid)
         return
     }
-
-    // Create the ~/.local/bin directory if it does not exist
-    binDir := filepath.Join(os.Getenv("HOME"), ".local", "bin")
-    err = os.MkdirAll(binDir, 0755)
     if err != nil {
-        fmt.Printf("Error creating directory %s: %v\n", binDir, err)
+        fmt.Println("Error writing to the configuration file:", err)
         return
     }
 
-    // Escape double quotes in the command
-    escapedCommand := strings.Replace(command, `"`, `\"`, -1)
-
-    // Create the script in ~/.local/bin using the escaped command
-    scriptPath := filepath.Join(binDir, name)
-    scriptContent := createScriptContent(name, escapedCommand)
-
-    err = os.WriteFile(scriptPath, []byte(scriptContent), 0755)
+    // Create the script in ~/.local/bin
+    err = scriptManager.Write(saved)
     if err != nil {
         fmt.Printf("Error creating script: %v\n", err)
         return
     }
 
+    // Rules referring to this one embed its command in their scripts
+    refreshDependentScripts(name)
+    warnMentions(name)
+
     // Log the event in abbtr.log
     err = logEvent("CREATE_RULE", fmt.Sprintf("Name: %s, Command: %s", name, command))
     if err != nil {
@@ -294,91 +601,218 @@ func createRule(name, command string) {
     fmt.Printf("Rule '%s' successfully added. You can now use it directly by typing '%s'\n", name, name)
 }
 
-func deleteRule(name string) {
-    // Read existing lines from the configuration file
-    lines, err := readLines(configFile)
+// checkNewName makes sure a new rule can take a name: it is not reserved, it
+// can be a script name and typed as a single word, and it does not shadow a
+// program that abbtr did not install
+func checkNewName(name string) error {
+    if isReservedName(name) {
+        return fmt.Errorf("'%s' is a reserved command name", name)
+    }
+
+    err := store.ValidateName(name)
     if err != nil {
-        fmt.Println("Error reading the configuration file:", err)
-        return
+        return err
     }
 
-    // Check if the rule exists and remove it from the configuration file
-    found := false
-    for i, line := range lines {
-        if strings.HasPrefix(line, name+" = ") {
-            lines = append(lines[:i], lines[i+1:]...)
-            found = true
-            break
+    owned, err := scriptManager.IsAbbtrScript(scriptManager.Path(name))
+    if err == nil && !owned {
+        return fmt.Errorf("'%s' already exists in ~/.local/bin and was not created by abbtr", name)
+    }
+    return nil
+}
+
+// ruleCommand returns the command given to -n or -c: the words after the
+// name, the standard input for "-" or the file given with --from-file. Usage
+// and read errors are reported.
+func ruleCommand(commands []string, fromFile string) (string, bool) {
+    option := commands[0]
+    source := ""
+    switch {
+    case fromFile != "" && len(commands) == 2:
+        source = fromFile
+    case fromFile == "" && len(commands) == 3 && commands[2] == "-":
+        source = "-"
+    case fromFile == "" && len(commands) >= 3:
+        return strings.Join(commands[2:], " "), true
+    default:
+        fmt.Printf("Error: Incorrect usage of %s. It should be: abbtr %s <name> '<command>', abbtr %s <name> - or abbtr %s <name> --from-file <file path>\n", option, option, option, option)
+        return "", false
+    }
+
+    var data []byte
+    var err error
+    if source == "-" {
+        if term.IsTerminal(os.Stdin) {
+            fmt.Println("Type the command, then press Ctrl+D on an empty line:")
         }
+        data, err = io.ReadAll(stdin)
+    } else {
+        data, err = os.ReadFile(source)
+    }
+    if err != nil {
+        fmt.Printf("Error: Unable to read the command: %v\n", err)
+        return "", false
     }
 
-    if !found {
-        fmt.Printf("Rule '%s' not found.\n", name)
+    // The line break ending the last line is not part of the command
+    command := strings.TrimRight(string(data), "\r\n")
+    if strings.TrimSpace(command) == "" {
+        fmt.Println("Error: The command is empty.")
+        return "", false
+    }
+    return command, true
+}
+
+// showDefaultShell prints the interpreter of the rules that name none
+func showDefaultShell() {
+    rules, err := loadRules()
+    if err != nil {
+        fmt.Println("Error reading the configuration file:", err)
+        return
+    }
+    if rules.Shell == "" {
+        fmt.Println("Rules without a shell of their own run with bash.")
         return
     }
+    fmt.Printf("Rules without a shell of their own run with %s.\n", rules.Shell)
+}
 
-    err = writeLines(configFile, lines)
+// setDefaultShell changes the interpreter of the rules that name none and
+// rewrites their scripts
+func setDefaultShell(interpreter string) {
+    var invalid error
+    err := updateRules(func(rules *store.Store) error {
+        invalid = executor.SetDefaultShell(rules, interpreter)
+        return invalid
+    })
+    if invalid != nil {
+        fmt.Printf("Unable to change the default shell. %v.\n", invalid)
+        return
+    }
     if err != nil {
         fmt.Println("Error writing to the configuration file:", err)
         return
     }
 
-    // Remove the corresponding script in ~/.local/bin
-    scriptPath := filepath.Join(os.Getenv("HOME"), ".local", "bin", name)
-    err = os.Remove(scriptPath)
-    if err != nil && !os.IsNotExist(err) {
-        fmt.Printf("Error deleting script: %v\n", err)
-        return
+    _, err = syncRulesWithScripts(false)
+    if err != nil {
+        fmt.Printf("Warning: Unable to update the scripts of the rules: %v\n", err)
     }
 
-    // Log the deletion event in abbtr.log
-    err = logEvent("DELETE_RULE", fmt.Sprintf("Name: %s", name))
+    err = logEvent("SET_DEFAULT_SHELL", fmt.Sprintf("Shell: %s", interpreter))
     if err != nil {
         fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
 
-    fmt.Printf("Rule '%s' successfully deleted.\n", name)
+    fmt.Printf("Rules without a shell of their own now run with %s.\n", interpreter)
 }
 
-func deleteAllRules() error {
-    // Open the configuration file for writing
-    file, err := os.OpenFile(configFile, os.O_WRONLY, 0644)
+// warnMentions tells about the rules holding @name as plain text, written
+// before a rule took that name. They do not run the new rule.
+func warnMentions(name string) {
+    rules, err := loadRules()
     if err != nil {
-        return fmt.Errorf("failed to open abbtr.conf: %v", err)
+        return
     }
-    defer file.Close()
+    if mentions := rules.Mentions(name); len(mentions) > 0 {
+        fmt.Printf("Warning: '@%s' in the command of %s does not refer to the rule '%s'. Update the command with -c or --edit to make it a reference.\n", name, strings.Join(mentions, ", "), name)
+    }
+}
 
-    // Truncate the configuration file to remove all rules
-    err = file.Truncate(0)
+// refreshDependentScripts rewrites the scripts of the rules referring to a
+// rule whose command changed
+func refreshDependentScripts(name string) {
+    rules, err := loadRules()
+    if err != nil || len(rules.Dependents(name)) == 0 {
+        return
+    }
+    _, err = syncRulesWithScripts(false)
     if err != nil {
-        return fmt.Errorf("failed to truncate abbtr.conf: %v", err)
+        fmt.Printf("Warning: Unable to update the scripts of the rules using '%s': %v\n", name, err)
     }
+}
 
-    // Define the directory containing the scripts for the rules
-    rulesDir := filepath.Join(os.Getenv("HOME"), ".local/bin")
+// deleteRules removes rules. Unless forced, rules that other rules refer to
+// or need are kept, except when those are deleted as well.
+func deleteRules(names []string, force bool) {
+    var deletion *store.Deletion
+    err := updateRules(func(rules *store.Store) error {
+        deletion = rules.Delete(names, force)
+        if len(deletion.Deleted) == 0 {
+            return store.ErrAborted
+        }
+        return nil
+    })
+    if err != nil && err != store.ErrAborted {
+        fmt.Println("Error writing to the configuration file:", err)
+        return
+    }
 
-    // Read all files in the rules directory
-    files, err := os.ReadDir(rulesDir)
-    if err != nil {
-        return fmt.Errorf("failed to read rules directory: %v", err)
+    for _, name := range names {
+        if users, ok := deletion.Blocked[name]; ok {
+            fmt.Printf("Unable to delete rule '%s', it is used by %s. Use --force to delete it anyway.\n", name, strings.Join(users, ", "))
+        }
     }
+    for _, name := range deletion.Missing {
+        fmt.Printf("Rule '%s' not found.\n", name)
+    }
+    for _, name := range deletion.Deleted {
+        // Remove the corresponding script in ~/.local/bin
+        err = removeScript(name)
+        if err != nil {
+            fmt.Printf("Error deleting script of '%s': %v\n", name, err)
+            continue
+        }
 
-    // Iterate over the files and remove each script
-    for _, file := range files {
-        if !file.IsDir() {  // Ensure it's not a directory
-            scriptPath := filepath.Join(rulesDir, file.Name())
-            err := os.Remove(scriptPath)
-            if err != nil {
-                fmt.Printf("Error deleting script %s: %v\n", file.Name(), err)
-            }
+        // Log the deletion event in abbtr.log
+        err = logEvent("DELETE_RULE", fmt.Sprintf("Name: %s", name))
+        if err != nil {
+            fmt.Printf("Warning: Failed to log event: %v\n", err)
+        }
+
+        fmt.Printf("Rule '%s' successfully deleted.\n", name)
+    }
+
+    // The rules that used them no longer expand them
+    if len(deletion.Orphaned) > 0 {
+        _, err = syncRulesWithScripts(false)
+        if err != nil {
+            fmt.Printf("Warning: Unable to update the scripts of %s: %v\n", strings.Join(deletion.Orphaned, ", "), err)
         }
     }
+}
+
+func deleteAllRules() error {
+    // Empty the store to remove all rules
+    err := updateRules(func(rules *store.Store) error {
+        rules.Clear()
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to write abbtr.conf: %v", err)
+    }
+
+    // Only the scripts abbtr created are removed, anything else in
+    // ~/.local/bin belongs to other programs
+    report, err := scriptManager.RemoveAll()
+    for _, scriptErr := range report.Errors {
+        fmt.Printf("Error: %v\n", scriptErr)
+    }
+    for _, name := range report.Skipped {
+        fmt.Printf("Skipped %s: it was not created by abbtr.\n", scriptManager.Path(name))
+    }
+    if err != nil {
+        return fmt.Errorf("the rules were deleted but not their scripts: %v", err)
+    }
+    if len(report.Errors) > 0 {
+        return fmt.Errorf("the rules were deleted but not every script")
+    }
 
     fmt.Println("All rules have been successfully deleted.")
     return nil
 }
 
-func updateRule(name, command string) {
+func updateRule(name, command string, meta store.Settings) {
 
     // Initialize configuration file
     err := initConfigFile()
@@ -387,8 +821,8 @@ func updateRule(name, command string) {
         return
     }
 
-    // Read existing lines from the configuration file
-    lines, err := readLines(configFile)
+    // Read the existing rules from the configuration file
+    rules, err := loadRules()
     if err != nil {
         fmt.Println("Error reading the configuration file:", err)
         return
@@ -400,258 +834,751 @@ func updateRule(name, command string) {
         return
     }
 
+    err = meta.Check(command)
+    if err != nil {
+        fmt.Printf("Unable to update rule. %v.\n", err)
+        return
+    }
+
+    if rules.Find(name) == nil {
+        fmt.Printf("Rule '%s' not found.\n", name)
+        return
+    }
+
     // Update the rule in the configuration
-    found := false
-    for i, line := range lines {
-        if strings.HasPrefix(line, name+" = ") {
-            lines[i] = fmt.Sprintf("%s = %s", name, command)
-            found = true
-            break
+    var saved *store.Rule
+    var invalid error
+    err = updateRules(func(rules *store.Store) error {
+        if rules.Find(name) == nil {
+            return store.ErrNotFound
         }
+        rules.Set(name, command, meta)
+        saved, invalid = executor.Prepare(rules, name)
+        return invalid
+    })
+    if err == store.ErrNotFound {
+        fmt.Printf("Rule '%s' not found.\n", name)
+        return
+    }
+    if invalid != nil {
+        fmt.Printf("Unable to update rule. %v.\n", invalid)
+        return
+    }
+    if err != nil {
+        fmt.Println("Error writing to the configuration file:", err)
+        return
+    }
+
+    // Create or update the script file
+    err = scriptManager.Write(saved)
+    if err != nil {
+        fmt.Printf("Error updating script: %v\n", err)
+        return
+    }
+
+    // Rules referring to this one embed its command in their scripts
+    refreshDependentScripts(name)
+
+    // Log the event
+    err = logEvent("UPDATE_RULE", fmt.Sprintf("Name: %s, New Command: %s", name, command))
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+
+    fmt.Printf("Rule '%s' successfully updated.\n", name)
+}
+
+// renameRule gives a rule a new name in a single write of abbtr.conf, along
+// with the needs and references of the rules using it. The scripts follow.
+func renameRule(name, newName string) {
+    err := checkNewName(newName)
+    if err != nil {
+        fmt.Printf("Unable to rename rule. %v.\n", err)
+        return
     }
 
-    if !found {
+    err = updateRules(func(rules *store.Store) error {
+        err := rules.Rename(name, newName)
+        if err != nil {
+            return err
+        }
+        // The values saved for the rule alone follow it
+        return store.RenameRuleValues(profilesFile, name, newName)
+    })
+    if err == store.ErrExists {
+        fmt.Printf("Unable to rename rule. A rule named '%s' already exists.\n", newName)
+        return
+    }
+    if err == store.ErrNotFound {
         fmt.Printf("Rule '%s' not found.\n", name)
         return
     }
+    if err != nil {
+        fmt.Println("Error writing to the configuration file:", err)
+        return
+    }
+
+    // Write the new script, remove the old one and rewrite the scripts of
+    // the rules using it. Whatever fails here is retried on the next run.
+    _, err = syncRulesWithScripts(false)
+    if err != nil {
+        fmt.Printf("Warning: Unable to update the scripts of the rules: %v\n", err)
+    }
+
+    warnMentions(newName)
+
+    err = logEvent("RENAME_RULE", fmt.Sprintf("Name: %s, New Name: %s", name, newName))
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+
+    fmt.Printf("Rule '%s' successfully renamed to '%s'.\n", name, newName)
+}
+
+// copyRule adds a rule with the command and metadata of another one
+func copyRule(name, newName string) {
+    err := checkNewName(newName)
+    if err != nil {
+        fmt.Printf("Unable to copy rule. %v.\n", err)
+        return
+    }
 
-    // Write updated lines to the configuration file
-    err = writeLines(configFile, lines)
+    var saved *store.Rule
+    var invalid error
+    err = updateRules(func(rules *store.Store) error {
+        _, err := rules.Copy(name, newName)
+        if err != nil {
+            return err
+        }
+        saved, invalid = executor.Prepare(rules, newName)
+        return invalid
+    })
+    if err == store.ErrExists {
+        fmt.Printf("Unable to copy rule. A rule named '%s' already exists.\n", newName)
+        return
+    }
+    if err == store.ErrNotFound {
+        fmt.Printf("Rule '%s' not found.\n", name)
+        return
+    }
+    if invalid != nil {
+        fmt.Printf("Unable to copy rule. %v.\n", invalid)
+        return
+    }
     if err != nil {
         fmt.Println("Error writing to the configuration file:", err)
         return
     }
 
-    // Create the directory for scripts if it does not exist
-    binDir := filepath.Join(os.Getenv("HOME"), ".local/bin")
-    err = os.MkdirAll(binDir, 0755)
+    err = scriptManager.Write(saved)
+    if err != nil {
+        fmt.Printf("Error creating script: %v\n", err)
+        return
+    }
+
+    warnMentions(newName)
+
+    err = logEvent("COPY_RULE", fmt.Sprintf("Name: %s, Copied From: %s", newName, name))
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+
+    fmt.Printf("Rule '%s' successfully copied to '%s'. You can now use it directly by typing '%s'\n", name, newName, newName)
+}
+
+// editRule opens a rule in the editor of the user, or an empty one when it
+// does not exist yet. The result is checked, shown as a diff and, once
+// confirmed, saved by updateRule or createRule like any other change.
+func editRule(name string) {
+    rules, err := loadRules()
+    if err != nil {
+        fmt.Println("Error reading the configuration file:", err)
+        return
+    }
+
+    rule := rules.Find(name)
+    creating := rule == nil
+    if creating {
+        err = checkNewName(name)
+        if err != nil {
+            fmt.Printf("Unable to create a rule with this name. %v.\n", err)
+            return
+        }
+        rule = &store.Rule{Name: name}
+    } else if isReservedName(name) {
+        fmt.Printf("Unable to update rule. '%s' is a reserved command name.\n", name)
+        return
+    }
+
+    file, err := os.CreateTemp("", "abbtr-"+name+"-*.txt")
+    if err != nil {
+        fmt.Printf("Error: Unable to create a temporary file: %v\n", err)
+        return
+    }
+    file.Close()
+    defer os.Remove(file.Name())
+
+    // Reopen what was typed until it is valid or the user gives up
+    original := store.FormatDocument(rule)
+    text := original
+    var command string
+    var meta store.Settings
+    for {
+        err = os.WriteFile(file.Name(), []byte(text), 0600)
+        if err == nil {
+            err = runEditor(file.Name())
+        }
+        if err != nil {
+            fmt.Printf("Error: Unable to edit the rule: %v\n", err)
+            return
+        }
+        data, err := os.ReadFile(file.Name())
+        if err != nil {
+            fmt.Printf("Error: Unable to read the edited rule: %v\n", err)
+            return
+        }
+        text = string(data)
+
+        var doc store.Document
+        doc, err = store.ParseDocument(text)
+        command, meta = doc.Command, doc.Settings()
+        if err == nil && strings.TrimSpace(command) == "" {
+            fmt.Println("The command is empty. Operation cancelled.")
+            return
+        }
+        if err == nil {
+            err = executor.Preview(rules, name, command, meta)
+        }
+        if err == nil {
+            break
+        }
+        fmt.Printf("The rule is not valid: %v.\n", err)
+        fmt.Print("Do you want to edit it again? (y/n): ")
+        response, _ := readLine()
+        if response != "y" {
+            fmt.Println("Operation cancelled.")
+            return
+        }
+    }
+
+    changes := diff.Lines(store.SettleDocument(original), store.SettleDocument(text))
+    changed := false
+    for _, line := range changes {
+        changed = changed || !strings.HasPrefix(line, "  ")
+    }
+    if !changed {
+        fmt.Printf("No changes made to rule '%s'.\n", name)
+        return
+    }
+    for _, line := range changes {
+        fmt.Println(line)
+    }
+    fmt.Print("Do you want to apply these changes? (y/n): ")
+    response, _ := readLine()
+    if response != "y" {
+        fmt.Println("Operation cancelled.")
+        return
+    }
+
+    if creating {
+        createRule(name, command, meta)
+    } else {
+        updateRule(name, command, meta)
+    }
+}
+
+// runEditor opens a file in $VISUAL, $EDITOR or vi. The variable may hold
+// options as well, as in "code --wait".
+func runEditor(path string) error {
+    editor := os.Getenv("VISUAL")
+    if editor == "" {
+        editor = os.Getenv("EDITOR")
+    }
+    if editor == "" {
+        editor = "vi"
+    }
+
+    cmd := exec.Command("sh", "-c", editor+` "$1"`, editor, path)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    return cmd.Run()
+}
+
+// showRule prints a rule and its metadata. With expand its command is also
+// shown with the references to other rules expanded.
+func showRule(name string, expand bool) {
+    rules, err := loadRules()
+    if err != nil {
+        fmt.Println("Failed to read the configuration file:", err)
+        return
+    }
+
+    rule := rules.Find(name)
+    if rule == nil {
+        fmt.Printf("Rule '%s' does not exist.\n", name)
+        return
+    }
+
+    printCommand(rule.Name+" =", rule.Command)
+    if expand {
+        expanded, err := rules.Expand(name)
+        if err != nil {
+            fmt.Printf("Unable to expand the rule: %v\n", err)
+        } else {
+            printCommand("Expanded:", expanded.Command)
+        }
+    }
+    if rule.Description != "" {
+        fmt.Printf("Description: %s\n", rule.Description)
+    }
+    if len(rule.Tags) > 0 {
+        fmt.Printf("Tags: %s\n", strings.Join(rule.Tags, ", "))
+    }
+    if rule.Shell != "" {
+        fmt.Printf("Shell: %s\n", rule.Shell)
+    }
+    if len(rule.Needs) > 0 {
+        fmt.Println("Needs:")
+        printNeeds(rules, rule.Needs, "  ", map[string]bool{rule.Name: true})
+    }
+    if declared := bottles.Parse(rule.Command); len(declared) > 0 {
+        fmt.Println("Bottles:")
+        for _, bottle := range declared {
+            var details []string
+            if bottle.Secret {
+                details = append(details, "secret")
+            }
+            if bottle.HasDefault {
+                details = append(details, fmt.Sprintf("default '%s'", bottle.Default))
+            }
+            if spec := rule.Bottles[bottle.Name].String(); spec != "" {
+                details = append(details, spec)
+            }
+            if len(details) > 0 {
+                fmt.Printf("  %s: %s\n", bottle.Name, strings.Join(details, "; "))
+            } else {
+                fmt.Printf("  %s\n", bottle.Name)
+            }
+        }
+    }
+    if !rule.Created.IsZero() {
+        fmt.Printf("Created: %s\n", rule.Created.Format("2006-01-02 15:04:05"))
+    }
+    if !rule.Updated.IsZero() {
+        fmt.Printf("Updated: %s\n", rule.Updated.Format("2006-01-02 15:04:05"))
+    }
+}
+
+// printCommand prints a label followed by a command. Multi-line commands
+// start on the next line, each line indented and otherwise untouched.
+func printCommand(label, command string) {
+    if !strings.Contains(command, "\n") {
+        fmt.Printf("%s %s\n", label, command)
+        return
+    }
+    fmt.Println(label)
+    for _, line := range strings.Split(command, "\n") {
+        fmt.Printf("    %s\n", line)
+    }
+}
+
+// printNeeds shows the rules needed by a rule as a tree, each level indented
+// further. seen holds the rules on the way down, to stop at cycles.
+func printNeeds(rules *store.Store, needs []string, indent string, seen map[string]bool) {
+    for _, name := range needs {
+        rule := rules.Find(name)
+        switch {
+        case rule == nil:
+            fmt.Printf("%s%s (missing)\n", indent, name)
+        case seen[name]:
+            fmt.Printf("%s%s (cycle)\n", indent, name)
+        default:
+            fmt.Printf("%s%s\n", indent, name)
+            seen[name] = true
+            printNeeds(rules, rule.Needs, indent+"  ", seen)
+            delete(seen, name)
+        }
+    }
+}
+
+// runCommands runs the given rules, and the rules they need, and returns the
+// exit status of the first one that failed. ruleArgs are forwarded to the
+// given rules, the rules they need run without them. Each bottle is resolved
+// once, its value being reused by every rule. Nothing runs if a value given
+// with -b=, the profile, the bottles file or the environment is refused by
+// one of the rules. A rule starts once the rules it needs passed and is
+// skipped if one of them did not. With opts.failFast the rules after a
+// failure are skipped, and nothing runs if one of them does not exist. Runs
+// of several rules end with a summary.
+func runCommands(commands []string, resolver *bottles.Resolver, ruleArgs []string, opts runOptions) int {
+    run, ok := newRun(commands, resolver, ruleArgs, opts)
+    if !ok {
+        return 1
+    }
+    err := run.Check()
     if err != nil {
-        fmt.Printf("Error creating directory %s: %v\n", binDir, err)
-        return
+        fmt.Printf("Error: %s\n", err)
+        return 1
+    }
+    // A matrix never runs without one of its rules
+    if len(run.Missing) > 0 && (opts.failFast || len(opts.matrix) > 0) {
+        return 1
     }
 
-    // Escape quotes in the command
-    escapedCommand := strings.Replace(command, `"`, `\"`, -1)
-
-    // Create or update the script file using the escaped command
-    scriptPath := filepath.Join(binDir, name)
-    scriptContent := createScriptContent(name, escapedCommand)
-
-    err = os.WriteFile(scriptPath, []byte(scriptContent), 0755)
+    outcomes, err := run.Execute()
     if err != nil {
-        fmt.Printf("Error updating script: %v\n", err)
-        return
+        fmt.Printf("Error: %s\n", err)
+        return 1
     }
+    if len(outcomes) > 1 || len(opts.matrix) > 0 {
+        printSummary(outcomes)
+    }
+    return executor.ExitCode(executor.FirstFailure(outcomes))
+}
 
-    // Log the event
-    err = logEvent("UPDATE_RULE", fmt.Sprintf("Name: %s, New Command: %s", name, command))
+// newRun plans the rules given on the command line, reporting the unknown
+// ones, and returns the run of their commands
+func newRun(commands []string, resolver *bottles.Resolver, ruleArgs []string, opts runOptions) (*executor.Run, bool) {
+    rules, err := loadRules()
     if err != nil {
-        fmt.Printf("Warning: Failed to log event: %v\n", err)
+        fmt.Printf("Error: failed to read the configuration file: %v\n", err)
+        return nil, false
     }
-
-    fmt.Printf("Rule '%s' successfully updated.\n", name)
+    plan, missing, err := executor.Plan(rules, commands)
+    for _, name := range missing {
+        fmt.Printf("Error: rule '%s' not found\n", name)
+    }
+    if err != nil {
+        fmt.Printf("Error: %s\n", err)
+        return nil, false
+    }
+
+    return &executor.Run{
+        Rules:    plan,
+        Missing:  missing,
+        Args:     ruleArgs,
+        Targets:  commands,
+        Resolver: resolver,
+        Matrix:   opts.matrix,
+        Jobs:     opts.jobs,
+        FailFast: opts.failFast,
+        Prompt:   bottlePrompter,
+        Log: func(details string) error {
+            return logEvent("EXECUTE_RULE", details)
+        },
+        Runner: runner,
+    }, true
 }
 
-func showRule(name string) {
-    file, err := os.Open(configFile)
-    if err != nil {
-        fmt.Println("Failed to open the configuration file:", err)
-        return
+// printSummary shows how every rule or iteration of a run ended
+func printSummary(outcomes []executor.Outcome) {
+    width := 0
+    for _, outcome := range outcomes {
+        if len(outcome.Name) > width {
+            width = len(outcome.Name)
+        }
     }
-    defer file.Close()
 
-    scanner := bufio.NewScanner(file)
-    found := false
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.HasPrefix(line, name+" = ") {
-            fmt.Println(line)
-            found = true
-            break
+    counts := make(map[executor.Status]int)
+    fmt.Println("Summary:")
+    for _, outcome := range outcomes {
+        counts[outcome.Status]++
+        status := outcome.Status.String()
+        duration := "-"
+        if outcome.Status != executor.Skipped {
+            duration = fmt.Sprintf("%.2fs", outcome.Duration.Seconds())
         }
+        if outcome.Status == executor.Failed {
+            status += fmt.Sprintf(" (exit code %d)", executor.ExitCode(outcome.Err))
+        }
+        fmt.Printf("  %-*s  %-22s %s\n", width, outcome.Name, status, duration)
     }
+    fmt.Printf("%d passed, %d failed, %d skipped\n", counts[executor.Passed], counts[executor.Failed], counts[executor.Skipped])
+}
 
-    if !found {
-        fmt.Printf("Rule '%s' does not exist.\n", name)
+// explainCommands shows the commands runCommands would run and where each
+// bottle takes its value from. Nothing is run and nobody is asked, the
+// command attributes of bottles are the only thing executed.
+func explainCommands(commands []string, resolver *bottles.Resolver, ruleArgs []string, opts runOptions) int {
+    fmt.Println("Dry run, no rule is executed. Each bottle takes its value from the first of:")
+    fmt.Println("values for the rule alone (-b=<rule>.<bottle>), --matrix, -b=, the profile, the")
+    fmt.Println("bottles file, the environment, the command attribute and the prompt.")
+
+    run, ok := newRun(commands, resolver, ruleArgs, opts)
+    if !ok {
+        return 1
+    }
+    status := 0
+    if len(run.Missing) > 0 {
+        status = 1
+    }
+
+    iterations := run.Explain()
+    for n, iteration := range iterations {
+        if iteration.Label != "" {
+            fmt.Printf("Iteration %d of %d: %s\n", n+1, len(iterations), iteration.Label)
+        }
+        for i, explanation := range iteration.Rules {
+            if explanation.Err != nil {
+                fmt.Printf("Error: %s\n", explanation.Err)
+                status = 1
+                continue
+            }
+            fmt.Printf("Command %d (rule '%s'): %s\n", i+1, explanation.Rule, explanation.Command)
+            printResolutions(explanation)
+        }
     }
+    return status
 }
 
-func runCommands(commands []string, bottleValues map[string]string) {
-    for i, cmd := range commands {
-        rule, err := getCommand(cmd)
-        if err != nil {
-            fmt.Printf("Error: %s\n", err)
+// printResolutions shows where each bottle of an explained rule takes its
+// value from
+func printResolutions(explanation executor.Explanation) {
+    for _, resolution := range explanation.Resolutions {
+        bottle := resolution.Bottle
+        if resolution.Pending {
+            first, asked := explanation.AskedBefore[bottle.Name]
+            switch {
+            case asked:
+                fmt.Printf("  %s: the answer given for rule '%s'\n", bottle.Name, first)
+            case bottle.HasDefault && !bottle.Secret:
+                fmt.Printf("  %s: asked, Enter for '%s' (prompt)\n", bottle.Name, bottle.Default)
+            default:
+                fmt.Printf("  %s: asked (prompt)\n", bottle.Name)
+            }
             continue
         }
-        processedRule := processBottles(rule, bottleValues)
 
-        start := time.Now()
-        fmt.Printf("Executing command %d: %s\n", i+1, processedRule)
-        err = executeCommand(processedRule)
-        duration := time.Since(start)
+        from := string(resolution.Source)
+        switch {
+        case resolution.Source == bottles.FromFlag && resolution.Rule != "":
+            from = "-b=" + resolution.Rule + "." + bottle.Name
+        case resolution.Source == bottles.FromFlag:
+            from = "-b=" + bottle.Name
+        case resolution.Rule != "":
+            from += " " + resolution.Rule + "." + bottle.Name
+        }
+        value := resolution.Value.Value
+        if bottle.Secret {
+            value = bottles.Redacted
+        }
+        fmt.Printf("  %s: %s (%s)\n", bottle.Name, value, from)
+    }
+}
+
+// bottlePrompter asks the user for the bottles of a rule, naming the rule
+// and the default accepted with Enter. Secrets are typed without echo.
+func bottlePrompter(ruleName string) bottles.Prompter {
+    return func(bottle bottles.Bottle) (string, error) {
+        if bottle.Invalid != nil {
+            fmt.Printf("Invalid value: %v. Please try again.\n", bottle.Invalid)
+        } else {
+            for i, choice := range bottle.Spec.Choices {
+                fmt.Printf("  %d) %s\n", i+1, choice)
+            }
+        }
 
-        result := "Success"
-        if err != nil {
-            result = fmt.Sprintf("Error: %v", err)
-            fmt.Printf("Error executing command %d: %s\n", i+1, err)
+        question := fmt.Sprintf("The %s is?", bottle.Name)
+        if bottle.Spec.Prompt != "" {
+            question = bottle.Spec.Prompt
+        }
+        switch {
+        case bottle.HasDefault && bottle.Secret:
+            fmt.Printf("%s (rule '%s', Enter for the default): ", question, ruleName)
+        case bottle.HasDefault:
+            fmt.Printf("%s (rule '%s', Enter for '%s'): ", question, ruleName, bottle.Default)
+        default:
+            fmt.Printf("%s (rule '%s'): ", question, ruleName)
         }
 
-        logDetails := fmt.Sprintf("Command: \"%s\", Result: %s, Duration: %v", processedRule, result, duration)
-        err = logEvent("EXECUTE_RULE", logDetails)
-        if err != nil {
-            fmt.Printf("Warning: Failed to log event: %v\n", err)
+        if bottle.Secret {
+            restore := term.DisableEcho(os.Stdin)
+            defer restore()
         }
+        value, err := readLine()
+        if err == io.EOF {
+            if bottle.HasDefault {
+                return "", nil
+            }
+            return "", fmt.Errorf("no value given for the bottle '%s'", bottle.Name)
+        }
+        return value, err
     }
 }
 
-func getCommand(name string) (string, error) {
-    file, err := os.Open(configFile)
-    if err != nil {
-        return "", fmt.Errorf("failed to open the configuration file: %v", err)
+// stdin is shared by every prompt reading whole lines, so that no prompt
+// loses what the previous one buffered
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads a line from the standard input without its line break. It
+// returns io.EOF only when the input ended before anything was typed.
+func readLine() (string, error) {
+    line, err := stdin.ReadString('\n')
+    if err != nil && (err != io.EOF || line == "") {
+        return "", err
     }
-    defer file.Close()
+    return strings.TrimRight(line, "\r\n"), nil
+}
 
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.HasPrefix(line, name+" = ") {
-            return strings.TrimSpace(strings.TrimPrefix(line, name+" = ")), nil
-        }
+// getRule returns a rule ready to run, its references to other rules
+// expanded
+func getRule(name string) (*store.Rule, error) {
+    rules, err := loadRules()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read the configuration file: %v", err)
     }
 
-    if err := scanner.Err(); err != nil {
-        return "", fmt.Errorf("error reading the configuration file: %v", err)
+    rule, err := rules.Expand(name)
+    if err == store.ErrNotFound {
+        return nil, fmt.Errorf("rule '%s' not found", name)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("rule '%s': %v", name, err)
     }
 
-    return "", fmt.Errorf("rule '%s' not found", name)
+    return rule, nil
 }
 
 func importRulesFromFile(filePath string) {
     start := time.Now()
 
-    // Open the file
-    file, err := os.Open(filePath)
+    // Read the whole file, a rule of many lines is a single long line
+    data, err := os.ReadFile(filePath)
     if err != nil {
         fmt.Println("Error opening file:", err)
         return
     }
-    defer file.Close()
+    rulesText := string(data)
 
-    // Read the file
-    scanner := bufio.NewScanner(file)
-    var rulesText string
-    for scanner.Scan() {
-        rulesText += scanner.Text() + "\n"
-    }
-    if err := scanner.Err(); err != nil {
+    // Extract rules from the text, with their metadata
+    imported, err := store.ParseExport(rulesText)
+    if err != nil {
         fmt.Println("Error reading file:", err)
         return
     }
 
-    // Extract rules from the text
-    rules := extractRules(rulesText)
-
     // Read existing rules from the configuration file
-    existingRules, err := readLines(configFile)
+    rules, err := loadRules()
     if err != nil {
         fmt.Println("Error reading existing rules:", err)
         return
     }
 
-    // Process each rule
-    for _, rule := range rules {
-        parts := strings.Split(rule, " = ")
-        if len(parts) != 2 {
-            fmt.Println("Error parsing rule:", rule)
-            continue
-        }
-        name := strings.TrimSpace(parts[0])
-        command := strings.TrimSpace(parts[1])
-
-        // Check if the rule already exists
-        exists := false
-        for i, existingRule := range existingRules {
-            if strings.HasPrefix(existingRule, name+" = ") {
-                exists = true
-                fmt.Printf("Rule '%s' already exists. Do you want to overwrite it? (y/n): ", name)
-                var response string
-                fmt.Scanln(&response)
-                if response == "y" {
-                    existingRules[i] = fmt.Sprintf("%s = %s", name, command)
-                    fmt.Printf("Rule '%s' updated.\n", name)
-                } else {
-                    fmt.Printf("Skipping rule '%s'.\n", name)
-                }
-                break
-            }
+    // Decide which rules to import before touching the configuration
+    var accepted []store.Rule
+    for i, candidate := range rules.ImportCandidates(imported, checkNewName) {
+        if confirmImport("Rule", candidate) {
+            accepted = append(accepted, imported[i])
         }
+    }
 
-        if !exists {
-            existingRules = append(existingRules, fmt.Sprintf("%s = %s", name, command))
-            fmt.Printf("Rule '%s' added.\n", name)
-        }
+    // Write all rules to the configuration file at once
+    err = updateRules(func(rules *store.Store) error {
+        rules.Import(accepted)
+        return nil
+    })
+    if err != nil {
+        fmt.Println("Error writing rules to config file:", err)
+        return
+    }
+
+    importProfiles(store.ParseProfileExport(rulesText), filePath)
 
-        // Create the script immediately
-        scriptPath := filepath.Join(filepath.Join(os.Getenv("HOME"), ".local/bin"), name)
-        scriptContent := fmt.Sprintf(`#!/bin/bash
-start=$(date +%%s)
-%s
-end=$(date +%%s)
-duration=$((end - start))
-echo "[$(date +'%%Y-%%m-%%d %%H:%%M:%%S')] EXECUTE_RULE %s at $(hostname -I | awk '{print $1}') | Rule: %s, Command: '%s', Result: Success, Duration: ${duration}s" >> %s
-`, command, os.Getenv("USER"), name, command, filepath.Join(os.Getenv("HOME"), logDir, logFileName))
+    for _, rule := range accepted {
+        fmt.Printf("Rule '%s' imported.\n", rule.Name)
+
+        // Rules may need or refer to rules that were not imported, or run
+        // with an interpreter missing on this machine
+        rules, err := loadRules()
+        if err == nil {
+            _, err = executor.Prepare(rules, rule.Name)
+        }
+        if err != nil {
+            fmt.Printf("Warning: Rule '%s' cannot run: %v.\n", rule.Name, err)
+        }
 
-        err = os.WriteFile(scriptPath, []byte(scriptContent), 0755)
+        // Create the script immediately, from the stored rule expanded as it
+        // runs
+        if stored, err := getRule(rule.Name); err == nil {
+            rule = *stored
+        }
+        err = scriptManager.Write(&rule)
         if err != nil {
-            fmt.Printf("Error creating script for rule %s: %v\n", name, err)
+            fmt.Printf("Error creating script for rule %s: %v\n", rule.Name, err)
         }
 
         // Log the import event
-        err = logEvent("IMPORT_RULE", fmt.Sprintf("From File: %s, Name: %s, Command: %s", filePath, name, command))
+        err = logEvent("IMPORT_RULE", fmt.Sprintf("From File: %s, Name: %s, Command: %s", filePath, rule.Name, rule.Command))
         if err != nil {
             fmt.Printf("Warning: Failed to log event: %v\n", err)
         }
     }
 
-    // Write all rules back to the configuration file
-    err = writeLinesWithLock(configFile, existingRules)
-    if err != nil {
-        fmt.Println("Error writing rules to config file:", err)
-        return
-    }
-
     // End timing
     duration := time.Since(start)
     fmt.Printf("Rules imported successfully in %.2f seconds.\n", duration.Seconds())
 }
 
-func createScriptForRule(name, command string) {
-    scriptPath := filepath.Join(os.Getenv("HOME"), ".local/bin", name)
-    scriptContent := fmt.Sprintf("#!/bin/bash\n%s\n", command)
+// importProfiles saves the profiles found in an export file, asking before
+// replacing an existing one
+func importProfiles(imported *store.Profiles, filePath string) {
+    if len(imported.Profiles) == 0 {
+        return
+    }
 
-    err := os.WriteFile(scriptPath, []byte(scriptContent), 0755)
+    existing, err := store.ReadProfiles(profilesFile)
     if err != nil {
-        fmt.Printf("Error creating script for rule %s: %v\n", name, err)
+        fmt.Println("Error reading existing profiles:", err)
+        return
     }
-}
 
-func extractRules(text string) []string {
-    var rules []string
-
-    re := regexp.MustCompile(`b:([^=]+) = (.*?):b`)
-    matches := re.FindAllStringSubmatch(text, -1)
-    for _, match := range matches {
-        ruleName := strings.TrimSpace(match[1])
-        ruleCommand := strings.TrimSpace(match[2])
+    var accepted []string
+    for _, candidate := range existing.ImportCandidates(imported) {
+        if confirmImport("Profile", candidate) {
+            accepted = append(accepted, candidate.Name)
+        }
+    }
+    if len(accepted) == 0 {
+        return
+    }
 
-        // Replace HTML entities with their actual characters
-        ruleCommand = html.UnescapeString(ruleCommand)
+    _, err = store.UpdateProfiles(profilesFile, func(profiles *store.Profiles) error {
+        profiles.Merge(imported, accepted)
+        return nil
+    })
+    if err != nil {
+        fmt.Println("Error writing the profiles:", err)
+        return
+    }
 
-        rule := fmt.Sprintf("%s = %s", ruleName, ruleCommand)
-        rules = append(rules, rule)
+    for _, name := range accepted {
+        fmt.Printf("Profile '%s' imported.\n", name)
+        err = logEvent("IMPORT_PROFILE", fmt.Sprintf("From File: %s, Name: %s", filePath, name))
+        if err != nil {
+            fmt.Printf("Warning: Failed to log event: %v\n", err)
+        }
     }
+}
 
-    return rules
+// confirmImport reports whether a rule or a profile of an export file is
+// imported, asking before it replaces one with the same name
+func confirmImport(kind string, candidate store.Candidate) bool {
+    if candidate.Err != nil {
+        fmt.Printf("Skipping %s '%s': %v.\n", strings.ToLower(kind), candidate.Name, candidate.Err)
+        return false
+    }
+    if !candidate.Replaces {
+        return true
+    }
+    fmt.Printf("%s '%s' already exists. Do you want to overwrite it? (y/n): ", kind, candidate.Name)
+    var response string
+    fmt.Scanln(&response)
+    if response != "y" {
+        fmt.Printf("Skipping %s '%s'.\n", strings.ToLower(kind), candidate.Name)
+        return false
+    }
+    return true
 }
 
 func exportRules() {
@@ -701,18 +1628,21 @@ func exportRules() {
     comment := scanner.Text()
 
     // Prepare export content
-    var exportContent []string
-    if comment != "" {
-        exportContent = append(exportContent, fmt.Sprintf("#%s", comment))
+    rules, err := loadRules()
+    if err != nil {
+        fmt.Println("Error reading the configuration file:", err)
+        return
+    }
+    profiles, err := store.ReadProfiles(profilesFile)
+    if err != nil {
+        fmt.Printf("Error reading the profiles: %v\n", err)
     }
 
-    for _, rule := range exportRules {
-        command, err := getCommand(rule)
-        if err != nil {
-            fmt.Printf("Error getting command for rule '%s': %v\n", rule, err)
-            continue
-        }
-        exportContent = append(exportContent, fmt.Sprintf("b:%s = %s:b", rule, command))
+    // Profiles travel with the rules that use them, and may hold secrets
+    exportContent, values := store.Export(rules, exportRules, profiles, comment)
+    perm := os.FileMode(0644)
+    if values {
+        perm = 0600
     }
 
     for {
@@ -734,7 +1664,7 @@ func exportRules() {
 
         // Write to file
         exportFilePath := fmt.Sprintf("%s/abbtr-rules.txt", exportPath)
-        err = writeToFile(exportFilePath, exportContent)
+        err = writeToFile(exportFilePath, exportContent, perm)
         if err != nil {
             fmt.Println("Error writing rules to file:", err)
             return
@@ -753,196 +1683,235 @@ func exportRules() {
     }
 }
 
-func ruleExists(name string) bool {
-    file, err := os.Open(configFile)
-    if err != nil {
-        return false
+// manageProfiles runs the save, list and delete actions of --profile
+func manageProfiles(args []string, bottleValues map[string]string) {
+    usage := "Error: Incorrect usage of --profile. It should be: abbtr --profile save <profile> -b=<variable:value>..., abbtr --profile list or abbtr --profile delete <profile>"
+    if len(args) == 0 {
+        fmt.Println(usage)
+        return
     }
-    defer file.Close()
 
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.HasPrefix(line, name+" = ") {
-            return true
-        }
+    switch {
+    case args[0] == "save" && len(args) == 2:
+        saveProfile(args[1], bottleValues)
+    case args[0] == "list" && len(args) == 1:
+        listProfiles()
+    case args[0] == "delete" && len(args) == 2:
+        deleteProfile(args[1])
+    default:
+        fmt.Println(usage)
     }
-
-    return false
 }
 
-func getAllRules() []string {
-    var rules []string
-
-    file, err := os.Open(configFile)
+func saveProfile(name string, bottleValues map[string]string) {
+    err := store.ValidateProfileName(name)
     if err != nil {
-        fmt.Println("Failed to open the configuration file:", err)
-        return rules
+        fmt.Printf("Error: %v.\n", err)
+        return
+    }
+    if len(bottleValues) == 0 {
+        fmt.Println("Error: give the values of the profile with -b=<variable:value>")
+        return
     }
-    defer file.Close()
 
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        parts := strings.SplitN(line, "=", 2)
-        if len(parts) == 2 {
-            rules = append(rules, strings.TrimSpace(parts[0]))
-        }
+    _, err = store.UpdateProfiles(profilesFile, func(profiles *store.Profiles) error {
+        profiles.Profiles[name] = bottleValues
+        return nil
+    })
+    if err != nil {
+        fmt.Println("Error writing the profiles:", err)
+        return
     }
 
-    if err := scanner.Err(); err != nil {
-        fmt.Println("Error reading the configuration file:", err)
+    // The values may be secrets, only the bottle names are logged
+    err = logEvent("SAVE_PROFILE", fmt.Sprintf("Name: %s, Bottles: %s", name, strings.Join(sortedKeys(bottleValues), ", ")))
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
 
-    return rules
+    fmt.Printf("Profile '%s' successfully saved.\n", name)
 }
 
-func writeToFile(filePath string, content []string) error {
-    file, err := os.Create(filePath)
+func listProfiles() {
+    profiles, err := store.ReadProfiles(profilesFile)
     if err != nil {
-        return fmt.Errorf("failed to create file: %v", err)
+        fmt.Println("Failed to read the profiles:", err)
+        return
+    }
+    if len(profiles.Profiles) == 0 {
+        fmt.Println("No profiles have been saved yet.")
+        return
     }
-    defer file.Close()
 
-    writer := bufio.NewWriter(file)
-    for _, line := range content {
-        _, err := fmt.Fprintln(writer, line)
-        if err != nil {
-            return fmt.Errorf("failed to write to file: %v", err)
+    // Bottles that any rule declares secret are not shown
+    var secrets map[string]bool
+    if rules, err := loadRules(); err == nil {
+        var all []*store.Rule
+        for i := range rules.Rules {
+            all = append(all, &rules.Rules[i])
         }
+        secrets = store.SecretBottles(all)
     }
-    if err := writer.Flush(); err != nil {
-        return fmt.Errorf("failed to flush writer: %v", err)
+
+    fmt.Println("Profiles:")
+    for _, name := range profiles.Names() {
+        fmt.Printf("Profile: %s\n", name)
+        values := profiles.Profiles[name]
+        for _, bottle := range sortedKeys(values) {
+            value := values[bottle]
+            if secrets[bottle] {
+                value = bottles.Redacted
+            }
+            fmt.Printf("  %s: %s\n", bottle, value)
+        }
+        fmt.Println()
     }
+}
 
-    return nil
+func deleteProfile(name string) {
+    _, err := store.UpdateProfiles(profilesFile, func(profiles *store.Profiles) error {
+        if _, ok := profiles.Profiles[name]; !ok {
+            return store.ErrNotFound
+        }
+        delete(profiles.Profiles, name)
+        return nil
+    })
+    if err == store.ErrNotFound {
+        fmt.Printf("Profile '%s' not found.\n", name)
+        return
+    }
+    if err != nil {
+        fmt.Println("Error writing the profiles:", err)
+        return
+    }
+
+    err = logEvent("DELETE_PROFILE", fmt.Sprintf("Name: %s", name))
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+
+    fmt.Printf("Profile '%s' successfully deleted.\n", name)
 }
 
-func executeCommand(command string) error {
-    // Record the start time of the command execution
-    start := time.Now()
+func sortedKeys(values map[string]string) []string {
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
 
-    // Prepare the command for execution
-    cmd := exec.Command("bash", "-c", command)
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    cmd.Stdin = os.Stdin
+func ruleExists(name string) bool {
+    rules, err := loadRules()
+    if err != nil {
+        return false
+    }
 
-    // Run the command
-    err := cmd.Run()
+    return rules.Find(name) != nil
+}
 
-    // Calculate the duration of the command execution
-    duration := time.Since(start)
-    result := "Success"
+func getAllRules() []string {
+    rules, err := loadRules()
     if err != nil {
-        result = fmt.Sprintf("Error: %v", err)
+        fmt.Println("Failed to read the configuration file:", err)
+        return nil
     }
 
-    // Format the log details
-    logDetails := fmt.Sprintf("Command: %q, Result: %s, Duration: %v", command, result, duration)
+    return rules.Names()
+}
+
+func writeToFile(filePath string, content []string, perm os.FileMode) error {
+    var buf strings.Builder
+    for _, line := range content {
+        buf.WriteString(line)
+        buf.WriteString("\n")
+    }
 
-    // Log the execution event
-    logErr := logEvent("EXECUTE_RULE", logDetails)
-    if logErr != nil {
-        fmt.Printf("Warning: Failed to log event: %v\n", logErr)
+    err := fsutil.WriteFileAtomic(filePath, []byte(buf.String()), perm)
+    if err != nil {
+        return fmt.Errorf("failed to write to file: %v", err)
     }
 
-    // Handle any errors that occurred during command execution
+    // An earlier export may have left a file readable by others, and this
+    // one may hold secrets
+    err = os.Chmod(filePath, perm)
     if err != nil {
-        if exitError, ok := err.(*exec.ExitError); ok {
-            return fmt.Errorf("command failed with exit code %d: %v", exitError.ExitCode(), err)
-        }
-        return fmt.Errorf("failed to execute command: %v", err)
+        return fmt.Errorf("failed to write to file: %v", err)
     }
 
-    // Return nil if the command was executed successfully
     return nil
 }
 
-func processBottles(command string, bottleValues map[string]string) string {
-    re := regexp.MustCompile(`b%\('([^']+)'\)%b`)
-    return re.ReplaceAllStringFunc(command, func(match string) string {
-        bottleName := re.FindStringSubmatch(match)[1]
-        if value, ok := bottleValues[bottleName]; ok {
-            return value
-        }
-        fmt.Printf("The %s is?: ", bottleName)
-        var value string
-        fmt.Scanln(&value)
-        return value
-    })
+func parseBottleAttr(arg string) (store.BottleSetting, error) {
+    setting, ok := store.ParseBottleSetting(arg)
+    if !ok {
+        return setting, fmt.Errorf("incorrect usage of --bottle. It should be: --bottle=<bottle>:<type|choices|pattern|prompt>=<value>")
+    }
+    return setting, nil
 }
 
-func readLines(filename string) ([]string, error) {
-    file, err := os.Open(filename)
+// loadedStore caches the rules for the rest of the invocation, so running
+// many rules or looking up names never reads abbtr.conf again
+var loadedStore *store.Store
+
+func loadRules() (*store.Store, error) {
+    if loadedStore != nil {
+        return loadedStore, nil
+    }
+
+    rules, migration, err := store.Load(configFile)
     if err != nil {
         return nil, err
     }
-    defer file.Close()
-
-    var lines []string
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        lines = append(lines, scanner.Text())
+    warnDuplicates(rules.Duplicates)
+    if migration != nil {
+        reportMigration(migration, rules)
     }
-    return lines, scanner.Err()
+
+    loadedStore = rules
+    return rules, nil
 }
 
-func writeLines(filename string, lines []string) error {
-    file, err := os.Create(filename)
+// updateRules applies a change to abbtr.conf through store.Update, which
+// holds the lock shared by every abbtr process
+func updateRules(change func(*store.Store) error) error {
+    rules, migration, err := store.Update(configFile, change)
     if err != nil {
+        // Whatever is in memory may no longer match the file
+        loadedStore = nil
         return err
     }
-    defer file.Close()
-
-    writer := bufio.NewWriter(file)
-    for _, line := range lines {
-        // Write the line after unquoting it to interpret escaped characters
-        unquotedLine, err := strconv.Unquote(`"` + line + `"`)
-        if err != nil {
-            fmt.Println("Error unquoting line:", line, "Error:", err)
-            return err
-        }
-        _, err = fmt.Fprintln(writer, unquotedLine)
-        if err != nil {
-            return err
-        }
+    warnDuplicates(rules.Duplicates)
+    if migration != nil {
+        reportMigration(migration, rules)
     }
-    return writer.Flush()
-}
 
-func logEvent(eventType, details string) error {
-    logPath := filepath.Join(os.Getenv("HOME"), logDir, logFileName)
+    loadedStore = rules
+    return nil
+}
 
-    // Create the log directory if it does not exist
-    err := os.MkdirAll(filepath.Dir(logPath), 0755)
-    if err != nil {
-        return fmt.Errorf("failed to create log directory: %v", err)
+func warnDuplicates(duplicates []string) {
+    if len(duplicates) > 0 {
+        fmt.Printf("Warning: abbtr.conf defines these rules more than once, only the first definition is kept: %s\n", strings.Join(duplicates, ", "))
     }
+}
 
-    // Open the log file in append mode, create it if it doesn't exist
-    file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        return fmt.Errorf("failed to open log file: %v", err)
+func reportMigration(m *store.Migration, rules *store.Store) {
+    details := fmt.Sprintf("From version: %d, To version: %d", m.From, m.To)
+    if m.Legacy != nil {
+        fmt.Printf("abbtr.conf has been migrated to the new format. A copy of the old file was saved to %s\n", m.BackupPath)
+        details += fmt.Sprintf(", Rules: %d, Backup: %s", len(rules.Rules), m.BackupPath)
     }
-    defer file.Close()
-
-    // Gather necessary information for the log
-    user := os.Getenv("USER")
-    timestamp := time.Now().Format("2006-01-02 15:04:05")
-    ip := getIP()
 
-    // Create the log message
-    logMessage := fmt.Sprintf("[%s] %s %s at %s | %s\n",
-        timestamp, eventType, user, ip, details)
-
-    // Write the log message to the file
-    _, err = file.WriteString(logMessage)
+    err := logEvent("MIGRATE_CONFIG", details)
     if err != nil {
-        return fmt.Errorf("failed to write to log file: %v", err)
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
+}
 
-    return nil
+func logEvent(eventType, details string) error {
+    return logger.Log(eventType, details)
 }
 
 func initConfigFile() error {
@@ -975,20 +1944,6 @@ func initConfigFile() error {
     return nil
 }
 
-func getIP() string {
-    addrs, err := net.InterfaceAddrs()
-    if err == nil {
-        for _, addr := range addrs {
-            if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-                if ipnet.IP.To4() != nil {
-                    return ipnet.IP.String()
-                }
-            }
-        }
-    }
-    return "Unknown IP"
-}
-
 func isReservedName(name string) bool {
     for _, reserved := range reservedNames {
         if name == reserved {
@@ -998,92 +1953,58 @@ func isReservedName(name string) bool {
     return false
 }
 
-func writeLinesWithLock(filename string, lines []string) error {
-    file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-    if err != nil {
-        return err
+// syncRulesWithScripts brings ~/.local/bin in line with abbtr.conf. Unless
+// forced nothing is read when abbtr.conf did not change since the last run.
+func syncRulesWithScripts(force bool) (*scripts.Report, error) {
+    storeHash, err := fsutil.HashFile(configFile)
+    if err != nil && !os.IsNotExist(err) {
+        return &scripts.Report{}, err
     }
-    defer file.Close()
 
-    writer := bufio.NewWriter(file)
-    for _, line := range lines {
-        _, err = fmt.Fprintln(writer, line)
+    report, err := scriptManager.Sync(storeHash, force, func() ([]store.Rule, error) {
+        rules, err := loadRules()
         if err != nil {
-            return err
+            return nil, err
         }
+        return rules.ExpandAll(), nil
+    })
+    for _, scriptErr := range report.Errors {
+        fmt.Printf("Error: %v\n", scriptErr)
     }
-    return writer.Flush()
-}
-
-func syncRulesWithScripts() error {
-    // Retrieve all the existing rules
-    rules := getAllRules()
-    rulesDir := filepath.Join(os.Getenv("HOME"), ".local", "bin")
-
-    // Create the directory if it doesn't exist
-    err := os.MkdirAll(rulesDir, 0755)
-    if err != nil {
-        return fmt.Errorf("failed to create rules directory: %v", err)
-    }
-
-    // Remove scripts that don't have corresponding rules
-    files, err := os.ReadDir(rulesDir)
     if err != nil {
-        return fmt.Errorf("failed to read rules directory: %v", err)
+        return report, err
     }
 
-    // Loop through each file in the rules directory
-    for _, file := range files {
-        if !file.IsDir() {
-            found := false
-            for _, rule := range rules {
-                if rule == file.Name() {
-                    found = true
-                    break
-                }
-            }
-            // Remove orphaned scripts
-            if !found {
-                scriptPath := filepath.Join(rulesDir, file.Name())
-                err := os.Remove(scriptPath)
-                if err != nil {
-                    fmt.Printf("Error deleting orphaned script %s: %v\n", file.Name(), err)
-                }
-            }
+    if report.Adopted > 0 {
+        err = logEvent("ADOPT_SCRIPTS", fmt.Sprintf("Scripts: %d", report.Adopted))
+        if err != nil {
+            fmt.Printf("Warning: Failed to log event: %v\n", err)
         }
     }
-
-    // Create or update scripts for existing rules
-    for _, rule := range rules {
-        // Get the command associated with the rule
-        command, err := getCommand(rule)
+    if !report.Empty() {
+        err = logEvent("SYNC_SCRIPTS", report.String())
         if err != nil {
-            fmt.Printf("Error getting command for rule %s: %v\n", rule, err)
-            continue
+            fmt.Printf("Warning: Failed to log event: %v\n", err)
         }
+    }
 
-        // Escape quotes in the command
-        escapedCommand := strings.Replace(command, `"`, `\"`, -1)
-
-        // Create the script content using the escaped command
-        scriptContent := createScriptContent(rule, escapedCommand)
-
-        // Define the script path
-        scriptPath := filepath.Join(rulesDir, rule)
+    return report, nil
+}
 
-        // Write the script content to the script file
-        err = os.WriteFile(scriptPath, []byte(scriptContent), 0755)
-        if err != nil {
-            fmt.Printf("Error creating/updating script for rule %s: %v\n", rule, err)
-        }
+// removeScript deletes the script of a rule. A file with the same name that
+// abbtr did not create is reported and kept.
+func removeScript(name string) error {
+    err := scriptManager.Remove(name)
+    if foreign, ok := err.(*scripts.ForeignError); ok {
+        fmt.Printf("Skipped %s: it was not created by abbtr.\n", foreign.Path)
+        return nil
     }
-
-    return nil
+    return err
 }
 
 func checkPath() {
     path := os.Getenv("PATH")
-    localBin := filepath.Join(os.Getenv("HOME"), ".local", "bin")
+    localBin := scriptManager.Dir
 
     // Split the PATH into individual directories
     pathDirs := strings.Split(path, ":")
@@ -1101,10 +2022,22 @@ func checkPath() {
         return // ~/.local/bin is already in the PATH
     }
 
-    reader := bufio.NewReader(os.Stdin)
+    // Only someone at a terminal can answer. Piped input belongs to the
+    // rules, as with abbtr -n <name> -, and must not end up in ~/.bashrc.
+    if !term.IsTerminal(os.Stdin) {
+        fmt.Fprintln(os.Stderr, "Warning: ~/.local/bin is not in your PATH, your rules can only be run through abbtr.")
+        return
+    }
+
     for {
         fmt.Printf("~/.local/bin is not in your PATH. Do you want to add it? This is necessary to locally run your rules (y/n): ")
-        response, _ := reader.ReadString('\n')
+        response, err := readLine()
+        if err != nil {
+            // Nobody to answer, as under cron or in a pipeline
+            fmt.Println()
+            fmt.Println("~/.local/bin was not added to your PATH.")
+            return
+        }
         response = strings.TrimSpace(strings.ToLower(response))
 
         if response == "y" {
@@ -1151,13 +2084,3 @@ func checkPath() {
         }
     }
 }
-
-func createScriptContent(name, command string) string {
-    return fmt.Sprintf(`#!/bin/bash
-start=$(date +%%s)
-%s
-end=$(date +%%s)
-duration=$((end - start))
-echo "[$(date +'%%Y-%%m-%%d %%H:%%M:%%S')] EXECUTE_RULE %s at $(hostname -I | awk '{print $1}') | Rule: %s, Command: '%s', Result: Success, Duration: ${duration}s" >> %s
-`, command, os.Getenv("USER"), name, command, filepath.Join(os.Getenv("HOME"), logDir, logFileName))
-}
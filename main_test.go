@@ -0,0 +1,1105 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// TestMain lets the tests run the test binary as the abbtr command
+func TestMain(m *testing.M) {
+    if os.Getenv("ABBTR_TEST_MAIN") != "" {
+        os.Args = append([]string{"abbtr"}, os.Args[1:]...)
+        main()
+        os.Exit(0)
+    }
+    os.Exit(m.Run())
+}
+
+// cli runs abbtr with a temporary HOME whose ~/.local/bin is in the PATH.
+// The PATH also has an abbtr command, which the scripts of rules with
+// bottles call.
+type cli struct {
+    t    *testing.T
+    home string
+    bin  string
+}
+
+func newCLI(t *testing.T) *cli {
+    home := t.TempDir()
+    err := os.MkdirAll(filepath.Join(home, ".local", "bin"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    bin := t.TempDir()
+    wrapper := "#!/bin/sh\nABBTR_TEST_MAIN=1 exec '" + os.Args[0] + "' \"$@\"\n"
+    err = os.WriteFile(filepath.Join(bin, "abbtr"), []byte(wrapper), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &cli{t: t, home: home, bin: bin}
+}
+
+func (c *cli) command(name string, args ...string) *exec.Cmd {
+    cmd := exec.Command(name, args...)
+    cmd.Env = append(os.Environ(),
+        "HOME="+c.home,
+        "PATH="+filepath.Join(c.home, ".local", "bin")+":"+c.bin+":"+os.Getenv("PATH"),
+    )
+    return cmd
+}
+
+// run runs abbtr and returns its output and exit status
+func (c *cli) run(stdin string, args ...string) (string, int) {
+    c.t.Helper()
+    cmd := c.command(os.Args[0], args...)
+    cmd.Env = append(cmd.Env, "ABBTR_TEST_MAIN=1")
+    cmd.Stdin = strings.NewReader(stdin)
+    out, err := cmd.CombinedOutput()
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        return string(out), exitErr.ExitCode()
+    }
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    return string(out), 0
+}
+
+func TestCLI(t *testing.T) {
+    c := newCLI(t)
+
+    out, _ := c.run("", "-n", "greet", "echo hello", "--desc=Say hello")
+    if !strings.Contains(out, "Rule 'greet' successfully added") {
+        t.Fatalf("create failed:\n%s", out)
+    }
+
+    out, _ = c.run("", "-l")
+    if !strings.Contains(out, "Rule Name: greet") || !strings.Contains(out, "Description: Say hello") {
+        t.Errorf("rule not listed:\n%s", out)
+    }
+
+    // Settings end where an unquoted command of several words starts
+    c.run("", "-n", "gl", "--desc=Releases", "git", "log", "--oneline", "--tags=v1*", "--shell=zsh")
+    out, _ = c.run("", "-ln", "gl")
+    if !strings.Contains(out, "git log --oneline --tags=v1* --shell=zsh") || !strings.Contains(out, "Description: Releases") || strings.Contains(out, "Tags:") {
+        t.Errorf("options were taken from the command:\n%s", out)
+    }
+
+    // The generated script runs the rule without abbtr
+    script := c.command(filepath.Join(c.home, ".local", "bin", "greet"), "world")
+    scriptOut, err := script.Output()
+    if err != nil || string(scriptOut) != "hello world\n" {
+        t.Errorf("script printed %q: %v", scriptOut, err)
+    }
+
+    out, status := c.run("", "greet", "--", "there")
+    if !strings.Contains(out, "hello there") || status != 0 {
+        t.Errorf("run failed with %d:\n%s", status, out)
+    }
+
+    // Scripts and abbtr place the arguments alike, whatever ends the command
+    c.run("", "-n", "tb", `echo trailing \`)
+    c.run("", "-n", "cm", "echo visible # a note")
+    for _, tc := range []struct {
+        name string
+        args []string
+        want string
+    }{
+        {"tb", nil, "trailing \\\n"},
+        {"tb", []string{"x"}, "trailing \\ x\n"},
+        {"cm", nil, "visible\n"},
+        {"cm", []string{"x"}, "visible x\n"},
+    } {
+        script, err := c.command(filepath.Join(c.home, ".local", "bin", tc.name), tc.args...).Output()
+        if err != nil || string(script) != tc.want {
+            t.Errorf("%s %v: the script printed %q: %v", tc.name, tc.args, script, err)
+        }
+        out, _ := c.run("", append([]string{tc.name, "--"}, tc.args...)...)
+        if !strings.HasSuffix(out, "\n"+tc.want) {
+            t.Errorf("%s %v: abbtr printed:\n%s", tc.name, tc.args, out)
+        }
+    }
+
+    // Bottles are filled from -b=, the environment or the prompt
+    c.run("", "-n", "fail", "echo b%('who')%b; exit 4")
+    out, status = c.run("", "--exec", "-b=who:given", "fail")
+    if !strings.Contains(out, "given") || status != 4 {
+        t.Errorf("--exec exited with %d:\n%s", status, out)
+    }
+    out, _ = c.run("typed\n", "fail")
+    if !strings.Contains(out, "The who is? (rule 'fail'): ") || !strings.Contains(out, "typed") {
+        t.Errorf("bottle was not prompted for:\n%s", out)
+    }
+
+    // A bottle shared by several rules is asked for once, defaults take Enter
+    c.run("", "-n", "twice", "echo b%('who')%b b%('who')%b as b%('as'|'root')%b")
+    out, _ = c.run("first\n\n", "twice", "fail")
+    if strings.Count(out, "The who is?") != 1 || !strings.Contains(out, "first first as root") {
+        t.Errorf("bottles were not asked for once:\n%s", out)
+    }
+    if !strings.Contains(out, "The as is? (rule 'twice', Enter for 'root'): ") {
+        t.Errorf("the default was not shown:\n%s", out)
+    }
+
+    // Secrets are read as whole lines and never shown or logged
+    c.run("", "-n", "login", "echo user=b%('user')%b pass=b%('!password')%b")
+    out, _ = c.run("Ada Lovelace\nsesame open\n", "login")
+    if !strings.Contains(out, "user=Ada Lovelace pass=sesame open") {
+        t.Errorf("bottles were not read as whole lines:\n%s", out)
+    }
+    if !strings.Contains(out, "Executing command 1: echo user=Ada Lovelace pass=***") {
+        t.Errorf("the secret was not redacted:\n%s", out)
+    }
+
+    out, _ = c.run("", "-r", "greet")
+    if !strings.Contains(out, "Rule 'greet' successfully deleted") {
+        t.Errorf("delete failed:\n%s", out)
+    }
+    if _, err := os.Stat(filepath.Join(c.home, ".local", "bin", "greet")); !os.IsNotExist(err) {
+        t.Errorf("script was not removed: %v", err)
+    }
+
+    log, err := os.ReadFile(filepath.Join(c.home, ".local", "share", "abbtr", "abbtr.log"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, event := range []string{"CREATE_RULE", "EXECUTE_RULE", "DELETE_RULE"} {
+        if !strings.Contains(string(log), event) {
+            t.Errorf("%s was not logged", event)
+        }
+    }
+    if strings.Contains(string(log), "sesame") || !strings.Contains(string(log), `pass=***"`) {
+        t.Errorf("the secret was not redacted in the log:\n%s", log)
+    }
+}
+
+func TestCLIBottleSpecs(t *testing.T) {
+    c := newCLI(t)
+
+    out, _ := c.run("", "-n", "deploy", "echo deploying to b%('env')%b on port b%('port'|'22')%b",
+        "--bottle=env:choices=dev,staging,prod", "--bottle=port:type=port", "--bottle=env:prompt=Target environment?")
+    if !strings.Contains(out, "successfully added") {
+        t.Fatalf("create failed:\n%s", out)
+    }
+
+    out, _ = c.run("", "-c", "deploy", "echo b%('env')%b", "--bottle=host:type=hostname")
+    if !strings.Contains(out, "no bottle named 'host'") {
+        t.Errorf("a spec for a missing bottle was accepted:\n%s", out)
+    }
+    out, _ = c.run("", "-c", "deploy", "echo b%('env')%b", "--bottle=env:type=colour")
+    if !strings.Contains(out, "unknown bottle type") {
+        t.Errorf("an unknown type was accepted:\n%s", out)
+    }
+
+    out, _ = c.run("", "-ln", "deploy")
+    if !strings.Contains(out, "  env: choices dev, staging, prod; prompt \"Target environment?\"") ||
+        !strings.Contains(out, "  port: default '22'; type port") {
+        t.Errorf("bottles not shown:\n%s", out)
+    }
+
+    // Invalid answers are asked again, menu numbers select a choice
+    out, _ = c.run("qa\n3\nssh\n\n", "deploy")
+    if !strings.Contains(out, "  3) prod") || !strings.Contains(out, "Target environment? (rule 'deploy'): ") {
+        t.Errorf("the menu was not shown:\n%s", out)
+    }
+    if strings.Count(out, "Invalid value") != 2 || !strings.Contains(out, "deploying to prod on port 22") {
+        t.Errorf("invalid answers were not asked again:\n%s", out)
+    }
+
+    // Invalid -b= values stop everything before the first rule runs
+    c.run("", "-n", "first", "echo first ran")
+    out, status := c.run("", "first", "deploy", "-b=port:http")
+    if status != 1 || strings.Contains(out, "first ran") || !strings.Contains(out, "bottle 'port'") {
+        t.Errorf("an invalid -b= value was not refused up front:\n%s", out)
+    }
+
+    // Changing the command drops the specs of bottles it no longer uses
+    c.run("", "-c", "deploy", "echo b%('env')%b")
+    out, _ = c.run("", "-ln", "deploy")
+    if strings.Contains(out, "port") {
+        t.Errorf("stale spec kept:\n%s", out)
+    }
+}
+
+func TestCLIBottleSources(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "deploy", "echo b%('host')%b b%('user')%b b%('branch')%b b%('port'|'22')%b",
+        "--bottle=user:env=DEPLOY_USER", "--bottle=branch:command=echo main", "--bottle=port:type=port")
+
+    values := filepath.Join(c.home, "deploy.env")
+    err := os.WriteFile(values, []byte("# staging\nhost=file-host\nuser=file-user\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Nothing is read from stdin, as under cron
+    out, _ := c.run("", "deploy", "--bottles-file", values, "-b=host:flag-host")
+    if !strings.Contains(out, "flag-host file-user main 22") {
+        t.Errorf("sources not applied in order:\n%s", out)
+    }
+
+    // The file can be named by the environment and given to the script too
+    script := c.command(filepath.Join(c.home, ".local", "bin", "deploy"))
+    script.Env = append(script.Env, "ABBTR_BOTTLES_FILE="+values, "ABBTR_BOTTLE_port=2222")
+    scriptOut, err := script.CombinedOutput()
+    if err != nil || !strings.Contains(string(scriptOut), "file-host file-user main 2222") {
+        t.Errorf("script printed %q: %v", scriptOut, err)
+    }
+
+    os.WriteFile(values, []byte("port=http\n"), 0644)
+    out, _ = c.run("", "deploy", "--bottles-file="+values, "-b=host:h", "-b=user:u")
+    if strings.Contains(out, "Executing") || !strings.Contains(out, "bottle 'port' (from bottles file)") {
+        t.Errorf("an invalid value from the file was not refused up front:\n%s", out)
+    }
+
+    out, _ = c.run("", "deploy", "--bottles-file="+filepath.Join(c.home, "missing.env"))
+    if !strings.Contains(out, "failed to read the bottles file") {
+        t.Errorf("a missing file was not reported:\n%s", out)
+    }
+
+    // Without a terminal a bottle nobody gave is an error, not a hang
+    out, _ = c.run("", "deploy", "-b=user:u")
+    if strings.Contains(out, "Executing") || !strings.Contains(out, "no value given for the bottle 'host'") {
+        t.Errorf("a missing value was not reported:\n%s", out)
+    }
+}
+
+func TestCLIProfiles(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "deploy", "echo b%('user')%b@b%('host')%b:b%('port'|'22')%b b%('!token')%b")
+    out, _ := c.run("", "--profile", "save", "prod", "-b=user:deploy", "-b=host:prod1", "-b=!token:s3cret")
+    if !strings.Contains(out, "Profile 'prod' successfully saved") {
+        t.Fatalf("save failed:\n%s", out)
+    }
+    c.run("", "--profile", "save", "staging", "-b=user:test", "-b=host:stage1", "-b=token:t")
+
+    out, _ = c.run("", "--profile", "list")
+    if !strings.Contains(out, "Profile: prod\n  host: prod1\n  token: ***\n  user: deploy\n") || strings.Contains(out, "s3cret") {
+        t.Errorf("profiles not listed:\n%s", out)
+    }
+
+    // -b= overrides single values of the profile
+    out, _ = c.run("", "-p", "prod", "deploy", "-b=host:prod2")
+    if !strings.Contains(out, "Executing command 1: echo deploy@prod2:22 ***") {
+        t.Errorf("profile not applied:\n%s", out)
+    }
+    script := c.command(filepath.Join(c.home, ".local", "bin", "deploy"), "-p=staging")
+    scriptOut, err := script.CombinedOutput()
+    if err != nil || !strings.Contains(string(scriptOut), "test@stage1:22 t") {
+        t.Errorf("script printed %q: %v", scriptOut, err)
+    }
+
+    out, _ = c.run("", "-p", "qa", "deploy")
+    if strings.Contains(out, "Executing") || !strings.Contains(out, "profile 'qa' not found") {
+        t.Errorf("an unknown profile was not refused:\n%s", out)
+    }
+
+    // Profiles are exported and imported with the rules
+    out, _ = c.run("\n\n\n", "-e")
+    if !strings.Contains(out, "successfully exported") {
+        t.Fatalf("export failed:\n%s", out)
+    }
+    exported, err := os.ReadFile(filepath.Join(c.home, "abbtr-rules.txt"))
+    if err != nil || !strings.Contains(string(exported), "p:prod/user = deploy:p") {
+        t.Fatalf("profiles not exported: %q, %v", exported, err)
+    }
+    if info, err := os.Stat(filepath.Join(c.home, "abbtr-rules.txt")); err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("the export holding secrets is readable by others: %v, %v", info.Mode(), err)
+    }
+
+    out, _ = c.run("", "--profile", "delete", "prod")
+    if !strings.Contains(out, "Profile 'prod' successfully deleted") {
+        t.Errorf("delete failed:\n%s", out)
+    }
+    out, _ = c.run("y\nn\n", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    if !strings.Contains(out, "Profile 'prod' imported") || !strings.Contains(out, "Skipping profile 'staging'") {
+        t.Errorf("profiles not imported:\n%s", out)
+    }
+    out, _ = c.run("", "-p", "prod", "deploy")
+    if !strings.Contains(out, "Executing command 1: echo deploy@prod1:22 ***") {
+        t.Errorf("imported profile not applied:\n%s", out)
+    }
+
+    // Only the values of the bottles of the chosen rules are exported
+    c.run("", "-n", "greet", "echo hello b%('user')%b")
+    c.run("greet\n\n\n", "-e")
+    exported, err = os.ReadFile(filepath.Join(c.home, "abbtr-rules.txt"))
+    if err != nil || !strings.Contains(string(exported), "p:prod/user = deploy:p") || strings.Contains(string(exported), "s3cret") {
+        t.Errorf("got %q, %v", exported, err)
+    }
+    c.run("", "-n", "plain", "echo plain")
+    c.run("plain\n\n\n", "-e")
+    exported, err = os.ReadFile(filepath.Join(c.home, "abbtr-rules.txt"))
+    if err != nil || strings.Contains(string(exported), "p:") {
+        t.Errorf("got %q, %v", exported, err)
+    }
+    if info, err := os.Stat(filepath.Join(c.home, "abbtr-rules.txt")); err != nil || info.Mode().Perm() != 0644 {
+        t.Errorf("got %v, %v", info.Mode(), err)
+    }
+}
+
+func TestCLIScopedBottles(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "ssh", "echo ssh b%('user')%b@b%('host')%b b%('!password')%b")
+    c.run("", "-n", "deploy", "echo deploy b%('user')%b b%('host')%b b%('port'|'22')%b")
+
+    // The host is asked once, the user is given for each rule
+    out, _ := c.run("h1\n\n", "ssh", "deploy", "-b=ssh.user:alice", "-b=user:bob", "-b=ssh.!password:pw")
+    if !strings.Contains(out, "ssh alice@h1 pw") || !strings.Contains(out, "deploy bob h1 22") {
+        t.Errorf("scoped values not applied:\n%s", out)
+    }
+    if strings.Count(out, "The host is?") != 1 || strings.Contains(out, "The user is?") {
+        t.Errorf("unexpected prompts:\n%s", out)
+    }
+
+    out, _ = c.run("", "--dry-run", "ssh", "deploy", "-b=ssh.user:alice", "-b=user:bob", "-b=password:pw")
+    for _, want := range []string{
+        "Command 1 (rule 'ssh'): echo ssh alice@b%('host')%b ***",
+        "  user: alice (-b=ssh.user)",
+        "  host: asked (prompt)",
+        "  password: *** (-b=password)",
+        "  user: bob (-b=user)",
+        "  host: the answer given for rule 'ssh'",
+        "  port: asked, Enter for '22' (prompt)",
+    } {
+        if !strings.Contains(out, want) {
+            t.Errorf("dry run lacks %q:\n%s", want, out)
+        }
+    }
+    if strings.Contains(out, "Executing") {
+        t.Errorf("the dry run executed rules:\n%s", out)
+    }
+
+    // An unquoted command keeps its own --dry-run
+    c.run("", "-n", "rs", "rsync", "-a", "--dry-run", "src/", "dst/")
+    out, _ = c.run("", "-ln", "rs")
+    if !strings.Contains(out, "rs = rsync -a --dry-run src/ dst/") {
+        t.Errorf("--dry-run was taken from the command:\n%s", out)
+    }
+
+    // Profiles may scope their values too
+    c.run("", "--profile", "save", "prod", "-b=deploy.host:prod1", "-b=host:shared")
+    out, _ = c.run("", "--dry-run", "-p", "prod", "ssh", "deploy")
+    if !strings.Contains(out, "  host: shared (profile)") || !strings.Contains(out, "  host: prod1 (profile deploy.host)") {
+        t.Errorf("scoped profile values not applied:\n%s", out)
+    }
+
+    // The values scoped to a rule follow it when it is renamed, not when it
+    // is copied
+    c.run("", "--rename", "deploy", "release")
+    c.run("", "--copy", "release", "rollout")
+    out, _ = c.run("", "--dry-run", "-p", "prod", "ssh", "release", "rollout")
+    if !strings.Contains(out, "  host: prod1 (profile release.host)") || strings.Count(out, "(profile release.host)") != 1 {
+        t.Errorf("scoped profile values not renamed:\n%s", out)
+    }
+}
+
+func TestCLIBulkRuns(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "build", "echo building; exit 3")
+    c.run("", "-n", "test", "echo testing")
+    c.run("", "-n", "deploy", "echo deploying")
+
+    // Nothing is deployed after a failed build
+    out, status := c.run("", "build", "test", "deploy")
+    if status != 3 || strings.Contains(out, "deploying") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    for _, want := range []string{"Summary:", "  build   failed (exit code 3)", "  test    skipped", "0 passed, 1 failed, 2 skipped"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("summary lacks %q:\n%s", want, out)
+        }
+    }
+
+    out, status = c.run("", "build", "test", "deploy", "--keep-going")
+    if status != 3 || !strings.Contains(out, "deploying") || !strings.Contains(out, "2 passed, 1 failed, 0 skipped") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+
+    // Unknown rules stop the run before anything starts, unless asked to go on
+    out, status = c.run("", "test", "tset")
+    if status != 1 || strings.Contains(out, "testing") || !strings.Contains(out, "rule 'tset' not found") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    out, status = c.run("", "test", "tset", "--keep-going")
+    if status != 1 || !strings.Contains(out, "testing") || !strings.Contains(out, "  tset  failed (exit code 1)") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+
+    out, status = c.run("", "test", "deploy")
+    if status != 0 || !strings.Contains(out, "2 passed, 0 failed, 0 skipped") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    out, _ = c.run("", "test")
+    if strings.Contains(out, "Summary") {
+        t.Errorf("a single rule printed a summary:\n%s", out)
+    }
+
+    // Unquoted commands keep their own --keep-going and --fail-fast
+    c.run("", "-n", "mk", "make", "--keep-going", "all")
+    c.run("", "-c", "test", "go", "test", "--fail-fast", "./...")
+    out, _ = c.run("", "-l")
+    if !strings.Contains(out, "make --keep-going all") || !strings.Contains(out, "go test --fail-fast ./...") {
+        t.Errorf("options were taken from the commands:\n%s", out)
+    }
+
+    // The script of a rule with bottles reads the options of abbtr placed
+    // before its arguments, -- forwards the rest as they are
+    c.run("", "-n", "say", "echo b%('who')%b said:")
+    say := filepath.Join(c.home, ".local", "bin", "say")
+    scriptOut, err := c.command(say, "-b=who:x", "hi", "-b=who:y").CombinedOutput()
+    if err != nil || !strings.Contains(string(scriptOut), "\nx said: hi -b=who:y\n") {
+        t.Errorf("the bottle was not read from the flag: %v\n%s", err, scriptOut)
+    }
+    script := c.command(say, "--", "--keep-going", "-b=who:x", "--")
+    script.Env = append(script.Env, "ABBTR_BOTTLE_who=Ada")
+    scriptOut, err = script.CombinedOutput()
+    if err != nil || !strings.Contains(string(scriptOut), "\nAda said: --keep-going -b=who:x --\n") {
+        t.Errorf("the arguments were not forwarded: %v\n%s", err, scriptOut)
+    }
+    // Other options of abbtr go to the command, as with the scripts of
+    // plain rules
+    script = c.command(say, "-b=who:x", "--dry-run", "--keep-going", "-j=2", "--matrix=who:y")
+    scriptOut, err = script.CombinedOutput()
+    if err != nil || !strings.Contains(string(scriptOut), "\nx said: --dry-run --keep-going -j=2 --matrix=who:y\n") {
+        t.Errorf("the options of abbtr were read from the arguments: %v\n%s", err, scriptOut)
+    }
+}
+
+func TestCLIParallelRules(t *testing.T) {
+    c := newCLI(t)
+
+    // Each rule waits for the other, which only ends when both run together
+    wait := "touch %[1]s/%[2]s; for i in $(seq 100); do test -e %[1]s/%[3]s && break; sleep 0.05; done; test -e %[1]s/%[3]s && echo %[2]s met %[3]s"
+    c.run("", "-n", "left", fmt.Sprintf(wait, c.home, "left", "right"))
+    c.run("", "-n", "right", fmt.Sprintf(wait, c.home, "right", "left")+" b%('user')%b")
+    c.run("", "-n", "greet", "echo hello b%('user')%b; read line || echo no input")
+
+    // The prompt comes first, the rules then share its answer
+    out, status := c.run("alice\n", "-j", "3", "left", "right", "greet")
+    if status != 0 {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    if strings.Count(out, "The user is?") != 1 || strings.Index(out, "The user is?") > strings.Index(out, "[") {
+        t.Errorf("the user was not asked once before the rules started:\n%s", out)
+    }
+    for _, want := range []string{"[left] left met right\n", "[right] right met left alice\n", "[greet] hello alice\n", "[greet] no input\n", "3 passed, 0 failed, 0 skipped"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("output lacks %q:\n%s", want, out)
+        }
+    }
+
+    log, err := os.ReadFile(filepath.Join(c.home, ".local", "share", "abbtr", "abbtr.log"))
+    if err != nil || strings.Count(string(log), "EXECUTE_RULE") != 3 {
+        t.Errorf("rules not logged: %v\n%s", err, log)
+    }
+
+    c.run("", "-n", "fail", "exit 4")
+    out, status = c.run("", "-j", "2", "fail", "greet", "-b=user:bob", "--keep-going")
+    if status != 4 || !strings.Contains(out, "[greet] hello bob\n") || !strings.Contains(out, "1 passed, 1 failed, 0 skipped") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+}
+
+func TestCLINeeds(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "build", "echo building")
+    c.run("", "-n", "test", "echo testing", "--needs=build")
+    c.run("", "-n", "deploy", "echo deploying", "--needs=build,test")
+    c.run("", "-n", "lint", "echo linting")
+
+    out, _ := c.run("", "-n", "release", "echo releasing", "--needs=nope")
+    if !strings.Contains(out, "rule 'release' needs 'nope', which does not exist") {
+        t.Errorf("an unknown rule was accepted:\n%s", out)
+    }
+    out, _ = c.run("", "-c", "build", "echo building", "--needs=deploy")
+    if !strings.Contains(out, "dependency cycle: build -> deploy -> build") {
+        t.Errorf("a cycle was accepted:\n%s", out)
+    }
+
+    out, _ = c.run("", "-ln", "deploy")
+    if !strings.Contains(out, "Needs:\n  build\n  test\n    build\n") {
+        t.Errorf("the dependency tree is missing:\n%s", out)
+    }
+
+    // Each needed rule runs once, before the rules needing it
+    out, status := c.run("", "test", "deploy")
+    if status != 0 || strings.Count(out, "\nbuilding\n") != 1 {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    if b, t1, d := strings.Index(out, "\nbuilding"), strings.Index(out, "\ntesting"), strings.Index(out, "\ndeploying"); b > t1 || t1 > d {
+        t.Errorf("the rules ran out of order:\n%s", out)
+    }
+
+    // The script of the rule runs what it needs as well
+    script, err := c.command(filepath.Join(c.home, ".local", "bin", "deploy")).CombinedOutput()
+    if err != nil || !strings.Contains(string(script), "building") || !strings.Contains(string(script), "deploying") {
+        t.Errorf("the script did not run the needed rules: %v\n%s", err, script)
+    }
+
+    // Only the rules needing the failed one are skipped
+    c.run("", "-c", "test", "exit 2", "--needs=build")
+    out, status = c.run("", "deploy", "lint", "-j", "2", "--keep-going")
+    if status != 2 || strings.Contains(out, "deploying") || !strings.Contains(out, "[lint] linting") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    if !strings.Contains(out, "  deploy  skipped") || !strings.Contains(out, "2 passed, 1 failed, 1 skipped") {
+        t.Errorf("unexpected summary:\n%s", out)
+    }
+
+    // A rule using another one with @name needs what that rule needs
+    c.run("", "-n", "gen", "echo generating")
+    c.run("", "-n", "compile", "echo compiling", "--needs=gen")
+    c.run("", "-n", "ship", "@compile && echo shipping")
+    script, err = c.command(filepath.Join(c.home, ".local", "bin", "ship")).CombinedOutput()
+    if err != nil || !strings.Contains(string(script), "generating\n") || !strings.Contains(string(script), "compiling\nshipping\n") {
+        t.Errorf("the script did not run what the used rule needs: %v\n%s", err, script)
+    }
+}
+
+func TestCLIReferences(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "build", "echo building")
+    c.run("", "-n", "ship", "@build && echo shipping to user@example.com")
+
+    out, status := c.run("", "ship")
+    if status != 0 || !strings.Contains(out, "\nbuilding\nshipping to user@example.com\n") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+
+    // The script of the rule embeds the command of the other one, and
+    // follows its changes
+    c.run("", "-c", "build", "echo compiling")
+    script, err := c.command(filepath.Join(c.home, ".local", "bin", "ship")).CombinedOutput()
+    if err != nil || string(script) != "compiling\nshipping to user@example.com\n" {
+        t.Errorf("the script did not run the expanded command: %v\n%s", err, script)
+    }
+
+    out, _ = c.run("", "-ln", "ship", "--expand")
+    if !strings.Contains(out, "Expanded: ( echo compiling ) && echo shipping to user@example.com\n") {
+        t.Errorf("the expanded command is missing:\n%s", out)
+    }
+
+    out, _ = c.run("", "-c", "build", "@ship")
+    if !strings.Contains(out, "Unable to update rule. dependency cycle: build -> ship -> build.") {
+        t.Errorf("a cycle was accepted:\n%s", out)
+    }
+
+    out, _ = c.run("", "-r", "build")
+    if !strings.Contains(out, "Unable to delete rule 'build', it is used by ship.") {
+        t.Errorf("a rule in use was deleted:\n%s", out)
+    }
+    out, _ = c.run("", "-r", "build", "--force")
+    if !strings.Contains(out, "Rule 'build' successfully deleted.") {
+        t.Errorf("--force did not delete the rule:\n%s", out)
+    }
+    c.run("", "-n", "build", "echo building")
+    out, _ = c.run("", "-r", "ship", "build")
+    if strings.Count(out, "successfully deleted") != 2 {
+        t.Errorf("rules deleted together were kept:\n%s", out)
+    }
+
+    // A new rule does not take over the text of existing ones
+    c.run("", "-n", "inst", "echo npm install @types/node")
+    out, _ = c.run("", "-n", "types", "echo OOPS")
+    if !strings.Contains(out, "Warning: '@types' in the command of inst does not refer to the rule 'types'.") {
+        t.Errorf("the mention was not reported:\n%s", out)
+    }
+    out, status = c.run("", "inst")
+    if status != 0 || !strings.Contains(out, "\nnpm install @types/node\n") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    script, err = c.command(filepath.Join(c.home, ".local", "bin", "inst")).CombinedOutput()
+    if err != nil || string(script) != "npm install @types/node\n" {
+        t.Errorf("the script changed: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "-r", "types")
+    if !strings.Contains(out, "Rule 'types' successfully deleted.") {
+        t.Errorf("an unused rule was kept:\n%s", out)
+    }
+}
+
+func TestCLIShells(t *testing.T) {
+    c := newCLI(t)
+
+    out, _ := c.run("", "-n", "args", `print join(",", "perl", @ARGV), "\n"`, "--shell=perl")
+    if !strings.Contains(out, "successfully added") {
+        t.Fatalf("create failed:\n%s", out)
+    }
+    out, status := c.run("", "args", "--", "a b", "c")
+    if status != 0 || !strings.Contains(out, "perl,a b,c\n") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    script, err := c.command(filepath.Join(c.home, ".local", "bin", "args"), "x").CombinedOutput()
+    if err != nil || string(script) != "perl,x\n" {
+        t.Errorf("the script did not use perl: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "-ln", "args")
+    if !strings.Contains(out, "Shell: perl\n") {
+        t.Errorf("the shell is not shown:\n%s", out)
+    }
+
+    out, _ = c.run("", "-n", "nope", "true", "--shell=no-such-shell")
+    if !strings.Contains(out, "Unable to create rule. the interpreter 'no-such-shell' was not found on this machine.") {
+        t.Errorf("a missing interpreter was accepted:\n%s", out)
+    }
+    out, _ = c.run("", "-n", "first", `print b%(1)%b, "\n"`, "--shell=perl")
+    if !strings.Contains(out, "Unable to create rule. b%(1)%b placeholders only work with shells") {
+        t.Errorf("a placeholder was accepted for perl:\n%s", out)
+    }
+    out, _ = c.run("", "-n", "both", "@args && echo done")
+    if !strings.Contains(out, "rule 'args' runs with perl, it cannot be used by 'both' which runs with bash") {
+        t.Errorf("rules with different shells were mixed:\n%s", out)
+    }
+
+    // An @ in perl is not a reference, even to an existing rule
+    c.run("", "-n", "files", "ls")
+    c.run("", "-n", "count", `my @files = @ARGV; print scalar(@files), "\n"`, "--shell=perl")
+    out, status = c.run("", "count", "--", "a", "b")
+    if status != 0 || !strings.Contains(out, "\n2\n") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+
+    // Rules without a shell of their own follow the default
+    c.run("", "-n", "hello", `print "hello from perl\n"`)
+    out, _ = c.run("", "--default-shell", "perl")
+    if !strings.Contains(out, "now run with perl") {
+        t.Errorf("the default was not changed:\n%s", out)
+    }
+    script, err = c.command(filepath.Join(c.home, ".local", "bin", "hello")).CombinedOutput()
+    if err != nil || string(script) != "hello from perl\n" {
+        t.Errorf("the script did not follow the default: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "--default-shell")
+    if !strings.Contains(out, "run with perl.") {
+        t.Errorf("the default is not shown:\n%s", out)
+    }
+
+    // An import keeps the interpreter of the rules
+    c.run("", "--default-shell", "bash")
+    c.run("args\n\n\n", "-e")
+    c.run("", "-r", "args")
+    c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    out, status = c.run("", "args", "--", "again")
+    if status != 0 || !strings.Contains(out, "perl,again\n") {
+        t.Errorf("the imported rule lost its shell, exit status %d:\n%s", status, out)
+    }
+
+    exported := filepath.Join(c.home, "other.txt")
+    err = os.WriteFile(exported, []byte(`r:{"name":"elsewhere","command":"true","shell":"no-such-shell"}:r`+"\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    out, _ = c.run("", "-i", exported)
+    if !strings.Contains(out, "Warning: Rule 'elsewhere' cannot run: the interpreter 'no-such-shell' was not found on this machine.") {
+        t.Errorf("a missing interpreter was not reported:\n%s", out)
+    }
+
+    c.run("", "-n", "first", "echo b%(1)%b")
+    out, _ = c.run("", "--default-shell", "perl")
+    if !strings.Contains(out, "Unable to change the default shell. rule 'first': b%(1)%b placeholders only work with shells") {
+        t.Errorf("a rule with placeholders was moved to perl:\n%s", out)
+    }
+}
+
+func TestCLIMultilineRules(t *testing.T) {
+    c := newCLI(t)
+
+    body := "set -e\nfor n in 1 2; do\n  echo \"line $n of $1\"\ndone # the end"
+    out, _ := c.run(body+"\n", "-n", "loop", "-")
+    if !strings.Contains(out, "Rule 'loop' successfully added") {
+        t.Fatalf("create failed:\n%s", out)
+    }
+
+    // Arguments are positional parameters, not appended to the last line
+    out, status := c.run("", "loop", "--", "abbtr")
+    if status != 0 || !strings.Contains(out, "line 1 of abbtr\nline 2 of abbtr\n") {
+        t.Errorf("got exit status %d:\n%s", status, out)
+    }
+    script, err := c.command(filepath.Join(c.home, ".local", "bin", "loop"), "the script").CombinedOutput()
+    if err != nil || string(script) != "line 1 of the script\nline 2 of the script\n" {
+        t.Errorf("the script failed: %v\n%s", err, script)
+    }
+
+    out, _ = c.run("", "-ln", "loop")
+    if !strings.Contains(out, "loop =\n    set -e\n    for n in 1 2; do\n      echo \"line $n of $1\"\n    done # the end\n") {
+        t.Errorf("the command is not shown line by line:\n%s", out)
+    }
+
+    log, err := os.ReadFile(filepath.Join(c.home, ".local", "share", "abbtr", "abbtr.log"))
+    if err != nil || strings.Contains(string(log), "\nfor n") {
+        t.Errorf("a multi-line command split a log entry: %v\n%s", err, log)
+    }
+
+    file := filepath.Join(c.home, "deploy.sh")
+    err = os.WriteFile(file, []byte("#!/bin/bash\necho first\necho second\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.run("", "-c", "loop", "--from-file", file)
+    out, _ = c.run("", "loop")
+    if !strings.Contains(out, "first\nsecond\n") {
+        t.Errorf("the command was not read from the file:\n%s", out)
+    }
+
+    // Export and import keep every byte
+    c.run("\n\n\n", "-e")
+    c.run("", "-r", "loop")
+    c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    out, _ = c.run("", "-ln", "loop")
+    if !strings.Contains(out, "loop =\n    #!/bin/bash\n    echo first\n    echo second\nCreated") {
+        t.Errorf("the command changed on the way:\n%s", out)
+    }
+
+    // A long command is a long line of the export file
+    long := strings.Repeat("echo "+strings.Repeat("x", 75)+"\n", 1000) + "echo last"
+    err = os.WriteFile(file, []byte(long), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.run("", "-n", "long", "--from-file", file)
+    c.run("long\n\n\n", "-e")
+    c.run("", "-r", "long")
+    out, _ = c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    if !strings.Contains(out, "Rule 'long' imported.") {
+        t.Errorf("the long rule was not imported:\n%s", out)
+    }
+    script, err = c.command(filepath.Join(c.home, ".local", "bin", "long")).Output()
+    if err != nil || string(script) != strings.Repeat(strings.Repeat("x", 75)+"\n", 1000)+"last\n" {
+        t.Errorf("the long rule changed on the way: %v", err)
+    }
+
+    out, _ = c.run("", "-n", "empty", "-")
+    if !strings.Contains(out, "The command is empty") {
+        t.Errorf("an empty command was accepted:\n%s", out)
+    }
+
+    // Without ~/.local/bin in PATH the piped command is not taken as the
+    // answer to the PATH question
+    cmd := c.command(os.Args[0], "-n", "piped", "-")
+    cmd.Env = append(cmd.Env, "ABBTR_TEST_MAIN=1", "PATH="+c.bin+":/usr/bin:/bin", "SHELL=/bin/bash")
+    cmd.Stdin = strings.NewReader("y\necho two\n")
+    piped, err := cmd.CombinedOutput()
+    if err != nil || !strings.Contains(string(piped), "Rule 'piped' successfully added") {
+        t.Errorf("create failed: %v\n%s", err, piped)
+    }
+    if _, err := os.Stat(filepath.Join(c.home, ".bashrc")); !os.IsNotExist(err) {
+        t.Errorf("the command answered the PATH question: %v", err)
+    }
+    out, _ = c.run("", "-ln", "piped")
+    if !strings.Contains(out, "piped =\n    y\n    echo two\n") {
+        t.Errorf("the command lost lines:\n%s", out)
+    }
+
+    // The warning goes to stderr, and never into the output of rules
+    var stdout, stderr strings.Builder
+    cmd = c.command(os.Args[0], "-l")
+    cmd.Env = append(cmd.Env, "ABBTR_TEST_MAIN=1", "PATH="+c.bin+":/usr/bin:/bin")
+    cmd.Stdout, cmd.Stderr = &stdout, &stderr
+    if err := cmd.Run(); err != nil || strings.Contains(stdout.String(), "PATH") || !strings.Contains(stderr.String(), "not in your PATH") {
+        t.Errorf("the warning was misplaced: %v\nstdout:\n%s\nstderr:\n%s", err, stdout.String(), stderr.String())
+    }
+    for _, args := range [][]string{{"piped"}, {"--exec", "piped"}} {
+        cmd = c.command(os.Args[0], args...)
+        cmd.Env = append(cmd.Env, "ABBTR_TEST_MAIN=1", "PATH="+c.bin+":/usr/bin:/bin")
+        out, err := cmd.CombinedOutput()
+        if err != nil || strings.Contains(string(out), "PATH") {
+            t.Errorf("%s warned about the PATH: %v\n%s", args, err, out)
+        }
+    }
+}
+
+func TestCLIEdit(t *testing.T) {
+    c := newCLI(t)
+
+    // The editor replaces the file it is given with the next version
+    edited := filepath.Join(c.home, "edited.txt")
+    t.Setenv("VISUAL", "cp '"+edited+"'")
+    edit := func(text, answers string) string {
+        err := os.WriteFile(edited, []byte(text), 0644)
+        if err != nil {
+            t.Fatal(err)
+        }
+        out, _ := c.run(answers, "--edit", "greet")
+        return out
+    }
+
+    out := edit("desc: Say hi\ntags: demo\n---\necho hi\n", "y\n")
+    if !strings.Contains(out, "+ desc: Say hi\n") || !strings.Contains(out, "+ echo hi\n") || !strings.Contains(out, "Rule 'greet' successfully added") {
+        t.Fatalf("create failed:\n%s", out)
+    }
+
+    out = edit("needs: nope\n---\necho hi\n", "n\n")
+    if !strings.Contains(out, "The rule is not valid: rule 'greet' needs 'nope', which does not exist.") || !strings.Contains(out, "Operation cancelled.") {
+        t.Errorf("an invalid rule was not refused:\n%s", out)
+    }
+
+    out = edit("desc: Say hello\n---\necho hello\necho again\n", "n\n")
+    if !strings.Contains(out, "Operation cancelled.") {
+        t.Errorf("changes were applied without confirmation:\n%s", out)
+    }
+
+    out = edit("# my notes\ndesc: Say hello\n---\necho hello\necho again\n", "y\n")
+    for _, line := range []string{"- desc: Say hi\n", "+ desc: Say hello\n", "- tags: demo\n", "- echo hi\n", "+ echo hello\n", "+ echo again\n", "Rule 'greet' successfully updated."} {
+        if !strings.Contains(out, line) {
+            t.Errorf("%q is missing:\n%s", line, out)
+        }
+    }
+    if strings.Contains(out, "my notes") || strings.Contains(out, "needs:") {
+        t.Errorf("comments or empty settings are part of the diff:\n%s", out)
+    }
+
+    script, err := c.command(filepath.Join(c.home, ".local", "bin", "greet")).Output()
+    if err != nil || string(script) != "hello\nagain\n" {
+        t.Errorf("the script was not updated: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "-ln", "greet")
+    if !strings.Contains(out, "Description: Say hello") || strings.Contains(out, "Tags:") {
+        t.Errorf("the settings were not applied:\n%s", out)
+    }
+
+    // Saving the file as it was opened changes nothing
+    t.Setenv("VISUAL", "true")
+    out, _ = c.run("", "--edit", "greet")
+    if !strings.Contains(out, "No changes made to rule 'greet'.") {
+        t.Errorf("got:\n%s", out)
+    }
+}
+
+func TestCLIRenameCopy(t *testing.T) {
+    c := newCLI(t)
+    bin := filepath.Join(c.home, ".local", "bin")
+
+    c.run("", "-n", "build", "echo building", "--desc=Build it", "--tags=ci")
+    c.run("", "-n", "ship", "@build && echo shipping")
+    c.run("", "-n", "check", "echo checking", "--needs=build")
+
+    out, _ := c.run("", "--rename", "build", "compile")
+    if !strings.Contains(out, "Rule 'build' successfully renamed to 'compile'.") {
+        t.Fatalf("rename failed:\n%s", out)
+    }
+    if _, err := os.Stat(filepath.Join(bin, "build")); !os.IsNotExist(err) {
+        t.Errorf("the old script is still there: %v", err)
+    }
+    script, err := c.command(filepath.Join(bin, "ship")).Output()
+    if err != nil || string(script) != "building\nshipping\n" {
+        t.Errorf("the script of ship was not kept working: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "-ln", "ship")
+    if !strings.Contains(out, "ship = @compile && echo shipping") {
+        t.Errorf("the reference was not renamed:\n%s", out)
+    }
+    out, status := c.run("", "check")
+    if status != 0 || !strings.Contains(out, "building\n") || !strings.Contains(out, "checking\n") {
+        t.Errorf("the needs were not renamed, exit status %d:\n%s", status, out)
+    }
+    out, _ = c.run("", "-ln", "compile")
+    if !strings.Contains(out, "Description: Build it") || !strings.Contains(out, "Tags: ci") {
+        t.Errorf("the metadata was lost:\n%s", out)
+    }
+
+    for _, args := range [][]string{{"compile", "ship"}, {"compile", "pwd"}, {"compile", "a/b"}, {"nope", "other"}} {
+        out, _ = c.run("", append([]string{"--rename"}, args...)...)
+        if strings.Contains(out, "successfully") {
+            t.Errorf("--rename %s %s was accepted:\n%s", args[0], args[1], out)
+        }
+    }
+
+    out, _ = c.run("", "--copy", "compile", "compile2")
+    if !strings.Contains(out, "Rule 'compile' successfully copied to 'compile2'.") {
+        t.Fatalf("copy failed:\n%s", out)
+    }
+    script, err = c.command(filepath.Join(bin, "compile2")).Output()
+    if err != nil || string(script) != "building\n" {
+        t.Errorf("the copy has no working script: %v\n%s", err, script)
+    }
+    out, _ = c.run("", "-ln", "compile2")
+    if !strings.Contains(out, "Description: Build it") {
+        t.Errorf("the metadata was not copied:\n%s", out)
+    }
+    out, _ = c.run("", "--copy", "compile", "ship")
+    if !strings.Contains(out, "A rule named 'ship' already exists.") {
+        t.Errorf("got:\n%s", out)
+    }
+
+    log, err := os.ReadFile(filepath.Join(c.home, ".local", "share", "abbtr", "abbtr.log"))
+    if err != nil || !strings.Contains(string(log), "RENAME_RULE") || !strings.Contains(string(log), "COPY_RULE") {
+        t.Errorf("the events were not logged: %v\n%s", err, log)
+    }
+}
+
+func TestCLIExportMetadata(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "build", "echo building")
+    c.run("", "-n", "deploy", "echo deploying to b%('env')%b", "--needs=build", "--desc=Ship it", "--tags=web,prod", "--bottle=env:choices=dev,prod")
+    c.run("\n\n\n", "-e")
+    c.run("", "-r", "a")
+
+    out, _ := c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    if !strings.Contains(out, "Rule 'deploy' imported.") || strings.Contains(out, "Warning") {
+        t.Fatalf("import failed:\n%s", out)
+    }
+    out, _ = c.run("", "-ln", "deploy")
+    for _, want := range []string{"Description: Ship it", "Tags: web, prod", "Needs:\n  build", "  env: choices dev, prod"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("%q was lost:\n%s", want, out)
+        }
+    }
+    cmd := c.command(filepath.Join(c.home, ".local", "bin", "deploy"))
+    cmd.Env = append(cmd.Env, "ABBTR_BOTTLE_env=prod")
+    script, err := cmd.CombinedOutput()
+    if err != nil || !strings.Contains(string(script), "building\n") || !strings.Contains(string(script), "deploying to prod\n") {
+        t.Errorf("the imported rule does not run what it needs: %v\n%s", err, script)
+    }
+
+    // Importing deploy alone warns that build is missing
+    c.run("deploy\n\n\n", "-e")
+    c.run("", "-r", "a")
+    out, _ = c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    if !strings.Contains(out, "Warning: Rule 'deploy' cannot run: rule 'deploy' needs 'build', which does not exist.") {
+        t.Errorf("got:\n%s", out)
+    }
+
+    // References are resolved against the rules of this machine, so a rule
+    // created after the import does not take over the text
+    c.run("", "-r", "a")
+    c.run("", "-n", "build", "echo building")
+    c.run("", "-n", "ship", "@build && echo shipped")
+    c.run("ship\n\n\n", "-e")
+    c.run("", "-r", "a", "--force")
+    c.run("", "-i", filepath.Join(c.home, "abbtr-rules.txt"))
+    out, _ = c.run("", "-n", "build", "echo OOPS")
+    if !strings.Contains(out, "Warning: '@build' in the command of ship does not refer to the rule 'build'.") {
+        t.Errorf("the mention was not reported:\n%s", out)
+    }
+    out, _ = c.run("", "ship")
+    if strings.Contains(out, "OOPS") {
+        t.Errorf("a new rule took over an imported command:\n%s", out)
+    }
+}
+
+func TestCLIMatrix(t *testing.T) {
+    c := newCLI(t)
+
+    c.run("", "-n", "ping", "echo ping b%('host')%b as b%('user')%b; test b%('host')%b != web2")
+
+    // The user is asked once for every iteration
+    out, status := c.run("alice\n", "ping", "--matrix=host:web1,web2,web3", "--keep-going")
+    if status != 1 {
+        t.Errorf("got exit status %d, want 1", status)
+    }
+    if strings.Count(out, "The user is?") != 1 {
+        t.Errorf("the prompt was repeated:\n%s", out)
+    }
+    for _, want := range []string{"ping web1 as alice", "ping web3 as alice", "  host=web2  failed (exit code 1)", "2 passed, 1 failed, 0 skipped"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("output lacks %q:\n%s", want, out)
+        }
+    }
+
+    log, err := os.ReadFile(filepath.Join(c.home, ".local", "share", "abbtr", "abbtr.log"))
+    if err != nil || strings.Count(string(log), ", Matrix: host=") != 3 {
+        t.Errorf("iterations not logged: %v\n%s", err, log)
+    }
+
+    // Stop after the first failure
+    out, _ = c.run("", "ping", "-b=user:bob", "--matrix=host:web2,web1")
+    if strings.Contains(out, "ping web1") || !strings.Contains(out, "0 passed, 1 failed, 1 skipped") {
+        t.Errorf("the matrix went on after a failure:\n%s", out)
+    }
+
+    // Iterations running together prefix their lines
+    out, _ = c.run("", "ping", "-b=user:bob", "--matrix=host:web1,web3", "--matrix=env:a,b", "-j", "4")
+    for _, want := range []string{"[host=web1 env=a] ping web1 as bob\n", "[host=web3 env=b] ping web3 as bob\n", "4 passed, 0 failed, 0 skipped"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("output lacks %q:\n%s", want, out)
+        }
+    }
+
+    out, _ = c.run("", "ping", "-b=user:bob", "--matrix=host:", "-j", "0")
+    if !strings.Contains(out, "incorrect usage of --matrix") {
+        t.Errorf("an empty matrix was accepted:\n%s", out)
+    }
+}
+
+func TestCLIKeepsForeignPrograms(t *testing.T) {
+    c := newCLI(t)
+
+    foreign := filepath.Join(c.home, ".local", "bin", "pipx")
+    err := os.WriteFile(foreign, []byte("#!/bin/sh\necho pipx\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    out, _ := c.run("", "-n", "pipx", "echo mine")
+    if !strings.Contains(out, "was not created by abbtr") {
+        t.Errorf("a foreign program was shadowed:\n%s", out)
+    }
+
+    c.run("", "-n", "mine", "echo mine")
+    c.run("", "-n", "replaced", "echo replaced")
+    replaced := filepath.Join(c.home, ".local", "bin", "replaced")
+    err = os.WriteFile(replaced, []byte("#!/bin/sh\necho someone else\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    out, _ = c.run("", "-r", "a")
+    if !strings.Contains(out, "Skipped "+replaced+": it was not created by abbtr.") {
+        t.Errorf("the foreign file was not reported:\n%s", out)
+    }
+    if _, err := os.Stat(replaced); err != nil {
+        t.Errorf("the foreign file was removed: %v", err)
+    }
+    if _, err := os.Stat(foreign); err != nil {
+        t.Errorf("foreign program was removed: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(c.home, ".local", "bin", "mine")); !os.IsNotExist(err) {
+        t.Errorf("abbtr script was kept: %v", err)
+    }
+
+    // Imported rules follow the same naming rules as -n
+    rulesFile := filepath.Join(c.home, "rules.txt")
+    err = os.WriteFile(rulesFile, []byte("b:pwd = echo hijacked:b\nb:pipx = echo mine:b\nb:ok = echo ok:b\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    out, _ = c.run("", "-i", rulesFile)
+    for _, want := range []string{
+        "Skipping rule 'pwd': 'pwd' is a reserved command name.",
+        "Skipping rule 'pipx': 'pipx' already exists in ~/.local/bin and was not created by abbtr.",
+        "Rule 'ok' imported.",
+    } {
+        if !strings.Contains(out, want) {
+            t.Errorf("%q is missing:\n%s", want, out)
+        }
+    }
+    out, _ = c.run("", "-l")
+    if strings.Contains(out, "pwd") || strings.Contains(out, "pipx") {
+        t.Errorf("refused rules were imported:\n%s", out)
+    }
+    out, _ = c.run("", "--sync")
+    if strings.Contains(out, "skipped") {
+        t.Errorf("the sync still skips a rule:\n%s", out)
+    }
+
+    // Scripts that could not be removed are an error
+    err = os.WriteFile(filepath.Join(c.home, ".config", "abbtr", "scripts.json"), []byte("not json"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    out, status := c.run("", "-r", "a")
+    if status != 1 || !strings.Contains(out, "Error deleting all rules: the rules were deleted but not their scripts") {
+        t.Errorf("the failure was not reported, exit status %d:\n%s", status, out)
+    }
+}
@@ -0,0 +1,522 @@
+// Package scripts generates the executable files through which rules are run
+// by name, and keeps track of them in a manifest so that files installed by
+// other programs are never touched.
+package scripts
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "abbtr/bottles"
+    "abbtr/eventlog"
+    "abbtr/executor"
+    "abbtr/internal/fsutil"
+    "abbtr/internal/shell"
+    "abbtr/store"
+)
+
+const (
+    // Marker is written on the second line of every generated script
+    Marker = "# Generated by abbtr"
+
+    // Format identifies the template of Content. Bump it whenever the
+    // template, or the choice between Content and RuntimeContent, changes so
+    // existing scripts get regenerated.
+    Format = 7
+
+    // maxScriptSize bounds the files inspected when looking for abbtr scripts
+    maxScriptSize = 1024 * 1024
+)
+
+// Manager writes the scripts of the rules into Dir
+type Manager struct {
+    // Dir is the directory of the scripts, normally ~/.local/bin
+    Dir string
+    // ManifestPath is the file recording the scripts abbtr owns
+    ManifestPath string
+    // LogPath is the abbtr.log the scripts append their executions to
+    LogPath string
+}
+
+// ForeignError is returned for files in Dir that abbtr did not create
+type ForeignError struct {
+    Path string
+}
+
+func (e *ForeignError) Error() string {
+    return fmt.Sprintf("%s already exists and was not created by abbtr", e.Path)
+}
+
+// Report lists what a synchronisation changed in Dir
+type Report struct {
+    Created []string
+    Updated []string
+    Removed []string
+    // Skipped lists the scripts replaced by files abbtr did not create,
+    // which are left alone, and those that could not be written
+    Skipped []string
+    // Adopted counts the scripts of older abbtr versions taken over
+    Adopted int
+    // Errors holds the problems met with single scripts, which did not stop
+    // the synchronisation
+    Errors []error
+}
+
+// Empty reports whether nothing was changed
+func (r *Report) Empty() bool {
+    return len(r.Created)+len(r.Updated)+len(r.Removed)+len(r.Skipped) == 0
+}
+
+func (r *Report) String() string {
+    var parts []string
+    for _, group := range []struct {
+        label string
+        names []string
+    }{
+        {"created", r.Created},
+        {"updated", r.Updated},
+        {"removed", r.Removed},
+        {"skipped", r.Skipped},
+    } {
+        if len(group.names) > 0 {
+            parts = append(parts, fmt.Sprintf("%s: %s", group.label, strings.Join(group.names, ", ")))
+        }
+    }
+    if len(parts) == 0 {
+        return "all scripts are up to date"
+    }
+    return strings.Join(parts, "; ")
+}
+
+// manifest records the scripts in Dir that abbtr generated
+type manifest struct {
+    Version int `json:"version"`
+    // Format is the Format the scripts were generated with
+    Format int `json:"format"`
+    // StoreHash is the hash of abbtr.conf at the last synchronisation
+    StoreHash string           `json:"store_hash"`
+    Scripts   map[string]entry `json:"scripts"`
+}
+
+type entry struct {
+    Path    string    `json:"path"`
+    Hash    string    `json:"hash"`
+    Created time.Time `json:"created"`
+}
+
+func (m *manifest) names() []string {
+    names := make([]string, 0, len(m.Scripts))
+    for name := range m.Scripts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Path returns where the script of a rule is written
+func (m *Manager) Path(name string) string {
+    return filepath.Join(m.Dir, name)
+}
+
+// Write creates or replaces the script of a rule. Files that abbtr did not
+// create are never overwritten, a *ForeignError is returned instead.
+func (m *Manager) Write(rule *store.Rule) error {
+    unlock, err := fsutil.Lock(m.ManifestPath)
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    manifest, err := m.loadManifest()
+    if err != nil {
+        return err
+    }
+
+    err = m.writeTo(manifest, rule.Name, m.Content(rule))
+    if err != nil {
+        return err
+    }
+    return m.saveManifest(manifest)
+}
+
+// writeTo is Write for callers that save the manifest themselves
+func (m *Manager) writeTo(manifest *manifest, name, content string) error {
+    // Create the scripts directory if it does not exist
+    err := os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        return fmt.Errorf("failed to create directory %s: %v", m.Dir, err)
+    }
+
+    scriptPath := m.Path(name)
+    owned, err := m.IsAbbtrScript(scriptPath)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    if err == nil && !owned {
+        return &ForeignError{Path: scriptPath}
+    }
+
+    err = fsutil.WriteFileAtomic(scriptPath, []byte(content), 0755)
+    if err != nil {
+        return err
+    }
+
+    e, ok := manifest.Scripts[name]
+    if !ok || e.Path != scriptPath {
+        e = entry{Path: scriptPath, Created: time.Now()}
+    }
+    e.Hash = fsutil.Hash([]byte(content))
+    manifest.Scripts[name] = e
+    return nil
+}
+
+// Remove deletes the script of a rule if abbtr created it and drops it from
+// the manifest. A foreign file with the same name is kept and reported with
+// a *ForeignError.
+func (m *Manager) Remove(name string) error {
+    unlock, err := fsutil.Lock(m.ManifestPath)
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    manifest, err := m.loadManifest()
+    if err != nil {
+        return err
+    }
+
+    _, removeErr := m.removeFrom(manifest, name)
+    if _, foreign := removeErr.(*ForeignError); removeErr != nil && !foreign {
+        return removeErr
+    }
+
+    err = m.saveManifest(manifest)
+    if err != nil {
+        return err
+    }
+    return removeErr
+}
+
+// RemoveAll deletes every script listed in the manifest. Anything else in
+// Dir belongs to other programs.
+func (m *Manager) RemoveAll() (*Report, error) {
+    report := &Report{}
+
+    unlock, err := fsutil.Lock(m.ManifestPath)
+    if err != nil {
+        return report, err
+    }
+    defer unlock()
+
+    manifest, err := m.loadManifest()
+    if err != nil {
+        return report, err
+    }
+
+    for _, name := range manifest.names() {
+        m.removeInto(report, manifest, name)
+    }
+
+    return report, m.saveManifest(manifest)
+}
+
+// removeFrom is Remove for callers that save the manifest themselves. It
+// reports whether a file was removed.
+func (m *Manager) removeFrom(manifest *manifest, name string) (bool, error) {
+    scriptPath := m.Path(name)
+    if e, ok := manifest.Scripts[name]; ok {
+        scriptPath = e.Path
+    }
+
+    owned, err := m.IsAbbtrScript(scriptPath)
+    if err != nil && !os.IsNotExist(err) {
+        return false, err
+    }
+
+    delete(manifest.Scripts, name)
+
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if !owned {
+        return false, &ForeignError{Path: scriptPath}
+    }
+    err = os.Remove(scriptPath)
+    if err != nil && !os.IsNotExist(err) {
+        return false, err
+    }
+    return true, nil
+}
+
+// removeInto runs removeFrom and records the outcome in report
+func (m *Manager) removeInto(report *Report, manifest *manifest, name string) {
+    removed, err := m.removeFrom(manifest, name)
+    if _, foreign := err.(*ForeignError); err != nil && !foreign {
+        report.Errors = append(report.Errors, fmt.Errorf("failed to delete the script of %s: %v", name, err))
+        return
+    }
+    if removed {
+        report.Removed = append(report.Removed, name)
+    } else if err != nil {
+        report.Skipped = append(report.Skipped, name)
+    }
+}
+
+// Sync brings Dir in line with the rules. Unless forced it returns straight
+// away when storeHash, the hash of abbtr.conf, has not changed since the
+// last synchronisation, in which case rules is never called. Only the
+// scripts whose content changed are written, and a forced run also checks
+// the scripts on disk against the manifest. Files abbtr did not create are
+// skipped for good, but the hash is not recorded when a script could not be
+// written, so those are tried again on the next run.
+func (m *Manager) Sync(storeHash string, force bool, rules func() ([]store.Rule, error)) (*Report, error) {
+    report := &Report{}
+
+    unlock, err := fsutil.Lock(m.ManifestPath)
+    if err != nil {
+        return report, err
+    }
+    defer unlock()
+
+    manifest, err := m.loadManifest()
+    if err != nil {
+        return report, err
+    }
+    if !force && manifest.StoreHash == storeHash && manifest.Format == Format {
+        return report, nil
+    }
+
+    ruleList, err := rules()
+    if err != nil {
+        return report, err
+    }
+    wanted := make(map[string]bool, len(ruleList))
+    for _, rule := range ruleList {
+        wanted[rule.Name] = true
+    }
+
+    // Create the directory if it doesn't exist
+    err = os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        return report, fmt.Errorf("failed to create rules directory: %v", err)
+    }
+
+    // Take ownership of scripts written by versions without a manifest
+    report.Adopted, err = m.adopt(manifest)
+    if err != nil {
+        return report, err
+    }
+
+    // Remove scripts that don't have corresponding rules
+    for _, name := range manifest.names() {
+        if !wanted[name] {
+            m.removeInto(report, manifest, name)
+        }
+    }
+
+    // Create or update the scripts whose content changed
+    for _, rule := range ruleList {
+        e, tracked := manifest.Scripts[rule.Name]
+        content := m.Content(&rule)
+        if tracked && e.Hash == fsutil.Hash([]byte(content)) && isCurrent(e, force) {
+            continue
+        }
+
+        err = m.writeTo(manifest, rule.Name, content)
+        if _, foreign := err.(*ForeignError); foreign {
+            report.Skipped = append(report.Skipped, rule.Name)
+        } else if err != nil {
+            report.Errors = append(report.Errors, fmt.Errorf("failed to write the script of %s: %v", rule.Name, err))
+            report.Skipped = append(report.Skipped, rule.Name)
+        } else if tracked {
+            report.Updated = append(report.Updated, rule.Name)
+        } else {
+            report.Created = append(report.Created, rule.Name)
+        }
+    }
+
+    if len(report.Errors) == 0 {
+        manifest.StoreHash = storeHash
+        manifest.Format = Format
+    }
+    return report, m.saveManifest(manifest)
+}
+
+// isCurrent tells whether the file of a tracked script still holds what
+// abbtr wrote. Only forced synchronisations read the file back.
+func isCurrent(e entry, verify bool) bool {
+    if !verify {
+        _, err := os.Stat(e.Path)
+        return err == nil
+    }
+    hash, err := fsutil.HashFile(e.Path)
+    return err == nil && hash == e.Hash
+}
+
+func (m *Manager) loadManifest() (*manifest, error) {
+    manifest := &manifest{Version: 1, Scripts: map[string]entry{}}
+
+    data, err := os.ReadFile(m.ManifestPath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return manifest, nil
+        }
+        return nil, fmt.Errorf("failed to read the script manifest: %v", err)
+    }
+
+    err = json.Unmarshal(data, manifest)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", m.ManifestPath, err)
+    }
+    if manifest.Scripts == nil {
+        manifest.Scripts = map[string]entry{}
+    }
+
+    return manifest, nil
+}
+
+func (m *Manager) saveManifest(manifest *manifest) error {
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode the script manifest: %v", err)
+    }
+
+    err = os.MkdirAll(filepath.Dir(m.ManifestPath), 0755)
+    if err != nil {
+        return err
+    }
+
+    return fsutil.WriteFileAtomic(m.ManifestPath, append(data, '\n'), 0644)
+}
+
+// adopt registers in the manifest the scripts generated by abbtr versions
+// that did not keep one, recognising them by their content
+func (m *Manager) adopt(manifest *manifest) (int, error) {
+    files, err := os.ReadDir(m.Dir)
+    if err != nil {
+        return 0, fmt.Errorf("failed to read rules directory: %v", err)
+    }
+
+    adopted := 0
+    for _, file := range files {
+        if file.IsDir() {
+            continue
+        }
+        if _, ok := manifest.Scripts[file.Name()]; ok {
+            continue
+        }
+
+        scriptPath := m.Path(file.Name())
+        owned, err := m.IsAbbtrScript(scriptPath)
+        if err != nil || !owned {
+            continue
+        }
+        manifest.Scripts[file.Name()] = entry{Path: scriptPath, Created: time.Now()}
+        adopted++
+    }
+
+    return adopted, nil
+}
+
+// IsAbbtrScript reports whether the file at path was generated by abbtr,
+// either with the current marker header or with the template used by the
+// versions before it
+func (m *Manager) IsAbbtrScript(path string) (bool, error) {
+    info, err := os.Lstat(path)
+    if err != nil {
+        return false, err
+    }
+    if !info.Mode().IsRegular() || info.Size() > maxScriptSize {
+        return false, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return false, err
+    }
+    content := string(data)
+
+    if strings.HasPrefix(content, "#!/bin/bash\n"+Marker) {
+        return true, nil
+    }
+
+    isLegacy := strings.HasPrefix(content, "#!/bin/bash\nstart=$(date +%s)\n") &&
+        strings.Contains(content, "EXECUTE_RULE") &&
+        strings.Contains(content, "Result: Success, Duration: ${duration}s\" >> "+m.LogPath)
+
+    return isLegacy, nil
+}
+
+// Content returns the script of a rule. Rules with bottles or positional
+// placeholders, and rules needing others, are handed over to abbtr at run
+// time, the others run without it and log their execution themselves. The
+// command runs with the Shell of the rule, bash when it has none.
+func (m *Manager) Content(rule *store.Rule) string {
+    name, command := rule.Name, rule.Command
+    if bottles.Has(command) || len(rule.Needs) > 0 {
+        return RuntimeContent(name)
+    }
+
+    // Everything but the result and the duration is known now, so the log
+    // entry is built here and handed to printf as literal arguments
+    details := eventlog.RuleDetails(name, command)
+
+    // Shells get the arguments of the script appended to a single-line
+    // command, as abbtr does when running the rule, and the command alone
+    // when there are none. The other interpreters and multi-line commands get
+    // them as their own arguments.
+    run := commandLine(rule.Shell, name, command) + ` "$@"`
+    if executor.AppendsArguments(rule) {
+        run = fmt.Sprintf("if [ $# -eq 0 ]; then\n    %s\nelse\n    %s\nfi",
+            commandLine(rule.Shell, name, command), commandLine(rule.Shell, name, shell.Append(command, `"$@"`))+` "$@"`)
+    }
+
+    return fmt.Sprintf(`#!/bin/bash
+%s for the rule '%s'. Do not edit, use abbtr -c instead.
+start=$(date +%%s%%3N)
+%s
+status=$?
+end=$(date +%%s%%3N)
+if [ $status -eq 0 ]; then
+    result="Success"
+else
+    result="Error: exit status $status"
+fi
+ip=$(hostname -I 2>/dev/null | awk '{print $1}')
+{
+    flock -x 9 2>/dev/null
+    printf '[%%s] EXECUTE_RULE %%s at %%s | %%s, Result: %%s, Duration: %%sms\n' \
+        "$(date +'%%Y-%%m-%%d %%H:%%M:%%S')" "$USER" "${ip:-Unknown IP}" %s "$result" "$((end - start))" >&9
+} 9>> %s
+exit $status
+`, Marker, name, run, shell.Quote(details), shell.Quote(m.LogPath))
+}
+
+// commandLine returns the quoted words running command with an interpreter,
+// see executor.CommandLine
+func commandLine(interpreter, name, command string) string {
+    var line []string
+    for _, arg := range executor.CommandLine(interpreter, name, command, nil) {
+        line = append(line, shell.Quote(arg))
+    }
+    return strings.Join(line, " ")
+}
+
+// RuntimeContent returns a script that hands the rule over to abbtr, so
+// bottles are filled and needed rules run exactly as when running
+// 'abbtr <name>'
+func RuntimeContent(name string) string {
+    return fmt.Sprintf(`#!/bin/bash
+%s for the rule '%s'. Do not edit, use abbtr -c instead.
+if ! command -v abbtr >/dev/null 2>&1; then
+    echo "abbtr is not in your PATH, it is needed to run this rule" >&2
+    exit 127
+fi
+exec abbtr --exec %s "$@"
+`, Marker, name, shell.Quote(name))
+}
@@ -0,0 +1,295 @@
+package scripts
+
+import (
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "abbtr/bottles"
+    "abbtr/internal/corpus"
+    "abbtr/internal/shell"
+    "abbtr/store"
+)
+
+func newManager(t *testing.T) *Manager {
+    t.Helper()
+    dir := t.TempDir()
+    return &Manager{
+        Dir:          filepath.Join(dir, "bin"),
+        ManifestPath: filepath.Join(dir, "scripts.json"),
+        LogPath:      filepath.Join(dir, "abbtr.log"),
+    }
+}
+
+func TestContentRoundTrip(t *testing.T) {
+    m := newManager(t)
+
+    // date is the only command of the corpus whose output changes from a run
+    // to the next
+    bin := t.TempDir()
+    err := os.WriteFile(filepath.Join(bin, "date"), []byte("#!/bin/sh\necho 1700000000\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, tc := range corpus.Commands {
+        t.Run(tc.Name, func(t *testing.T) {
+            // A rule printing the awkward text proves the script hands bash
+            // exactly the bytes that were stored
+            err := m.Write(&store.Rule{Name: "rule", Command: "printf %s " + shell.Quote(tc.Command)})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            out, status := runStdout(t, bin, exec.Command(m.Path("rule")))
+            if status != 0 || out != tc.Command {
+                t.Errorf("got %q, want %q", out, tc.Command)
+            }
+
+            // The command itself, however broken, must run from the script
+            // as it does when abbtr runs it with bash -c
+            rule := &store.Rule{Name: "rule", Command: tc.Command}
+            err = m.Write(rule)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, args := range [][]string{nil, {"a b", "c"}} {
+                command, positional := tc.Command, args
+                if !rule.Multiline() {
+                    command, err = bottles.InsertArguments(tc.Command, args)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    positional = nil
+                }
+                want, wantStatus := runStdout(t, bin, exec.Command("bash", append([]string{"-c", command, "rule"}, positional...)...))
+                got, status := runStdout(t, bin, exec.Command(m.Path("rule"), args...))
+                if got != want || status != wantStatus {
+                    t.Errorf("with %q the script printed %q and exited with %d, bash -c printed %q and exited with %d", args, got, status, want, wantStatus)
+                }
+            }
+        })
+    }
+
+    log, err := os.ReadFile(m.LogPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(log), "EXECUTE_RULE") || !strings.Contains(string(log), "Result: Success, Duration: ") {
+        t.Errorf("the scripts did not log their executions:\n%s", log)
+    }
+}
+
+// runStdout runs cmd with bin first in the PATH and returns its standard
+// output and exit status
+func runStdout(t *testing.T, bin string, cmd *exec.Cmd) (string, int) {
+    t.Helper()
+    cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+    out, err := cmd.Output()
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        return string(out), exitErr.ExitCode()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(out), 0
+}
+
+func TestContentShell(t *testing.T) {
+    m := newManager(t)
+
+    for _, rule := range []store.Rule{
+        {Name: "posix", Command: `printf '%s|' "$0"`, Shell: "sh"},
+        {Name: "perl", Command: `print join("|", @ARGV), "|"`, Shell: "perl"},
+    } {
+        err := m.Write(&rule)
+        if err != nil {
+            t.Fatal(err)
+        }
+        out, err := exec.Command(m.Path(rule.Name), "a b", "c").Output()
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := map[string]string{"posix": "posix|a b|c|", "perl": "a b|c|"}[rule.Name]
+        if string(out) != want {
+            t.Errorf("%s: got %q, want %q", rule.Name, out, want)
+        }
+    }
+}
+
+func TestForeignFilesAreKept(t *testing.T) {
+    m := newManager(t)
+    err := os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    foreign := m.Path("pipx")
+    err = os.WriteFile(foreign, []byte("#!/bin/sh\necho pipx\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = m.Write(&store.Rule{Name: "pipx", Command: "echo mine"})
+    if _, ok := err.(*ForeignError); !ok {
+        t.Errorf("got %v, want a *ForeignError", err)
+    }
+    err = m.Remove("pipx")
+    if _, ok := err.(*ForeignError); !ok {
+        t.Errorf("got %v, want a *ForeignError", err)
+    }
+
+    data, err := os.ReadFile(foreign)
+    if err != nil || string(data) != "#!/bin/sh\necho pipx\n" {
+        t.Errorf("foreign file was touched: %v", err)
+    }
+}
+
+func TestSyncOnlyWritesChangedScripts(t *testing.T) {
+    m := newManager(t)
+
+    rules := []store.Rule{{Name: "one", Command: "echo one"}, {Name: "two", Command: "echo two"}}
+    loads := 0
+    load := func() ([]store.Rule, error) {
+        loads++
+        return rules, nil
+    }
+
+    report, err := m.Sync("hash1", false, load)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Join(report.Created, ",") != "one,two" {
+        t.Fatalf("unexpected first sync: %s", report)
+    }
+
+    // Nothing changed, so nothing is even looked at
+    report, err = m.Sync("hash1", false, load)
+    if err != nil || !report.Empty() || loads != 1 {
+        t.Fatalf("second sync changed something: %s, %v", report, err)
+    }
+
+    // A foreign program must survive, an edited rule gets rewritten alone
+    foreign := m.Path("pipx")
+    err = os.WriteFile(foreign, []byte("#!/bin/sh\necho pipx\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rules = []store.Rule{{Name: "two", Command: "echo 2"}}
+
+    report, err = m.Sync("hash2", false, load)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Created) != 0 || strings.Join(report.Updated, ",") != "two" || strings.Join(report.Removed, ",") != "one" {
+        t.Errorf("unexpected sync: %s", report)
+    }
+    if _, err := os.Stat(foreign); err != nil {
+        t.Errorf("foreign file was touched: %v", err)
+    }
+
+    // A forced sync repairs scripts modified on disk
+    err = os.WriteFile(m.Path("two"), []byte("#!/bin/bash\n"+Marker+"\necho tampered\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    report, err = m.Sync("hash2", true, load)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Join(report.Updated, ",") != "two" {
+        t.Errorf("forced sync did not repair the script: %s", report)
+    }
+
+    // Removing everything leaves the foreign program in place
+    report, err = m.RemoveAll()
+    if err != nil || strings.Join(report.Removed, ",") != "two" {
+        t.Errorf("unexpected removal: %s, %v", report, err)
+    }
+    if _, err := os.Stat(foreign); err != nil {
+        t.Errorf("foreign file was touched: %v", err)
+    }
+}
+
+func TestLegacyScriptsAreAdopted(t *testing.T) {
+    m := newManager(t)
+    err := os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The template written before scripts carried a marker
+    legacy := "#!/bin/bash\nstart=$(date +%s)\necho old\nend=$(date +%s)\nduration=$((end - start))\n" +
+        "echo \"[$(date +'%Y-%m-%d %H:%M:%S')] EXECUTE_RULE $USER | Rule: old, Command: echo old, Result: Success, Duration: ${duration}s\" >> " + m.LogPath + "\n"
+    err = os.WriteFile(m.Path("old"), []byte(legacy), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    report, err := m.Sync("hash", false, func() ([]store.Rule, error) { return nil, nil })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Adopted != 1 || strings.Join(report.Removed, ",") != "old" {
+        t.Errorf("legacy script was not adopted: %s, adopted %d", report, report.Adopted)
+    }
+}
+
+func TestSyncSettlesForeignFiles(t *testing.T) {
+    m := newManager(t)
+    err := os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.WriteFile(m.Path("one"), []byte("#!/bin/sh\necho pipx\n"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    load := func() ([]store.Rule, error) {
+        return []store.Rule{{Name: "one", Command: "echo one"}}, nil
+    }
+
+    report, err := m.Sync("hash", false, load)
+    if err != nil || strings.Join(report.Skipped, ",") != "one" || len(report.Errors) != 0 {
+        t.Fatalf("the foreign file did not block the script: %s, %v, %v", report, report.Errors, err)
+    }
+
+    // The foreign file is left alone, there is nothing to do until
+    // abbtr.conf changes
+    report, err = m.Sync("hash", false, func() ([]store.Rule, error) {
+        t.Error("the rules were read again")
+        return load()
+    })
+    if err != nil || !report.Empty() {
+        t.Errorf("the second sync changed something: %s, %v", report, err)
+    }
+}
+
+func TestSyncRetriesFailedScripts(t *testing.T) {
+    m := newManager(t)
+    // No file system takes a name this long
+    long := strings.Repeat("x", 300)
+    load := func() ([]store.Rule, error) {
+        return []store.Rule{{Name: long, Command: "echo long"}}, nil
+    }
+
+    report, err := m.Sync("hash", false, load)
+    if err != nil || len(report.Errors) != 1 {
+        t.Fatalf("the script was written: %s, %v", report, err)
+    }
+
+    // abbtr.conf did not change, but the script is tried again
+    retried := false
+    report, err = m.Sync("hash", false, func() ([]store.Rule, error) {
+        retried = true
+        return nil, nil
+    })
+    if err != nil || !retried {
+        t.Fatalf("the script was not retried: %s, %v", report, err)
+    }
+    report, err = m.Sync("hash", false, load)
+    if err != nil || !report.Empty() {
+        t.Errorf("the sync after the retry changed something: %s, %v", report, err)
+    }
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// documentHelp heads the file opened by --edit
+const documentHelp = `# Edit the rule '%s', then save and close the editor to review the changes.
+# The settings above the --- line take the values of --desc=, --tags=,
+# --needs=, --shell= and --bottle=, one per line, as in "bottle: port:type=port".
+# Everything below the --- line is the command, kept as typed.
+`
+
+// Document is a rule as read from the text opened by --edit. It describes
+// the whole rule: settings left out of the text are empty.
+type Document struct {
+    Command     string
+    Description string
+    Tags        []string
+    Needs       []string
+    Shell       string
+    // Bottles are the bottle attributes, in the order they were written
+    Bottles []BottleSetting
+}
+
+// BottleSetting is one attribute of a bottle, written "<bottle>:<attr>=<value>"
+type BottleSetting struct {
+    Bottle string
+    Attr   string
+    Value  string
+}
+
+// ParseBottleSetting reads a "<bottle>:<attr>=<value>" bottle attribute
+func ParseBottleSetting(text string) (BottleSetting, bool) {
+    parts := strings.SplitN(text, ":", 2)
+    if len(parts) == 2 {
+        attrParts := strings.SplitN(parts[1], "=", 2)
+        if len(attrParts) == 2 && parts[0] != "" {
+            return BottleSetting{Bottle: strings.TrimPrefix(parts[0], "!"), Attr: attrParts[0], Value: attrParts[1]}, true
+        }
+    }
+    return BottleSetting{}, false
+}
+
+// SplitList reads a comma separated list such as "a, b", dropping empty
+// items
+func SplitList(value string) []string {
+    var items []string
+    for _, item := range strings.Split(value, ",") {
+        item = strings.TrimSpace(item)
+        if item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// FormatDocument returns a rule as the text opened by --edit: its settings,
+// a --- line, then its command
+func FormatDocument(rule *Rule) string {
+    var doc strings.Builder
+    setting := func(key, value string) {
+        doc.WriteString(strings.TrimRight(key+": "+value, " ") + "\n")
+    }
+
+    fmt.Fprintf(&doc, documentHelp, rule.Name)
+    setting("desc", rule.Description)
+    setting("tags", strings.Join(rule.Tags, ", "))
+    setting("needs", strings.Join(rule.Needs, ", "))
+    setting("shell", rule.Shell)
+    names := make([]string, 0, len(rule.Bottles))
+    for name := range rule.Bottles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        for _, attr := range rule.Bottles[name].Attributes() {
+            setting("bottle", name+":"+attr)
+        }
+    }
+    doc.WriteString("---\n")
+    doc.WriteString(rule.Command)
+    doc.WriteString("\n")
+    return doc.String()
+}
+
+// ParseDocument reads the text saved from --edit
+func ParseDocument(text string) (Document, error) {
+    var doc Document
+    lines := strings.Split(text, "\n")
+    separator := -1
+    for i, line := range lines {
+        if strings.TrimRight(line, "\r") == "---" {
+            separator = i
+            break
+        }
+    }
+    if separator < 0 {
+        return doc, fmt.Errorf("the --- line separating the settings from the command is missing")
+    }
+
+    for i, line := range lines[:separator] {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        parts := strings.SplitN(line, ":", 2)
+        if len(parts) != 2 {
+            return doc, fmt.Errorf("line %d is not a setting such as 'tags: a, b'", i+1)
+        }
+        value := strings.TrimSpace(parts[1])
+        switch strings.TrimSpace(parts[0]) {
+        case "desc":
+            doc.Description = value
+        case "tags":
+            doc.Tags = SplitList(value)
+        case "needs":
+            doc.Needs = SplitList(value)
+        case "shell":
+            doc.Shell = value
+        case "bottle":
+            setting, ok := ParseBottleSetting(value)
+            if !ok {
+                return doc, fmt.Errorf("line %d should be written as 'bottle: <bottle>:<attribute>=<value>'", i+1)
+            }
+            doc.Bottles = append(doc.Bottles, setting)
+        default:
+            return doc, fmt.Errorf("line %d sets '%s', which is not one of desc, tags, needs, shell or bottle", i+1, strings.TrimSpace(parts[0]))
+        }
+    }
+
+    command := strings.Join(lines[separator+1:], "\n")
+    doc.Command = strings.TrimRight(command, "\r\n")
+    return doc, nil
+}
+
+// SettleDocument drops the comments, blank lines and empty settings from
+// the text of --edit so only real changes show in its diff
+func SettleDocument(text string) string {
+    var lines []string
+    inSettings := true
+    for _, line := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+        if inSettings {
+            trimmed := strings.TrimSpace(line)
+            empty := strings.HasSuffix(trimmed, ":") && strings.Count(trimmed, ":") == 1
+            if trimmed == "" || strings.HasPrefix(trimmed, "#") || empty {
+                continue
+            }
+            inSettings = strings.TrimRight(line, "\r") != "---"
+        }
+        lines = append(lines, line)
+    }
+    return strings.Join(lines, "\n")
+}
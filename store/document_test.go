@@ -0,0 +1,87 @@
+package store
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+
+    "abbtr/bottles"
+)
+
+func TestDocumentRoundTrip(t *testing.T) {
+    rule := &Rule{
+        Name:        "deploy",
+        Command:     "rsync -a out/ b%(host)%b:/srv\n./notify.sh b%(env)%b",
+        Description: "Ship the site",
+        Tags:        []string{"web", "prod"},
+        Needs:       []string{"build", "test"},
+        Shell:       "zsh",
+        Bottles: map[string]bottles.Spec{
+            "host": {Type: "hostname"},
+            "env":  {Choices: []string{"dev", "prod"}, Prompt: "Where to?"},
+        },
+    }
+
+    text := FormatDocument(rule)
+    if !strings.HasPrefix(text, "# Edit the rule 'deploy'") {
+        t.Errorf("the help is missing:\n%s", text)
+    }
+    doc, err := ParseDocument(text)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := Document{
+        Command:     rule.Command,
+        Description: "Ship the site",
+        Tags:        []string{"web", "prod"},
+        Needs:       []string{"build", "test"},
+        Shell:       "zsh",
+        Bottles: []BottleSetting{
+            {"env", "choices", "dev,prod"},
+            {"env", "prompt", "Where to?"},
+            {"host", "type", "hostname"},
+        },
+    }
+    if !reflect.DeepEqual(doc, want) {
+        t.Errorf("got %+v, want %+v", doc, want)
+    }
+}
+
+func TestParseDocument(t *testing.T) {
+    doc, err := ParseDocument("desc:\r\ntags: a, , b\r\n\r\n# a comment\r\nbottle: !token:env=TOKEN\r\n---\r\necho --- b%(!token)%b\r\n\r\n")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := Document{
+        Command: "echo --- b%(!token)%b",
+        Tags:    []string{"a", "b"},
+        Bottles: []BottleSetting{{"token", "env", "TOKEN"}},
+    }
+    if !reflect.DeepEqual(doc, want) {
+        t.Errorf("got %+v, want %+v", doc, want)
+    }
+
+    for text, message := range map[string]string{
+        "desc: x\necho hi\n":          "--- line",
+        "tags a\n---\necho hi\n":      "line 1 is not a setting",
+        "\nbottle: port\n---\necho\n": "line 2 should be written as 'bottle:",
+        "owner: me\n---\necho hi\n":   "sets 'owner'",
+    } {
+        if _, err := ParseDocument(text); err == nil || !strings.Contains(err.Error(), message) {
+            t.Errorf("%q: got %v, want an error about %s", text, err, message)
+        }
+    }
+}
+
+func TestSettleDocument(t *testing.T) {
+    text := FormatDocument(&Rule{Name: "gs", Command: "git status\n"})
+    if got := SettleDocument(text); got != "---\ngit status" {
+        t.Errorf("got %q", got)
+    }
+
+    // Below the --- line everything is part of the command
+    text = "# help\ntags: ci\ndesc:\n---\n# not a comment\n\nshell:\n"
+    if got := SettleDocument(text); got != "tags: ci\n---\n# not a comment\n\nshell:" {
+        t.Errorf("got %q", got)
+    }
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+    "encoding/json"
+    "fmt"
+    "html"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// ExportFormat is the version of the export file layout. Format 1 only had
+// "b:<name> = <command>:b" entries; format 2 writes "r:<rule>:r" lines
+// holding the whole rule as JSON, which older versions do not import rather
+// than import without their interpreter or the rules they need.
+const ExportFormat = 2
+
+// exportRegex matches one "r:<rule>:r" line, or one "b:<name> = <command>:b"
+// entry of a format 1 export file
+var exportRegex = regexp.MustCompile(`(?m)^r:(.*?):r\r?$|b:([^=]+) = (.*?):b`)
+
+// exportFormatRegex matches the header naming the format of an export file
+var exportFormatRegex = regexp.MustCompile(`(?m)^#abbtr export format (\d+)\r?$`)
+
+// profileExportRegex matches one "p:<profile>/<bottle> = <value>:p" line of
+// an export file
+var profileExportRegex = regexp.MustCompile(`(?m)^p:([^/=]+)/(.*?) = (.*?):p\r?$`)
+
+// entityRegex matches an ampersand that html.UnescapeString could take as
+// the start of a character reference
+var entityRegex = regexp.MustCompile(`&([A-Za-z0-9#])`)
+
+// ParseExport returns the rules found in the text of an export file, with
+// their metadata. Rules of format 1 files only have a name and a command.
+func ParseExport(text string) ([]Rule, error) {
+    if format := exportFormatOf(text); format > ExportFormat {
+        return nil, fmt.Errorf("the file uses export format %d, but this abbtr only reads up to format %d", format, ExportFormat)
+    }
+
+    var rules []Rule
+    matches := exportRegex.FindAllStringSubmatch(text, -1)
+    for _, match := range matches {
+        if match[2] == "" {
+            var rule Rule
+            err := json.Unmarshal([]byte(html.UnescapeString(match[1])), &rule)
+            if err != nil {
+                return nil, fmt.Errorf("invalid rule in the export: %v", err)
+            }
+            rules = append(rules, rule)
+            continue
+        }
+
+        ruleName := strings.TrimSpace(match[2])
+        ruleCommand := strings.TrimSpace(match[3])
+
+        // Replace HTML entities with their actual characters
+        ruleCommand = html.UnescapeString(ruleCommand)
+
+        rules = append(rules, Rule{Name: ruleName, Command: ruleCommand})
+    }
+
+    return rules, nil
+}
+
+// Candidate is a rule or a profile read from an export file, as it would be
+// imported
+type Candidate struct {
+    Name string
+    // Replaces tells that it takes the place of one with the same name,
+    // which is worth asking about
+    Replaces bool
+    // Err tells why it cannot be imported
+    Err error
+}
+
+// ImportCandidates checks the rules of an export file against the store, in
+// their order. Every rule needs a valid name, a new rule must pass checkNew
+// as well so it shadows nothing abbtr did not write.
+func (s *Store) ImportCandidates(rules []Rule, checkNew func(name string) error) []Candidate {
+    candidates := make([]Candidate, len(rules))
+    for i, rule := range rules {
+        candidate := Candidate{Name: rule.Name, Replaces: s.Find(rule.Name) != nil}
+        candidate.Err = ValidateName(rule.Name)
+        if candidate.Err == nil && !candidate.Replaces {
+            candidate.Err = checkNew(rule.Name)
+        }
+        candidates[i] = candidate
+    }
+    return candidates
+}
+
+// Export returns the lines of an export file holding the named rules as
+// stored, their metadata and references included, and the values profiles
+// give to their bottles. The second result tells whether profile values
+// were written, they may be secrets. Profiles may be nil.
+func Export(rules *Store, names []string, profiles *Profiles, comment string) ([]string, bool) {
+    lines := []string{ExportHeader()}
+    if comment != "" {
+        lines = append(lines, "#"+comment)
+    }
+    for _, name := range names {
+        if rule := rules.Find(name); rule != nil {
+            lines = append(lines, ExportLine(rule))
+        }
+    }
+    if profiles == nil {
+        return lines, false
+    }
+    values := profiles.ExportLines(rules, names)
+    return append(lines, values...), len(values) > 0
+}
+
+// ExportHeader returns the first line of an export file, naming its format
+func ExportHeader() string {
+    return fmt.Sprintf("#abbtr export format %d", ExportFormat)
+}
+
+// exportFormatOf returns the format declared by the text of an export file,
+// 1 for files written before the format was declared
+func exportFormatOf(text string) int {
+    match := exportFormatRegex.FindStringSubmatch(text)
+    if match == nil {
+        return 1
+    }
+    format, err := strconv.Atoi(match[1])
+    if err != nil {
+        return ExportFormat + 1
+    }
+    return format
+}
+
+// ParseProfileExport returns the bottle values of every profile found in the
+// text of an export file
+func ParseProfileExport(text string) *Profiles {
+    profiles := &Profiles{Version: ProfilesVersion, Profiles: make(map[string]map[string]string)}
+
+    for _, match := range profileExportRegex.FindAllStringSubmatch(text, -1) {
+        profile := strings.TrimSpace(match[1])
+        if profiles.Profiles[profile] == nil {
+            profiles.Profiles[profile] = make(map[string]string)
+        }
+        profiles.Profiles[profile][match[2]] = html.UnescapeString(strings.TrimSpace(match[3]))
+    }
+
+    return profiles
+}
+
+// ExportLine formats a rule and all of its metadata as a line of an export
+// file
+func ExportLine(rule *Rule) string {
+    var buf strings.Builder
+    encoder := json.NewEncoder(&buf)
+    encoder.SetEscapeHTML(false)
+    // A Rule always encodes, it only holds strings, slices, maps and times
+    encoder.Encode(rule)
+    data := strings.TrimRight(buf.String(), "\n")
+    // Escaping ":b" and ":p" too keeps the line from being read as another
+    // kind of entry
+    return fmt.Sprintf("r:%s:r", encode(data, ":r", ":b", ":p"))
+}
+
+// ProfileExportLine formats the value of a bottle in a profile as a line of
+// an export file
+func ProfileExportLine(profile, bottle, value string) string {
+    // Escaping ":b" too keeps the line from being read as a rule
+    return fmt.Sprintf("p:%s/%s = %s:p", profile, bottle, encode(value, ":p", ":b"))
+}
+
+// encode escapes text to be read back by html.UnescapeString from an entry
+// that ends with one of terminators
+func encode(text string, terminators ...string) string {
+    encoded := entityRegex.ReplaceAllString(text, "&amp;$1")
+    encoded = strings.Replace(encoded, "\r", "&#13;", -1)
+    encoded = strings.Replace(encoded, "\n", "&#10;", -1)
+    for _, terminator := range terminators {
+        encoded = strings.Replace(encoded, terminator, "&#58;"+terminator[1:], -1)
+    }
+
+    // Surrounding whitespace would be trimmed on import
+    start := len(encoded) - len(strings.TrimLeftFunc(encoded, unicode.IsSpace))
+    end := len(strings.TrimRightFunc(encoded, unicode.IsSpace))
+    if end < start {
+        end = start
+    }
+    var b strings.Builder
+    for _, r := range encoded[:start] {
+        fmt.Fprintf(&b, "&#%d;", r)
+    }
+    b.WriteString(encoded[start:end])
+    for _, r := range encoded[end:] {
+        fmt.Fprintf(&b, "&#%d;", r)
+    }
+
+    return b.String()
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+    "fmt"
+    "strings"
+)
+
+// CycleError is returned for rules that end up needing themselves
+type CycleError struct {
+    // Path lists the rules of the cycle, starting and ending with the same one
+    Path []string
+}
+
+func (e *CycleError) Error() string {
+    return "dependency cycle: " + strings.Join(e.Path, " -> ")
+}
+
+// Plan returns the rules to run for names, each once, every rule coming
+// after the rules it needs, or that the rules it refers to need. Rules keep
+// the order they were given in when nothing needs them to move.
+func (s *Store) Plan(names []string) ([]string, error) {
+    const (
+        visiting = 1
+        done     = 2
+    )
+    state := make(map[string]int)
+    var order, path []string
+
+    var visit func(name, neededBy string) error
+    visit = func(name, neededBy string) error {
+        switch state[name] {
+        case done:
+            return nil
+        case visiting:
+            start := 0
+            for path[start] != name {
+                start++
+            }
+            cycle := append(append([]string{}, path[start:]...), name)
+            return &CycleError{Path: cycle}
+        }
+
+        rule := s.Find(name)
+        if rule == nil {
+            if neededBy != "" {
+                return fmt.Errorf("rule '%s' needs '%s', which does not exist", neededBy, name)
+            }
+            return fmt.Errorf("rule '%s' not found", name)
+        }
+
+        state[name] = visiting
+        path = append(path, name)
+        for _, need := range s.needsOf(rule) {
+            err := visit(need, name)
+            if err != nil {
+                return err
+            }
+        }
+        path = path[:len(path)-1]
+        state[name] = done
+        order = append(order, name)
+        return nil
+    }
+
+    for _, name := range names {
+        err := visit(name, "")
+        if err != nil {
+            return nil, err
+        }
+    }
+    return order, nil
+}
+
+// needsOf returns the rules a rule needs followed by those needed by the
+// rules it refers to with @name, once each. A reference runs the command of
+// a rule, which is only complete once what that rule needs has run.
+func (s *Store) needsOf(rule *Rule) []string {
+    var needs []string
+    seen := map[string]bool{rule.Name: true}
+    var collect func(rule *Rule)
+    collect = func(rule *Rule) {
+        for _, need := range rule.Needs {
+            if !contains(needs, need) {
+                needs = append(needs, need)
+            }
+        }
+        for _, ref := range rule.Refs {
+            referenced := s.Find(ref)
+            if referenced != nil && !seen[ref] {
+                seen[ref] = true
+                collect(referenced)
+            }
+        }
+    }
+    collect(rule)
+    return needs
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestPlan(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "deploy", Needs: []string{"build", "test"}},
+        {Name: "test", Needs: []string{"build"}},
+        {Name: "build"},
+        {Name: "lint"},
+    }}
+
+    order, err := s.Plan([]string{"lint", "deploy", "build"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"lint", "build", "test", "deploy"}; !reflect.DeepEqual(order, want) {
+        t.Errorf("got %v, want %v", order, want)
+    }
+
+    _, err = s.Plan([]string{"nope"})
+    if err == nil || err.Error() != "rule 'nope' not found" {
+        t.Errorf("got %v", err)
+    }
+
+    s.Find("build").Needs = []string{"gone"}
+    _, err = s.Plan([]string{"deploy"})
+    if err == nil || err.Error() != "rule 'build' needs 'gone', which does not exist" {
+        t.Errorf("got %v", err)
+    }
+
+    s.Find("build").Needs = []string{"deploy"}
+    _, err = s.Plan([]string{"lint", "test"})
+    cycle, ok := err.(*CycleError)
+    if !ok || !reflect.DeepEqual(cycle.Path, []string{"build", "deploy", "build"}) {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestPlanReferences(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "gen", Command: "go generate"},
+        {Name: "build", Command: "make", Needs: []string{"gen"}},
+        {Name: "deploy", Command: "@build && echo deploy"},
+    }}
+    updateAllRefs(s)
+
+    // Running deploy runs the command of build, so build's needs come first
+    order, err := s.Plan([]string{"deploy"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"gen", "deploy"}; !reflect.DeepEqual(order, want) {
+        t.Errorf("got %v, want %v", order, want)
+    }
+    rule, err := s.Expand("deploy")
+    if err != nil || !reflect.DeepEqual(rule.Needs, []string{"gen"}) {
+        t.Errorf("got needs %v, %v", rule.Needs, err)
+    }
+    if len(s.Find("deploy").Needs) != 0 {
+        t.Error("the stored rule was changed")
+    }
+
+    s.Find("gen").Command = "@deploy"
+    s.UpdateRefs(s.Find("gen"))
+    _, err = s.Plan([]string{"deploy"})
+    if _, ok := err.(*CycleError); !ok {
+        t.Errorf("got %v", err)
+    }
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+
+    "abbtr/bottles"
+    "abbtr/internal/fsutil"
+)
+
+// ProfilesVersion is the schema version written to profiles.json
+const ProfilesVersion = 1
+
+// Profiles is the layout of profiles.json, which sits next to abbtr.conf and
+// holds named sets of bottle values. It is only readable by its owner since
+// the values may be secrets.
+type Profiles struct {
+    Version  int                          `json:"version"`
+    Profiles map[string]map[string]string `json:"profiles"`
+}
+
+// Names returns the profile names in alphabetical order
+func (p *Profiles) Names() []string {
+    names := make([]string, 0, len(p.Profiles))
+    for name := range p.Profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// ValidateProfileName keeps profile names usable as a single word and in the
+// "p:<profile>/<bottle>" lines of export files
+func ValidateProfileName(name string) error {
+    if name == "" || strings.ContainsAny(name, "/= \t\r\n") {
+        return fmt.Errorf("'%s' is not a valid profile name", name)
+    }
+    return nil
+}
+
+// ExportLines returns the export lines of the values for the bottles of the
+// named rules, given to all rules or scoped to one of them. When every rule
+// of the store is named every value is exported.
+func (p *Profiles) ExportLines(rules *Store, names []string) []string {
+    used := make(map[string]bool)
+    for _, name := range names {
+        rule, err := rules.Expand(name)
+        if err != nil {
+            continue
+        }
+        for _, bottle := range bottles.Parse(rule.Command) {
+            used[bottle.Name] = true
+            used[name+"."+bottle.Name] = true
+        }
+    }
+    all := true
+    for _, rule := range rules.Rules {
+        all = all && contains(names, rule.Name)
+    }
+
+    var lines []string
+    for _, profile := range p.Names() {
+        values := p.Profiles[profile]
+        bottleNames := make([]string, 0, len(values))
+        for bottle := range values {
+            bottleNames = append(bottleNames, bottle)
+        }
+        sort.Strings(bottleNames)
+        for _, bottle := range bottleNames {
+            if all || used[bottle] {
+                lines = append(lines, ProfileExportLine(profile, bottle, values[bottle]))
+            }
+        }
+    }
+    return lines
+}
+
+// ImportCandidates checks the profiles of an export file against p, in
+// alphabetical order
+func (p *Profiles) ImportCandidates(imported *Profiles) []Candidate {
+    var candidates []Candidate
+    for _, name := range imported.Names() {
+        _, exists := p.Profiles[name]
+        candidates = append(candidates, Candidate{Name: name, Replaces: exists, Err: ValidateProfileName(name)})
+    }
+    return candidates
+}
+
+// Merge saves the named profiles of imported in p, replacing those with the
+// same names
+func (p *Profiles) Merge(imported *Profiles, names []string) {
+    for _, name := range names {
+        if values, ok := imported.Profiles[name]; ok {
+            p.Profiles[name] = values
+        }
+    }
+}
+
+// RenameRule gives the values scoped to a rule, saved as <rule>.<bottle>,
+// to the rule it was renamed to. It reports whether any value moved.
+func (p *Profiles) RenameRule(name, newName string) bool {
+    moved := false
+    for _, values := range p.Profiles {
+        renamed := make(map[string]string)
+        for key, value := range values {
+            if bottle := strings.TrimPrefix(key, name+"."); bottle != key {
+                delete(values, key)
+                renamed[newName+"."+bottle] = value
+            }
+        }
+        for key, value := range renamed {
+            values[key] = value
+            moved = true
+        }
+    }
+    return moved
+}
+
+// RenameRuleValues renames the values of the profiles at path scoped to a
+// rule. The file is only written when one of them moved.
+func RenameRuleValues(path, name, newName string) error {
+    _, err := UpdateProfiles(path, func(p *Profiles) error {
+        if !p.RenameRule(name, newName) {
+            return ErrAborted
+        }
+        return nil
+    })
+    if err == ErrAborted {
+        return nil
+    }
+    return err
+}
+
+// ReadProfiles decodes the profiles at path. A missing file holds no profiles.
+func ReadProfiles(path string) (*Profiles, error) {
+    profiles := &Profiles{Version: ProfilesVersion, Profiles: make(map[string]map[string]string)}
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return profiles, nil
+        }
+        return nil, err
+    }
+    if strings.TrimSpace(string(data)) == "" {
+        return profiles, nil
+    }
+
+    err = json.Unmarshal(data, profiles)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    if profiles.Version > ProfilesVersion {
+        return nil, fmt.Errorf("%s uses schema version %d, but this abbtr only supports up to version %d", path, profiles.Version, ProfilesVersion)
+    }
+    if profiles.Profiles == nil {
+        profiles.Profiles = make(map[string]map[string]string)
+    }
+    return profiles, nil
+}
+
+// UpdateProfiles applies a change to the profiles at path while holding
+// their lock. Nothing is written if change fails.
+func UpdateProfiles(path string, change func(*Profiles) error) (*Profiles, error) {
+    unlock, err := fsutil.Lock(path)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+
+    profiles, err := ReadProfiles(path)
+    if err != nil {
+        return nil, err
+    }
+
+    err = change(profiles)
+    if err != nil {
+        return nil, err
+    }
+
+    profiles.Version = ProfilesVersion
+    data, err := json.MarshalIndent(profiles, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode profiles: %v", err)
+    }
+
+    err = fsutil.WriteFileAtomic(path, append(data, '\n'), 0600)
+    if err != nil {
+        return nil, err
+    }
+    return profiles, nil
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+
+    "abbtr/internal/corpus"
+)
+
+func TestProfilesRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "profiles.json")
+
+    profiles, err := ReadProfiles(path)
+    if err != nil || len(profiles.Profiles) != 0 {
+        t.Fatalf("got %+v, %v for a missing file", profiles, err)
+    }
+
+    want := map[string]string{"user": "deploy", "host": "prod1"}
+    _, err = UpdateProfiles(path, func(p *Profiles) error {
+        p.Profiles["prod"] = want
+        p.Profiles["staging"] = map[string]string{"user": "test"}
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    info, err := os.Stat(path)
+    if err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("profiles are not private: %v, %v", info.Mode(), err)
+    }
+
+    profiles, err = ReadProfiles(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(profiles.Profiles["prod"], want) || !reflect.DeepEqual(profiles.Names(), []string{"prod", "staging"}) {
+        t.Errorf("got %+v", profiles)
+    }
+
+    _, err = UpdateProfiles(path, func(p *Profiles) error { return ErrNotFound })
+    if err != ErrNotFound {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestRenameRuleValues(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "profiles.json")
+
+    // Nothing to move, nothing written
+    err := RenameRuleValues(path, "build", "compile")
+    if _, statErr := os.Stat(path); err != nil || !os.IsNotExist(statErr) {
+        t.Fatalf("got %v, %v", err, statErr)
+    }
+
+    _, err = UpdateProfiles(path, func(p *Profiles) error {
+        p.Profiles["prod"] = map[string]string{"build.host": "b1", "build2.host": "b2", "host": "h"}
+        p.Profiles["dev"] = map[string]string{"build.!token": "t"}
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = RenameRuleValues(path, "build", "compile")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    profiles, err := ReadProfiles(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]map[string]string{
+        "prod": {"compile.host": "b1", "build2.host": "b2", "host": "h"},
+        "dev":  {"compile.!token": "t"},
+    }
+    if !reflect.DeepEqual(profiles.Profiles, want) {
+        t.Errorf("got %v, want %v", profiles.Profiles, want)
+    }
+}
+
+func TestProfileExportRoundTrip(t *testing.T) {
+    text := "#comment\n" + ExportLine(&Rule{Name: "rule", Command: "ssh b%('host')%b"}) + "\n"
+    for _, tc := range corpus.Commands {
+        text += ProfileExportLine("prod", tc.Name, tc.Command) + "\n"
+    }
+
+    profiles := ParseProfileExport(text).Profiles
+    if len(profiles) != 1 || len(profiles["prod"]) != len(corpus.Commands) {
+        t.Fatalf("got %q from %q", profiles, text)
+    }
+    for _, tc := range corpus.Commands {
+        if got := profiles["prod"][tc.Name]; got != tc.Command {
+            t.Errorf("%s: got %q, want %q", tc.Name, got, tc.Command)
+        }
+    }
+
+    rules, err := ParseExport(text)
+    if err != nil || len(rules) != 1 || rules[0].Name != "rule" {
+        t.Errorf("profile lines read as rules: %+v", rules)
+    }
+}
+
+func TestProfileExportLines(t *testing.T) {
+    rules := &Store{Rules: []Rule{
+        {Name: "ssh", Command: "ssh b%('host')%b"},
+        {Name: "db", Command: "psql b%('!password')%b"},
+    }}
+    profiles := &Profiles{Profiles: map[string]map[string]string{
+        "prod":    {"host": "web1", "password": "s3cret", "db.password": "other"},
+        "staging": {"ssh.host": "stage1"},
+    }}
+
+    // Only the values the exported rules use travel with them
+    got := profiles.ExportLines(rules, []string{"ssh"})
+    want := []string{"p:prod/host = web1:p", "p:staging/ssh.host = stage1:p"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+    if got := profiles.ExportLines(rules, []string{"db", "ssh"}); len(got) != 4 {
+        t.Errorf("exporting every rule did not export every value: %q", got)
+    }
+}
+
+func TestProfileImport(t *testing.T) {
+    existing := &Profiles{Profiles: map[string]map[string]string{"prod": {"host": "old"}, "dev": {"host": "dev1"}}}
+    imported := &Profiles{Profiles: map[string]map[string]string{"prod": {"host": "new"}, "bad/name": {}, "qa": {"host": "qa1"}}}
+
+    candidates := existing.ImportCandidates(imported)
+    want := []Candidate{{Name: "bad/name", Err: ValidateProfileName("bad/name")}, {Name: "prod", Replaces: true}, {Name: "qa"}}
+    if !reflect.DeepEqual(candidates, want) {
+        t.Errorf("got %+v, want %+v", candidates, want)
+    }
+
+    existing.Merge(imported, []string{"qa"})
+    if existing.Profiles["prod"]["host"] != "old" || existing.Profiles["qa"]["host"] != "qa1" || existing.Profiles["dev"]["host"] != "dev1" {
+        t.Errorf("got %v", existing.Profiles)
+    }
+}
+
+func TestValidateProfileName(t *testing.T) {
+    for name, valid := range map[string]bool{"prod": true, "": false, "a/b": false, "a=b": false, "a b": false} {
+        if err := ValidateProfileName(name); (err == nil) != valid {
+            t.Errorf("%q: got %v", name, err)
+        }
+    }
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+
+    "abbtr/bottles"
+    "abbtr/internal/shell"
+)
+
+// ReferenceRegex matches a reference to another rule, as in @build, at the
+// start of a command or after a space or one of ;&|( so addresses like
+// user@example.com are left alone
+var ReferenceRegex = regexp.MustCompile(`(^|[\s;&|(])@([A-Za-z0-9_][A-Za-z0-9_.+-]*)`)
+
+// References returns the existing rules a command refers to, once each and
+// in order of appearance. Names that are not rules are not references.
+// Rules keep what it returned when their command was written in Refs.
+func (s *Store) References(command string) []string {
+    var names []string
+    seen := make(map[string]bool)
+    for _, match := range ReferenceRegex.FindAllStringSubmatch(command, -1) {
+        name := match[2]
+        if !seen[name] && s.Find(name) != nil {
+            seen[name] = true
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// UpdateRefs records the rules the command of a rule refers to, as they are
+// now. Rules created later under a name written after an @ in the command do
+// not become references. Only rules run by a shell have references, in
+// python3 or perl an @ is part of the language, as in @ARGV.
+func (s *Store) UpdateRefs(rule *Rule) {
+    rule.Refs = nil
+    if shell.IsShell(s.ShellOf(rule)) {
+        rule.Refs = s.References(rule.Command)
+    }
+}
+
+// Dependents returns the rules that refer to or need the named rule, in
+// store order
+func (s *Store) Dependents(name string) []string {
+    var names []string
+    for _, rule := range s.Rules {
+        if rule.Name != name && (contains(rule.Needs, name) || contains(rule.Refs, name)) {
+            names = append(names, rule.Name)
+        }
+    }
+    return names
+}
+
+// Mentions returns the rules whose command holds @name without it being one
+// of their references, as when a rule takes a name that already appeared in
+// the text of others
+func (s *Store) Mentions(name string) []string {
+    var names []string
+    for _, rule := range s.Rules {
+        if rule.Name == name || contains(rule.Refs, name) || !shell.IsShell(s.ShellOf(&rule)) {
+            continue
+        }
+        for _, match := range ReferenceRegex.FindAllStringSubmatch(rule.Command, -1) {
+            if match[2] == name {
+                names = append(names, rule.Name)
+                break
+            }
+        }
+    }
+    return names
+}
+
+// Expand returns a copy of a rule whose references are replaced by the
+// commands of the rules they name, themselves expanded, each run in a
+// subshell. The bottle specs of the referenced rules apply unless the rule
+// declares its own, and so do their needs. The copy has its Shell set from
+// the default of the store and the rules it refers to must use the same one.
+func (s *Store) Expand(name string) (*Rule, error) {
+    rule := s.Find(name)
+    if rule == nil {
+        return nil, ErrNotFound
+    }
+
+    expanded := *rule
+    specs := make(map[string]bottles.Spec, len(rule.Bottles))
+    for bottle, spec := range rule.Bottles {
+        specs[bottle] = spec
+    }
+
+    expanded.Shell = s.ShellOf(rule)
+    if len(rule.Refs) > 0 && !shell.IsShell(expanded.Shell) {
+        return nil, fmt.Errorf("rule '%s' refers to other rules, which only works in rules run by a shell, not %s", name, expanded.Shell)
+    }
+    command, err := s.expand(rule, []string{name}, specs, expanded.Shell)
+    if err != nil {
+        return nil, err
+    }
+    expanded.Command = command
+    expanded.Needs = s.needsOf(rule)
+    expanded.Bottles = nil
+    if len(specs) > 0 {
+        expanded.Bottles = specs
+    }
+    return &expanded, nil
+}
+
+// ExpandAll returns every rule expanded as its script runs it, so the
+// scripts need no abbtr. A rule that cannot be expanded is returned as
+// stored.
+func (s *Store) ExpandAll() []Rule {
+    expanded := make([]Rule, len(s.Rules))
+    for i, rule := range s.Rules {
+        expanded[i] = rule
+        if full, err := s.Expand(rule.Name); err == nil {
+            expanded[i] = *full
+        }
+    }
+    return expanded
+}
+
+// ShellOf returns the interpreter of a rule, empty for bash
+func (s *Store) ShellOf(rule *Rule) string {
+    interpreter := rule.Shell
+    if interpreter == "" {
+        interpreter = s.Shell
+    }
+    if interpreter == "bash" {
+        return ""
+    }
+    return interpreter
+}
+
+// expand replaces the references in the command of owner. path holds the
+// rules being expanded, to stop at cycles, and interpreter the one running
+// them all.
+func (s *Store) expand(owner *Rule, path []string, specs map[string]bottles.Spec, interpreter string) (string, error) {
+    var err error
+    expanded := ReferenceRegex.ReplaceAllStringFunc(owner.Command, func(match string) string {
+        groups := ReferenceRegex.FindStringSubmatch(match)
+        if err != nil || !contains(owner.Refs, groups[2]) {
+            return match
+        }
+        rule := s.Find(groups[2])
+        if rule == nil {
+            return match
+        }
+        for i, name := range path {
+            if name == rule.Name {
+                cycle := append(append([]string{}, path[i:]...), rule.Name)
+                err = &CycleError{Path: cycle}
+                return match
+            }
+        }
+        if other := s.ShellOf(rule); other != interpreter {
+            err = fmt.Errorf("rule '%s' runs with %s, it cannot be used by '%s' which runs with %s", rule.Name, shellName(other), path[0], shellName(interpreter))
+            return match
+        }
+
+        for bottle, spec := range rule.Bottles {
+            if _, ok := specs[bottle]; !ok {
+                specs[bottle] = spec
+            }
+        }
+        inner, innerErr := s.expand(rule, append(append([]string{}, path...), rule.Name), specs, interpreter)
+        if innerErr != nil {
+            err = innerErr
+            return match
+        }
+        return groups[1] + subshell(inner)
+    })
+    return expanded, err
+}
+
+// renameReferences makes the references to a rule in command use its new
+// name
+func renameReferences(command, name, newName string) string {
+    return ReferenceRegex.ReplaceAllStringFunc(command, func(match string) string {
+        groups := ReferenceRegex.FindStringSubmatch(match)
+        if groups[2] != name {
+            return match
+        }
+        return groups[1] + "@" + newName
+    })
+}
+
+func contains(names []string, name string) bool {
+    for _, n := range names {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
+
+func shellName(interpreter string) string {
+    if interpreter == "" {
+        return "bash"
+    }
+    return interpreter
+}
+
+// subshell wraps a command so it runs on its own whatever surrounds it. A
+// comment in the command must not swallow the closing parenthesis.
+func subshell(command string) string {
+    if strings.ContainsAny(command, "#\n") {
+        return "( " + command + "\n)"
+    }
+    return "( " + command + " )"
+}
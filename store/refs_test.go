@@ -0,0 +1,211 @@
+package store
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+
+    "abbtr/bottles"
+)
+
+func TestExpand(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "build", Command: "make # everything", Bottles: map[string]bottles.Spec{"target": {Type: "path"}}},
+        {Name: "test", Command: "@build && go test"},
+        {Name: "ship", Command: "@test&&rsync -a out/ user@example.com:@build @nope"},
+    }}
+    updateAllRefs(s)
+
+    if refs := s.References(s.Find("ship").Command); !reflect.DeepEqual(refs, []string{"test"}) {
+        t.Errorf("got references %v", refs)
+    }
+
+    rule, err := s.Expand("ship")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := "( ( make # everything\n) && go test\n)&&rsync -a out/ user@example.com:@build @nope"
+    if rule.Command != want {
+        t.Errorf("got %q, want %q", rule.Command, want)
+    }
+    if rule.Bottles["target"].Type != "path" {
+        t.Errorf("the specs of build were not kept: %v", rule.Bottles)
+    }
+    if s.Find("ship").Command != "@test&&rsync -a out/ user@example.com:@build @nope" {
+        t.Error("the stored rule was changed")
+    }
+
+    if deps := s.Dependents("build"); !reflect.DeepEqual(deps, []string{"test"}) {
+        t.Errorf("got dependents %v", deps)
+    }
+
+    s.Find("build").Command = "make; @ship"
+    s.UpdateRefs(s.Find("build"))
+    _, err = s.Expand("test")
+    cycle, ok := err.(*CycleError)
+    if !ok || !reflect.DeepEqual(cycle.Path, []string{"test", "build", "ship", "test"}) {
+        t.Errorf("got %v", err)
+    }
+}
+
+func TestExpandShell(t *testing.T) {
+    s := &Store{Shell: "zsh", Rules: []Rule{
+        {Name: "setup", Command: "setopt extendedglob"},
+        {Name: "build", Command: "@setup; make", Shell: "zsh"},
+        {Name: "report", Command: "print(1)", Shell: "python3"},
+        {Name: "all", Command: "@build && @report"},
+    }}
+    updateAllRefs(s)
+
+    rule, err := s.Expand("build")
+    if err != nil || rule.Shell != "zsh" {
+        t.Errorf("got %+v, %v", rule, err)
+    }
+
+    _, err = s.Expand("all")
+    if err == nil || err.Error() != "rule 'report' runs with python3, it cannot be used by 'all' which runs with zsh" {
+        t.Errorf("got %v", err)
+    }
+
+    s.Shell = "bash"
+    if rule, _ := s.Expand("setup"); rule.Shell != "" {
+        t.Errorf("bash was not the default: %q", rule.Shell)
+    }
+}
+
+func TestRenameAndCopy(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "build", Command: "make", Tags: []string{"ci"}, Bottles: map[string]bottles.Spec{"target": {Type: "path"}}},
+        {Name: "test", Command: "@build && go test; echo @build.log @builder", Needs: []string{"lint", "build"}},
+        {Name: "lint", Command: "go vet"},
+    }}
+    updateAllRefs(s)
+
+    if err := s.Rename("build", "compile"); err != nil || s.Find("build") != nil || s.Find("compile") == nil {
+        t.Fatalf("the rule was not renamed: %v, %v", s.Names(), err)
+    }
+    if names := s.Names(); !reflect.DeepEqual(names, []string{"compile", "test", "lint"}) {
+        t.Errorf("the rule moved: %v", names)
+    }
+    test := s.Find("test")
+    if test.Command != "@compile && go test; echo @build.log @builder" {
+        t.Errorf("got %q", test.Command)
+    }
+    if !reflect.DeepEqual(test.Needs, []string{"lint", "compile"}) {
+        t.Errorf("got needs %v", test.Needs)
+    }
+    if err := s.Rename("nope", "other"); err != ErrNotFound {
+        t.Errorf("a missing rule was renamed: %v", err)
+    }
+    if err := s.Rename("compile", "lint"); err != ErrExists || s.Find("compile") == nil {
+        t.Errorf("a rule was renamed over another: %v", err)
+    }
+
+    if _, err := s.Copy("compile", "test"); err != ErrExists {
+        t.Errorf("a rule was copied over another: %v", err)
+    }
+    if _, err := s.Copy("nope", "other"); err != ErrNotFound {
+        t.Errorf("a missing rule was copied: %v", err)
+    }
+    copied, err := s.Copy("compile", "compile2")
+    if err != nil || copied.Command != "make" || copied.Bottles["target"].Type != "path" || !reflect.DeepEqual(copied.Tags, []string{"ci"}) {
+        t.Fatalf("got %+v", copied)
+    }
+    copied.Tags[0] = "changed"
+    if s.Find("compile").Tags[0] != "ci" {
+        t.Error("the copy shares its tags with the original")
+    }
+}
+
+func TestExpandAll(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "build", Command: "make"},
+        {Name: "ship", Command: "@build && rsync"},
+        {Name: "plot", Command: "@build", Shell: "python3"},
+    }}
+    updateAllRefs(s)
+
+    expanded := s.ExpandAll()
+    if len(expanded) != 3 || expanded[1].Command != "( make ) && rsync" {
+        t.Fatalf("got %+v", expanded)
+    }
+    // A rule that cannot be expanded keeps its command
+    if expanded[2].Command != "@build" {
+        t.Errorf("got %q", expanded[2].Command)
+    }
+    if s.Find("ship").Command != "@build && rsync" {
+        t.Error("the stored rule was changed")
+    }
+}
+
+func TestRefsAreResolvedOnce(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "inst", Command: "echo npm install @types/node"},
+        {Name: "build", Command: "make"},
+        {Name: "ship", Command: "@build && echo @deploy"},
+    }}
+    updateAllRefs(s)
+
+    // Rules created afterwards do not take over the text of others
+    s.Add("types", "echo OOPS")
+    s.Add("deploy", "echo deploying")
+    for _, name := range []string{"inst", "ship"} {
+        rule, err := s.Expand(name)
+        if err != nil || strings.Contains(rule.Command, "OOPS") || strings.Contains(rule.Command, "deploying") {
+            t.Errorf("got %+v, %v", rule, err)
+        }
+    }
+    if deps := s.Dependents("types"); len(deps) != 0 {
+        t.Errorf("got dependents %v", deps)
+    }
+    if mentions := s.Mentions("types"); !reflect.DeepEqual(mentions, []string{"inst"}) {
+        t.Errorf("got mentions %v", mentions)
+    }
+
+    // A rule deleted and created again is no longer referred to
+    s.Remove("build")
+    s.Add("build", "echo other")
+    if rule, _ := s.Expand("ship"); rule.Command != "@build && echo @deploy" {
+        t.Errorf("got %q", rule.Command)
+    }
+}
+
+func TestInterpretersWithoutRefs(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "files", Command: "ls"},
+        {Name: "count", Command: `my @files = @ARGV; print scalar(@files), "\n"; @files`, Shell: "perl"},
+        {Name: "first", Command: "import sys; print(sys.argv[1:]) # @files", Shell: "python3"},
+    }}
+    updateAllRefs(s)
+
+    for _, name := range []string{"count", "first"} {
+        rule := s.Find(name)
+        if rule.Refs != nil {
+            t.Errorf("%s: got refs %v", name, rule.Refs)
+        }
+        expanded, err := s.Expand(name)
+        if err != nil || expanded.Command != rule.Command {
+            t.Errorf("%s: got %+v, %v", name, expanded, err)
+        }
+    }
+    if deps := s.Dependents("files"); len(deps) != 0 {
+        t.Errorf("got dependents %v", deps)
+    }
+    if mentions := s.Mentions("files"); len(mentions) != 0 {
+        t.Errorf("got mentions %v", mentions)
+    }
+
+    // References recorded while the rule ran with a shell stop it from
+    // running with another interpreter
+    s.UpdateRefs(s.Add("ship", "@files"))
+    s.Shell = "perl"
+    if _, err := s.Expand("ship"); err == nil || !strings.Contains(err.Error(), "only works in rules run by a shell") {
+        t.Errorf("got %v", err)
+    }
+}
+
+func updateAllRefs(s *Store) {
+    for i := range s.Rules {
+        s.UpdateRefs(&s.Rules[i])
+    }
+}
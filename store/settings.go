@@ -0,0 +1,118 @@
+package store
+
+import (
+    "fmt"
+    "time"
+
+    "abbtr/bottles"
+    "abbtr/internal/shell"
+)
+
+// Settings are the settings of a rule given with -n, -c or --edit besides
+// its command. A nil field leaves the setting unchanged.
+type Settings struct {
+    Description *string
+    Tags        *[]string
+    Needs       *[]string
+    Shell       *string
+    Bottles     []BottleSetting
+    // ResetBottles drops the existing bottle specs before Bottles apply
+    ResetBottles bool
+}
+
+// Settings returns the settings written in an --edit document. Settings
+// left out are cleared, as the document describes the whole rule.
+func (d Document) Settings() Settings {
+    return Settings{
+        Description:  &d.Description,
+        Tags:         &d.Tags,
+        Needs:        &d.Needs,
+        Shell:        &d.Shell,
+        Bottles:      d.Bottles,
+        ResetBottles: true,
+    }
+}
+
+// Check makes sure the bottle attributes can be applied to a rule running
+// command, and that its interpreter is installed
+func (s Settings) Check(command string) error {
+    if s.Shell != nil && *s.Shell != "" {
+        err := shell.CheckShell(*s.Shell)
+        if err != nil {
+            return err
+        }
+    }
+
+    declared := make(map[string]bool)
+    for _, bottle := range bottles.Parse(command) {
+        declared[bottle.Name] = true
+    }
+    for _, b := range s.Bottles {
+        if !declared[b.Bottle] {
+            return fmt.Errorf("the command has no bottle named '%s'", b.Bottle)
+        }
+        var spec bottles.Spec
+        err := spec.Set(b.Attr, b.Value)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Apply sets the settings on a rule whose command is already up to date.
+// Specs of bottles the command no longer uses are dropped.
+func (s Settings) Apply(rule *Rule) {
+    if s.Description != nil {
+        rule.Description = *s.Description
+    }
+    if s.Tags != nil {
+        rule.Tags = *s.Tags
+    }
+    if s.Needs != nil {
+        rule.Needs = *s.Needs
+    }
+    if s.Shell != nil {
+        rule.Shell = *s.Shell
+    }
+    if s.ResetBottles {
+        rule.Bottles = nil
+    }
+
+    for _, b := range s.Bottles {
+        if rule.Bottles == nil {
+            rule.Bottles = make(map[string]bottles.Spec)
+        }
+        spec := rule.Bottles[b.Bottle]
+        spec.Set(b.Attr, b.Value)
+        rule.Bottles[b.Bottle] = spec
+    }
+
+    declared := make(map[string]bool)
+    for _, bottle := range bottles.Parse(rule.Command) {
+        declared[bottle.Name] = true
+    }
+    for name, spec := range rule.Bottles {
+        if !declared[name] || spec.IsZero() {
+            delete(rule.Bottles, name)
+        }
+    }
+    if len(rule.Bottles) == 0 {
+        rule.Bottles = nil
+    }
+}
+
+// Set gives the rule with this name a new command and settings, adding it
+// when it does not exist, and records the references of its command
+func (s *Store) Set(name, command string, settings Settings) *Rule {
+    rule := s.Find(name)
+    if rule == nil {
+        rule = s.Add(name, command)
+    } else {
+        rule.Command = command
+        rule.Updated = time.Now()
+    }
+    settings.Apply(rule)
+    s.UpdateRefs(rule)
+    return rule
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+
+    "abbtr/bottles"
+)
+
+func TestSettingsCheck(t *testing.T) {
+    perl, missing := "perl", "no-such-interpreter"
+    tests := []struct {
+        settings Settings
+        message  string
+    }{
+        {Settings{Shell: &perl, Bottles: []BottleSetting{{"port", "type", "port"}}}, ""},
+        {Settings{Shell: &missing}, "was not found"},
+        {Settings{Bottles: []BottleSetting{{"host", "type", "hostname"}}}, "no bottle named 'host'"},
+        {Settings{Bottles: []BottleSetting{{"port", "type", "colour"}}}, "colour"},
+    }
+
+    for _, tc := range tests {
+        err := tc.settings.Check("ssh -p b%('port')%b example.com")
+        if tc.message == "" && err != nil || tc.message != "" && (err == nil || !strings.Contains(err.Error(), tc.message)) {
+            t.Errorf("%+v: got %v, want an error about %q", tc.settings, err, tc.message)
+        }
+    }
+}
+
+func TestSettingsApply(t *testing.T) {
+    rule := &Rule{
+        Name:        "ssh",
+        Command:     "ssh -p b%('port')%b b%('host')%b",
+        Description: "Connect",
+        Tags:        []string{"net"},
+        Bottles:     map[string]bottles.Spec{"port": {Type: "port"}, "gone": {Type: "int"}},
+    }
+
+    // Nil fields are left alone and specs of bottles not in the command go
+    tags := []string{"remote"}
+    Settings{Tags: &tags, Bottles: []BottleSetting{{"host", "type", "hostname"}}}.Apply(rule)
+    want := map[string]bottles.Spec{"port": {Type: "port"}, "host": {Type: "hostname"}}
+    if rule.Description != "Connect" || !reflect.DeepEqual(rule.Tags, tags) || !reflect.DeepEqual(rule.Bottles, want) {
+        t.Errorf("got %+v", rule)
+    }
+
+    // A document replaces every setting
+    doc, err := ParseDocument("tags: a\nbottle: port:prompt=Port?\n---\n" + rule.Command)
+    if err != nil {
+        t.Fatal(err)
+    }
+    doc.Settings().Apply(rule)
+    want = map[string]bottles.Spec{"port": {Prompt: "Port?"}}
+    if rule.Description != "" || !reflect.DeepEqual(rule.Tags, []string{"a"}) || !reflect.DeepEqual(rule.Bottles, want) {
+        t.Errorf("got %+v", rule)
+    }
+}
+
+func TestStoreSet(t *testing.T) {
+    s := &Store{Rules: []Rule{{Name: "build", Command: "make"}}}
+
+    desc := "Ship it"
+    rule := s.Set("ship", "@build && rsync", Settings{Description: &desc})
+    if rule != s.Find("ship") || rule.Description != desc || !reflect.DeepEqual(rule.Refs, []string{"build"}) || rule.Created.IsZero() {
+        t.Errorf("got %+v", rule)
+    }
+
+    // Settings left out are kept
+    rule = s.Set("ship", "rsync", Settings{})
+    if rule.Command != "rsync" || rule.Description != desc || rule.Refs != nil || len(s.Rules) != 2 {
+        t.Errorf("got %+v", rule)
+    }
+}
@@ -0,0 +1,558 @@
+// Package store reads and writes abbtr.conf, the versioned JSON document
+// holding every rule and its metadata, and the bottle profiles kept next to
+// it.
+package store
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    "unicode"
+
+    "abbtr/bottles"
+    "abbtr/internal/fsutil"
+)
+
+// Version is the schema version written to abbtr.conf. Bump it and register
+// a migration in migrations whenever the layout changes.
+const Version = 5
+
+// ErrNotFound is returned for rules that do not exist. Update callbacks
+// return it to abandon a change to a rule that is missing.
+var ErrNotFound = errors.New("rule not found")
+
+// ErrAborted is returned by Update callbacks abandoning a change for any
+// other reason they report themselves, such as a name already taken
+var ErrAborted = errors.New("change abandoned")
+
+// ErrExists is returned when a rule is given a name another rule has
+var ErrExists = errors.New("rule already exists")
+
+// Rule is a single abbreviation stored in abbtr.conf
+type Rule struct {
+    Name        string    `json:"name"`
+    Command     string    `json:"command"`
+    Description string    `json:"description,omitempty"`
+    Tags        []string  `json:"tags,omitempty"`
+    Created     time.Time `json:"created"`
+    Updated     time.Time `json:"updated"`
+
+    // Bottles holds what the rule declared about the values its bottles
+    // accept, by bottle name
+    Bottles map[string]bottles.Spec `json:"bottles,omitempty"`
+
+    // Needs names the rules that run, and must pass, before this one
+    Needs []string `json:"needs,omitempty"`
+
+    // Refs names the rules the command refers to with @name, as resolved
+    // when the command was written. Other @words are left as they are.
+    Refs []string `json:"refs,omitempty"`
+
+    // Shell is the interpreter running the command, such as zsh or
+    // python3. Empty means the default of the store.
+    Shell string `json:"shell,omitempty"`
+}
+
+// Multiline reports whether the command of the rule is a script of several
+// lines. Such commands find their arguments in $1, $2... instead of having
+// them appended to their last line.
+func (r *Rule) Multiline() bool {
+    return strings.Contains(r.Command, "\n")
+}
+
+// SecretBottles returns the names of the secret bottles of the rules, also
+// in their <rule>.<bottle> form
+func SecretBottles(rules []*Rule) map[string]bool {
+    secrets := make(map[string]bool)
+    for _, rule := range rules {
+        for _, bottle := range bottles.Parse(rule.Command) {
+            if bottle.Secret {
+                secrets[bottle.Name] = true
+                secrets[rule.Name+"."+bottle.Name] = true
+            }
+        }
+    }
+    return secrets
+}
+
+// Store is the layout of abbtr.conf
+type Store struct {
+    Version int    `json:"version"`
+    Rules   []Rule `json:"rules"`
+    // Shell is the interpreter of the rules that name none, bash when empty
+    Shell string `json:"shell,omitempty"`
+
+    // Duplicates lists the names defined more than once in the file. Only
+    // the first definition is kept.
+    Duplicates []string `json:"-"`
+
+    index map[string]int
+}
+
+// migrations upgrade a store from the version used as key to the next one.
+// Version 0 is the legacy "name = command" text file, which is handled by
+// ParseLegacy before any JSON is decoded.
+var migrations = map[int]func(*Store) error{
+    // Version 2 added bottle specs to the rules. Nothing to convert, the
+    // version only keeps older abbtr from dropping them when saving.
+    1: func(*Store) error { return nil },
+    // Version 3 added the rules a rule needs, nothing to convert either
+    2: func(*Store) error { return nil },
+    // Version 4 added the interpreter of the rules and its default
+    3: func(*Store) error { return nil },
+    // Version 5 records the references of each rule, which used to be
+    // looked up every time a rule ran
+    4: func(s *Store) error {
+        for i := range s.Rules {
+            s.UpdateRefs(&s.Rules[i])
+        }
+        return nil
+    },
+}
+
+// Migration describes an upgrade that Read did in memory and that still has
+// to be written
+type Migration struct {
+    From int
+    To   int
+    // Legacy holds the original file when it used the flat text format
+    Legacy     []byte
+    BackupPath string
+}
+
+// Find returns the rule with exactly this name, or nil
+func (s *Store) Find(name string) *Rule {
+    if s.index == nil {
+        s.Reindex()
+    }
+    if i, ok := s.index[name]; ok {
+        return &s.Rules[i]
+    }
+    return nil
+}
+
+// Add appends a new rule. The caller checks that the name is free.
+func (s *Store) Add(name, command string) *Rule {
+    if s.index == nil {
+        s.Reindex()
+    }
+    now := time.Now()
+    s.Rules = append(s.Rules, Rule{Name: name, Command: command, Created: now, Updated: now})
+    s.index[name] = len(s.Rules) - 1
+    return &s.Rules[len(s.Rules)-1]
+}
+
+// Put adds a rule with all of its metadata, or replaces the rule with the
+// same name while keeping its creation date. Either way the rule is marked
+// as updated now; a new rule keeps the creation date it comes with, if any.
+func (s *Store) Put(rule Rule) *Rule {
+    now := time.Now()
+    stored := s.Find(rule.Name)
+    if stored == nil {
+        stored = s.Add(rule.Name, rule.Command)
+    } else {
+        rule.Created = stored.Created
+    }
+    if rule.Created.IsZero() {
+        rule.Created = now
+    }
+    rule.Updated = now
+    *stored = rule
+    return stored
+}
+
+// Remove deletes a rule and reports whether it existed. The rules referring
+// to it keep the @name in their command as plain text, so a rule created
+// later under the same name does not take its place.
+func (s *Store) Remove(name string) bool {
+    if s.index == nil {
+        s.Reindex()
+    }
+    i, ok := s.index[name]
+    if !ok {
+        return false
+    }
+    s.Rules = append(s.Rules[:i], s.Rules[i+1:]...)
+    for i := range s.Rules {
+        rule := &s.Rules[i]
+        for j, ref := range rule.Refs {
+            if ref == name {
+                rule.Refs = append(rule.Refs[:j:j], rule.Refs[j+1:]...)
+                break
+            }
+        }
+        if len(rule.Refs) == 0 {
+            rule.Refs = nil
+        }
+    }
+    s.Reindex()
+    return true
+}
+
+// Delete removes the named rules. Unless forced, a rule that other rules
+// refer to or need is kept, except when those are deleted as well.
+func (s *Store) Delete(names []string, force bool) *Deletion {
+    deletion := &Deletion{Blocked: make(map[string][]string)}
+    deleting := make(map[string]bool)
+    for _, name := range names {
+        if s.Find(name) == nil || deleting[name] {
+            deletion.Missing = append(deletion.Missing, name)
+            continue
+        }
+        deleting[name] = true
+    }
+
+    // A rule kept keeps the rules it uses in turn
+    for changed := !force; changed; {
+        changed = false
+        for _, name := range names {
+            if users := s.usersBesides(name, deleting); deleting[name] && len(users) > 0 {
+                delete(deleting, name)
+                deletion.Blocked[name] = users
+                changed = true
+            }
+        }
+    }
+
+    orphaned := make(map[string]bool)
+    for _, name := range names {
+        if !deleting[name] {
+            continue
+        }
+        for _, user := range s.usersBesides(name, deleting) {
+            if !orphaned[user] {
+                orphaned[user] = true
+                deletion.Orphaned = append(deletion.Orphaned, user)
+            }
+        }
+    }
+    for _, name := range names {
+        if deleting[name] {
+            s.Remove(name)
+            deletion.Deleted = append(deletion.Deleted, name)
+            delete(deleting, name)
+        }
+    }
+    return deletion
+}
+
+// usersBesides returns the rules using a rule that are not in deleting
+func (s *Store) usersBesides(name string, deleting map[string]bool) []string {
+    var users []string
+    for _, user := range s.Dependents(name) {
+        if !deleting[user] {
+            users = append(users, user)
+        }
+    }
+    return users
+}
+
+// Deletion tells what Delete did with each of the names it was given
+type Deletion struct {
+    Deleted []string
+    // Missing lists the names no rule has
+    Missing []string
+    // Blocked holds the rules kept, with the rules using them
+    Blocked map[string][]string
+    // Orphaned lists the rules left using a rule deleted by force
+    Orphaned []string
+}
+
+// Rename gives a rule a new name, keeping its place and metadata, and makes
+// the rules needing it or referring to it use the new name. It returns
+// ErrNotFound or ErrExists when either name is not the one expected.
+func (s *Store) Rename(name, newName string) error {
+    rule := s.Find(name)
+    if rule == nil {
+        return ErrNotFound
+    }
+    if s.Find(newName) != nil {
+        return ErrExists
+    }
+    now := time.Now()
+    rule.Name = newName
+    rule.Updated = now
+
+    for i := range s.Rules {
+        other := &s.Rules[i]
+        changed := false
+        for j, need := range other.Needs {
+            if need == name {
+                other.Needs[j] = newName
+                changed = true
+            }
+        }
+        for j, ref := range other.Refs {
+            if ref == name {
+                other.Refs[j] = newName
+                other.Command = renameReferences(other.Command, name, newName)
+                changed = true
+            }
+        }
+        if changed {
+            other.Updated = now
+        }
+    }
+    s.Reindex()
+    return nil
+}
+
+// Copy adds a rule named newName with the command and metadata of a rule.
+// It returns ErrNotFound or ErrExists when either name is not the one
+// expected.
+func (s *Store) Copy(name, newName string) (*Rule, error) {
+    if s.Find(newName) != nil {
+        return nil, ErrExists
+    }
+    rule := s.Find(name)
+    if rule == nil {
+        return nil, ErrNotFound
+    }
+    // Add may move the rules, so take what is needed first
+    source := rule.clone()
+    copied := s.Add(newName, source.Command)
+    source.Name, source.Created, source.Updated = copied.Name, copied.Created, copied.Updated
+    *copied = source
+    return copied, nil
+}
+
+// Clone returns a copy of the store that can be changed without touching
+// the original, as when trying a change before writing it
+func (s *Store) Clone() *Store {
+    clone := &Store{Version: s.Version, Shell: s.Shell, Rules: make([]Rule, len(s.Rules))}
+    for i := range s.Rules {
+        clone.Rules[i] = s.Rules[i].clone()
+    }
+    return clone
+}
+
+// Import puts rules read from an export file in the store. The references
+// they recorded name rules of the machine they were exported from, they
+// are resolved again once every rule is in place.
+func (s *Store) Import(rules []Rule) {
+    for _, rule := range rules {
+        s.Put(rule)
+    }
+    for _, rule := range rules {
+        s.UpdateRefs(s.Find(rule.Name))
+    }
+}
+
+// clone returns a copy of the rule sharing no slice or map with it
+func (r *Rule) clone() Rule {
+    clone := *r
+    clone.Tags = append([]string(nil), r.Tags...)
+    clone.Needs = append([]string(nil), r.Needs...)
+    clone.Refs = append([]string(nil), r.Refs...)
+    if r.Bottles != nil {
+        clone.Bottles = make(map[string]bottles.Spec, len(r.Bottles))
+        for bottle, spec := range r.Bottles {
+            clone.Bottles[bottle] = spec
+        }
+    }
+    return clone
+}
+
+// Clear removes every rule
+func (s *Store) Clear() {
+    s.Rules = nil
+    s.Reindex()
+}
+
+// Names returns the rule names in store order
+func (s *Store) Names() []string {
+    names := make([]string, 0, len(s.Rules))
+    for _, rule := range s.Rules {
+        names = append(names, rule.Name)
+    }
+    return names
+}
+
+// Reindex rebuilds the name index. Rules repeating an earlier name are
+// dropped and their names returned.
+func (s *Store) Reindex() []string {
+    var duplicates []string
+    s.index = make(map[string]int, len(s.Rules))
+    rules := s.Rules[:0]
+    for _, rule := range s.Rules {
+        if _, ok := s.index[rule.Name]; ok {
+            duplicates = append(duplicates, rule.Name)
+            continue
+        }
+        s.index[rule.Name] = len(rules)
+        rules = append(rules, rule)
+    }
+    s.Rules = rules
+    return duplicates
+}
+
+// Load reads the store at path, writing it back first if it had to be
+// migrated. The migration, if any, is returned so it can be reported.
+func Load(path string) (*Store, *Migration, error) {
+    store, migration, err := Read(path)
+    if err != nil || migration == nil {
+        return store, migration, err
+    }
+
+    // Converting the file is a write like any other
+    return Update(path, func(*Store) error { return nil })
+}
+
+// Update applies a change to the store at path while holding its lock, so
+// concurrent abbtr processes never lose each other's changes. The file is
+// read again once the lock is held and nothing is written if change fails.
+func Update(path string, change func(*Store) error) (*Store, *Migration, error) {
+    unlock, err := fsutil.Lock(path)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer unlock()
+
+    store, migration, err := Read(path)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    err = change(store)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if migration != nil && migration.Legacy != nil {
+        err = fsutil.WriteFileAtomic(migration.BackupPath, migration.Legacy, 0644)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to back up legacy config to %s: %v", migration.BackupPath, err)
+        }
+    }
+
+    err = save(path, store)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return store, migration, nil
+}
+
+// Read decodes the store at path, upgrading older layouts in memory. The
+// returned migration is nil when the file is already current.
+func Read(path string) (*Store, *Migration, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return &Store{Version: Version}, nil, nil
+        }
+        return nil, nil, err
+    }
+
+    trimmed := strings.TrimSpace(string(data))
+    if trimmed == "" {
+        return &Store{Version: Version}, nil, nil
+    }
+
+    // Anything that is not a JSON document is the legacy flat file
+    if !strings.HasPrefix(trimmed, "{") {
+        migration := &Migration{From: 0, To: Version, Legacy: data, BackupPath: path + ".bak"}
+        return ParseLegacy(data), migration, nil
+    }
+
+    store := &Store{}
+    err = json.Unmarshal(data, store)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    store.Duplicates = store.Reindex()
+
+    if store.Version > Version {
+        return nil, nil, fmt.Errorf("%s uses schema version %d, but this abbtr only supports up to version %d", path, store.Version, Version)
+    }
+    if store.Version == Version {
+        return store, nil, nil
+    }
+
+    migration := &Migration{From: store.Version, To: Version}
+    for store.Version < Version {
+        migrate, ok := migrations[store.Version]
+        if !ok {
+            return nil, nil, fmt.Errorf("no migration available from schema version %d", store.Version)
+        }
+        err = migrate(store)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to migrate from schema version %d: %v", store.Version, err)
+        }
+        store.Version++
+    }
+
+    return store, migration, nil
+}
+
+// save writes the whole store to path. Callers hold the lock.
+func save(path string, store *Store) error {
+    store.Version = Version
+    if store.Rules == nil {
+        store.Rules = []Rule{}
+    }
+
+    var buf strings.Builder
+    encoder := json.NewEncoder(&buf)
+    // Keep commands such as 'a && b' readable in the file
+    encoder.SetEscapeHTML(false)
+    encoder.SetIndent("", "  ")
+    err := encoder.Encode(store)
+    if err != nil {
+        return fmt.Errorf("failed to encode rules: %v", err)
+    }
+
+    return fsutil.WriteFileAtomic(path, []byte(buf.String()), 0644)
+}
+
+// ParseLegacy reads the "name = command" format used before the structured
+// store existed. As with JSON files, only the first definition of a name is
+// kept and the others are listed in Duplicates.
+func ParseLegacy(data []byte) *Store {
+    store := &Store{Version: Version}
+
+    scanner := bufio.NewScanner(strings.NewReader(string(data)))
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        parts := strings.SplitN(scanner.Text(), "=", 2)
+        if len(parts) != 2 {
+            continue
+        }
+        name := strings.TrimSpace(parts[0])
+        command := strings.TrimSpace(parts[1])
+        if name == "" {
+            continue
+        }
+        if store.Find(name) != nil {
+            store.Duplicates = append(store.Duplicates, name)
+            continue
+        }
+        store.Add(name, command)
+    }
+
+    return store
+}
+
+// ValidateName checks that a name can be used as a script name and typed as
+// a single word
+func ValidateName(name string) error {
+    if name == "" || name == "." || name == ".." {
+        return fmt.Errorf("'%s' is not a valid rule name", name)
+    }
+    if strings.HasPrefix(name, "-") {
+        return fmt.Errorf("rule names cannot start with '-'")
+    }
+    if strings.ContainsRune(name, '/') {
+        return fmt.Errorf("rule names cannot contain '/'")
+    }
+    for _, r := range name {
+        if unicode.IsSpace(r) || unicode.IsControl(r) {
+            return fmt.Errorf("rule names cannot contain spaces")
+        }
+    }
+    return nil
+}
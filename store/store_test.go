@@ -0,0 +1,433 @@
+package store
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "abbtr/bottles"
+    "abbtr/internal/corpus"
+)
+
+func tempConfig(t *testing.T) string {
+    t.Helper()
+    return filepath.Join(t.TempDir(), "abbtr.conf")
+}
+
+func TestRoundTrip(t *testing.T) {
+    path := tempConfig(t)
+
+    _, _, err := Update(path, func(s *Store) error {
+        for i, tc := range corpus.Commands {
+            s.Add(strings.Repeat("r", i+1), tc.Command)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    loaded, migration, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if migration != nil {
+        t.Errorf("unexpected migration from version %d", migration.From)
+    }
+    for i, tc := range corpus.Commands {
+        rule := loaded.Find(strings.Repeat("r", i+1))
+        if rule == nil {
+            t.Fatalf("%s: rule not found after reload", tc.Name)
+        }
+        if rule.Command != tc.Command {
+            t.Errorf("%s: got %q, want %q", tc.Name, rule.Command, tc.Command)
+        }
+    }
+}
+
+func TestLegacyMigration(t *testing.T) {
+    path := tempConfig(t)
+    legacy := "update = sudo apt update -y\nbroken line\nssh = ssh b%('user')%b@host = x\nupdate = echo duplicate\n"
+    err := os.WriteFile(path, []byte(legacy), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s, migration, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if migration == nil || migration.Legacy == nil {
+        t.Fatal("the legacy file was not migrated")
+    }
+    if got := strings.Join(s.Names(), ","); got != "update,ssh" {
+        t.Errorf("got rules %s", got)
+    }
+    if got := strings.Join(s.Duplicates, ","); got != "update" {
+        t.Errorf("got duplicates %q", got)
+    }
+    if rule := s.Find("ssh"); rule == nil || rule.Command != "ssh b%('user')%b@host = x" {
+        t.Errorf("command was not kept whole: %+v", rule)
+    }
+
+    backup, err := os.ReadFile(migration.BackupPath)
+    if err != nil || string(backup) != legacy {
+        t.Errorf("backup does not hold the legacy file: %v", err)
+    }
+
+    // The converted file loads without another migration
+    _, migration, err = Load(path)
+    if err != nil || migration != nil {
+        t.Errorf("second load migrated again: %v", err)
+    }
+}
+
+func TestSchemaMigration(t *testing.T) {
+    path := tempConfig(t)
+    err := os.WriteFile(path, []byte(`{"version": 1, "rules": [{"name": "a", "command": "echo a"}, {"name": "b", "command": "@a; mail @home"}]}`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s, migration, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if migration == nil || migration.From != 1 || migration.To != Version || migration.Legacy != nil {
+        t.Fatalf("unexpected migration %+v", migration)
+    }
+    if s.Find("a") == nil {
+        t.Error("rule lost in the migration")
+    }
+    if refs := s.Find("b").Refs; !reflect.DeepEqual(refs, []string{"a"}) {
+        t.Errorf("got references %v", refs)
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(data), fmt.Sprintf(`"version": %d`, Version)) {
+        t.Errorf("the migrated store was not written:\n%s", data)
+    }
+}
+
+func TestFindIsExact(t *testing.T) {
+    path := tempConfig(t)
+
+    err := os.WriteFile(path, []byte(`{"version": 1, "rules": [
+        {"name": "ab", "command": "echo ab"},
+        {"name": "a", "command": "echo a"},
+        {"name": "a b", "command": "echo space"},
+        {"name": "a", "command": "echo duplicate"}
+    ]}`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s, _, err := Read(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(s.Rules) != 3 || strings.Join(s.Duplicates, ",") != "a" {
+        t.Fatalf("duplicate was not dropped, got %d rules", len(s.Rules))
+    }
+
+    for name, want := range map[string]string{"a": "echo a", "ab": "echo ab", "a b": "echo space"} {
+        rule := s.Find(name)
+        if rule == nil || rule.Command != want {
+            t.Errorf("%q: got %+v, want %q", name, rule, want)
+        }
+    }
+    if s.Find("a b c") != nil || s.Find("") != nil {
+        t.Error("found a rule that does not exist")
+    }
+
+    s.Remove("ab")
+    if s.Find("a") == nil || s.Find("a b") == nil || s.Find("ab") != nil {
+        t.Error("index is stale after remove")
+    }
+}
+
+func TestUpdateAbandonsFailedChanges(t *testing.T) {
+    path := tempConfig(t)
+
+    _, _, err := Update(path, func(s *Store) error {
+        s.Add("kept", "echo kept")
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, _, err = Update(path, func(s *Store) error {
+        s.Remove("kept")
+        return ErrNotFound
+    })
+    if err != ErrNotFound {
+        t.Fatalf("got %v, want ErrNotFound", err)
+    }
+
+    s, _, err := Read(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s.Find("kept") == nil {
+        t.Error("a failed change was written")
+    }
+}
+
+func TestNewerVersionIsRefused(t *testing.T) {
+    path := tempConfig(t)
+    err := os.WriteFile(path, []byte(fmt.Sprintf(`{"version": %d, "rules": []}`, Version+1)), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, _, err = Read(path)
+    if err == nil {
+        t.Error("expected an error for a newer schema")
+    }
+}
+
+func TestValidateName(t *testing.T) {
+    for _, name := range []string{"update", "gs", "deploy.prod", "a_b-c", "ü"} {
+        if err := ValidateName(name); err != nil {
+            t.Errorf("%q: %v", name, err)
+        }
+    }
+    for _, name := range []string{"", ".", "..", "-x", "a b", "a/b", "tab\tname"} {
+        if err := ValidateName(name); err == nil {
+            t.Errorf("%q: expected an error", name)
+        }
+    }
+}
+
+func TestImportCandidates(t *testing.T) {
+    s := &Store{Rules: []Rule{{Name: "build", Command: "make"}}}
+    taken := func(name string) error {
+        if name == "pipx" {
+            return fmt.Errorf("'%s' is taken", name)
+        }
+        return nil
+    }
+
+    candidates := s.ImportCandidates([]Rule{{Name: "build"}, {Name: "pipx"}, {Name: "a b"}, {Name: "test"}}, taken)
+    if len(candidates) != 4 || !candidates[0].Replaces || candidates[0].Err != nil {
+        t.Fatalf("got %+v", candidates)
+    }
+    if candidates[1].Err == nil || candidates[2].Err == nil || candidates[3].Err != nil || candidates[3].Replaces {
+        t.Errorf("got %+v", candidates)
+    }
+}
+
+func TestExport(t *testing.T) {
+    s := &Store{Rules: []Rule{
+        {Name: "build", Command: "make"},
+        {Name: "ssh", Command: "ssh b%('host')%b"},
+    }}
+    profiles := &Profiles{Profiles: map[string]map[string]string{"prod": {"host": "web1"}}}
+
+    lines, values := Export(s, []string{"build"}, profiles, "mine")
+    if len(lines) != 3 || lines[0] != ExportHeader() || lines[1] != "#mine" || values {
+        t.Errorf("got %q, %v", lines, values)
+    }
+    lines, values = Export(s, []string{"ssh"}, profiles, "")
+    if len(lines) != 3 || lines[2] != ProfileExportLine("prod", "host", "web1") || !values {
+        t.Errorf("got %q, %v", lines, values)
+    }
+    imported, err := ParseExport(strings.Join(lines, "\n"))
+    if err != nil || len(imported) != 1 || imported[0].Command != "ssh b%('host')%b" {
+        t.Errorf("got %+v, %v", imported, err)
+    }
+    if lines, _ = Export(s, []string{"ssh"}, nil, ""); len(lines) != 2 {
+        t.Errorf("got %q", lines)
+    }
+}
+
+func TestExportRoundTrip(t *testing.T) {
+    for _, tc := range corpus.Commands {
+        t.Run(tc.Name, func(t *testing.T) {
+            rule := &Rule{Name: "rule", Command: tc.Command, Description: tc.Command}
+            exported := ExportHeader() + "\n#comment\n" + ExportLine(rule) + "\n"
+            if strings.Count(exported, "\n") != 3 {
+                t.Fatalf("export spans several lines: %q", exported)
+            }
+
+            rules, err := ParseExport(exported)
+            if err != nil || len(rules) != 1 {
+                t.Fatalf("got %d rules from %q: %v", len(rules), exported, err)
+            }
+            if rules[0].Name != "rule" || rules[0].Command != tc.Command || rules[0].Description != tc.Command {
+                t.Errorf("got %q = %q, want %q", rules[0].Name, rules[0].Command, tc.Command)
+            }
+        })
+    }
+}
+
+func TestLegacyExport(t *testing.T) {
+    // Files written before the rules carried their metadata
+    legacy := "#comment\nb:gs = git status &amp;&amp; echo &#58;b &#32;:b\nb:up = sudo apt update -y:b b:ls = ls -la:b\n"
+    rules, err := ParseExport(legacy)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []Rule{{Name: "gs", Command: "git status && echo :b  "}, {Name: "up", Command: "sudo apt update -y"}, {Name: "ls", Command: "ls -la"}}
+    if !reflect.DeepEqual(rules, want) {
+        t.Errorf("got %+v, want %+v", rules, want)
+    }
+}
+
+func TestExportMetadata(t *testing.T) {
+    created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    rule := Rule{
+        Name:        "deploy",
+        Command:     "./deploy.sh b%('env')%b",
+        Description: "Deploy: the b:site = x:b",
+        Tags:        []string{"web", "prod"},
+        Needs:       []string{"build", "test"},
+        Shell:       "python3",
+        Bottles:     map[string]bottles.Spec{"env": {Choices: []string{"dev", "prod"}, Pattern: "[a-z]+:r"}},
+        Created:     created,
+        Updated:     created,
+    }
+
+    rules, err := ParseExport(ExportHeader() + "\n" + ExportLine(&rule) + "\n")
+    if err != nil || len(rules) != 1 {
+        t.Fatalf("got %+v: %v", rules, err)
+    }
+    if !reflect.DeepEqual(rules[0], rule) {
+        t.Errorf("got %+v, want %+v", rules[0], rule)
+    }
+
+    _, err = ParseExport("#abbtr export format 3\nr:{}:r\n")
+    if err == nil || !strings.Contains(err.Error(), "format 3") {
+        t.Errorf("a newer format was read: %v", err)
+    }
+}
+
+func TestConcurrentUpdatesKeepEveryRule(t *testing.T) {
+    if writer := os.Getenv("ABBTR_TEST_WRITER"); writer != "" {
+        // Running as one of the concurrent writers below
+        for i := 0; i < 5; i++ {
+            name := fmt.Sprintf("%s-%d", writer, i)
+            _, _, err := Update(os.Getenv("ABBTR_TEST_CONFIG"), func(s *Store) error {
+                s.Add(name, "echo "+name)
+                return nil
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+        return
+    }
+
+    path := tempConfig(t)
+
+    var writers []*exec.Cmd
+    for i := 0; i < 8; i++ {
+        cmd := exec.Command(os.Args[0], "-test.run=TestConcurrentUpdatesKeepEveryRule")
+        cmd.Env = append(os.Environ(), fmt.Sprintf("ABBTR_TEST_WRITER=w%d", i), "ABBTR_TEST_CONFIG="+path)
+        err := cmd.Start()
+        if err != nil {
+            t.Fatal(err)
+        }
+        writers = append(writers, cmd)
+    }
+    for _, cmd := range writers {
+        err := cmd.Wait()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    s, _, err := Read(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(s.Rules) != 40 {
+        t.Errorf("got %d rules, want 40", len(s.Rules))
+    }
+
+    // No temporary file may be left behind
+    entries, err := os.ReadDir(filepath.Dir(path))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, entry := range entries {
+        if strings.Contains(entry.Name(), ".tmp-") {
+            t.Errorf("leftover temporary file %s", entry.Name())
+        }
+    }
+}
+
+func TestDelete(t *testing.T) {
+    newStore := func() *Store {
+        s := &Store{Rules: []Rule{
+            {Name: "build", Command: "make"},
+            {Name: "test", Command: "go test", Needs: []string{"build"}},
+            {Name: "ship", Command: "@test && rsync"},
+            {Name: "lint", Command: "go vet"},
+        }}
+        updateAllRefs(s)
+        return s
+    }
+
+    // Rules deleted together may use each other, a rule kept keeps the rules
+    // it uses
+    s := newStore()
+    deletion := s.Delete([]string{"build", "test", "lint", "nope", "lint"}, false)
+    if !reflect.DeepEqual(deletion.Deleted, []string{"lint"}) || !reflect.DeepEqual(deletion.Missing, []string{"nope", "lint"}) {
+        t.Errorf("got %+v", deletion)
+    }
+    want := map[string][]string{"test": {"ship"}, "build": {"test"}}
+    if !reflect.DeepEqual(deletion.Blocked, want) || len(deletion.Orphaned) != 0 {
+        t.Errorf("got %+v, want blocked %v", deletion, want)
+    }
+    if !reflect.DeepEqual(s.Names(), []string{"build", "test", "ship"}) {
+        t.Errorf("got %v", s.Names())
+    }
+
+    s = newStore()
+    deletion = s.Delete([]string{"build", "test", "ship"}, false)
+    if len(deletion.Deleted) != 3 || len(s.Rules) != 1 {
+        t.Errorf("got %+v", deletion)
+    }
+
+    s = newStore()
+    deletion = s.Delete([]string{"build"}, true)
+    if !reflect.DeepEqual(deletion.Deleted, []string{"build"}) || !reflect.DeepEqual(deletion.Orphaned, []string{"test"}) {
+        t.Errorf("got %+v", deletion)
+    }
+}
+
+func TestCloneAndImport(t *testing.T) {
+    s := &Store{Shell: "zsh", Rules: []Rule{
+        {Name: "build", Command: "make", Tags: []string{"ci"}, Bottles: map[string]bottles.Spec{"target": {Type: "path"}}},
+    }}
+
+    clone := s.Clone()
+    clone.Find("build").Tags[0] = "changed"
+    clone.Find("build").Bottles["target"] = bottles.Spec{}
+    clone.Add("test", "go test")
+    if s.Find("build").Tags[0] != "ci" || s.Find("build").Bottles["target"].Type != "path" || s.Find("test") != nil {
+        t.Errorf("the clone shares its rules with the original: %+v", s.Rules)
+    }
+    if clone.Shell != "zsh" {
+        t.Errorf("got %+v", clone)
+    }
+
+    // References are resolved against the rules once all are imported
+    s.Import([]Rule{
+        {Name: "ship", Command: "@build && @deploy", Refs: []string{"elsewhere"}},
+        {Name: "deploy", Command: "rsync"},
+    })
+    if refs := s.Find("ship").Refs; !reflect.DeepEqual(refs, []string{"build", "deploy"}) {
+        t.Errorf("got refs %v", refs)
+    }
+}